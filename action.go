@@ -1,5 +1,9 @@
 package botmeans
 
+import (
+	"log"
+)
+
 //ActionHandler defines the type of handler function
 type ActionHandler func(context ActionContextInterface)
 
@@ -17,6 +21,10 @@ type ChatSession interface {
 	IsOneToOne() bool
 	SetLocale(string)
 	Locale() string
+	Roles() []string
+	HasRole(string) bool
+	GrantRole(string)
+	RevokeRole(string)
 }
 
 type ActionSessionInterface interface {
@@ -27,10 +35,32 @@ type ActionSessionInterface interface {
 	Locale() string
 }
 
+type chatOwner interface {
+	Chat() ChatInterface
+}
+
+type userOwner interface {
+	User() UserInterface
+}
+
+//chatLocalizedSession prefers the chat locale over the user's one, if the chat locale is set
+type chatLocalizedSession struct {
+	senderSession
+	chat ChatInterface
+}
+
+func (s chatLocalizedSession) Locale() string {
+	if l := s.chat.Locale(); l != "" {
+		return l
+	}
+	return s.senderSession.Locale()
+}
+
 type actionExecuterFactoryConfig struct {
 	cmdGetter       func() string
 	argsGetter      func() Args
 	sourceMsgGetter func() BotMessageInterface
+	userGetter      func() UserInterface
 }
 
 //ActionFactory generates Executers
@@ -91,12 +121,27 @@ type Action struct {
 	err              interface{}
 	execChan         chan Executer
 	passedCmd        string
+	work             *unitOfWork
+	sourceMsg        BotMessageInterface
 }
 
 //Execute implements Execute for BotMachine
 func (a *Action) Execute() {
+	a.work = beginWork(a.session)
 	defer func() {
 		r := recover()
+		if a.work != nil {
+			if r == nil {
+				if err := a.work.flush(); err != nil {
+					log.Printf("Cannot save changes of chat %v: %v", a.Id(), err)
+				} else {
+					a.work.deliver()
+				}
+			} else {
+				a.work.rollback()
+			}
+			a.work = nil
+		}
 		if _, ok := r.(AbortedContextError); !ok {
 			if r != nil {
 				panic(r)
@@ -116,6 +161,9 @@ func (a *Action) Execute() {
 	if !ok {
 		return
 	}
+	if s, ok := a.session.(*Session); ok {
+		s.command = a.LastCommand
+	}
 	handler, _ := a.handlersProvider(a.LastCommand)
 	handler(a)
 	a.session.SetData(*a)
@@ -149,14 +197,70 @@ func (a *Action) Session() ChatSession {
 	return nil
 }
 
+//Chat allow user to access the chat-wide data inside ActionHandler through the Context()
+func (a *Action) Chat() ChatInterface {
+	if v, ok := a.session.(chatOwner); ok {
+		return v.Chat()
+	}
+	return nil
+}
+
+//User allow user to access the global profile of the user inside ActionHandler through the Context()
+func (a *Action) User() UserInterface {
+	if a.getters.userGetter != nil {
+		if u := a.getters.userGetter(); u != nil {
+			return u
+		}
+	}
+	if v, ok := a.session.(userOwner); ok {
+		return v.User()
+	}
+	return nil
+}
+
 //SourceMessage allow user to access the session inside ActionHandler through the Context()
 func (a *Action) SourceMessage() BotMessageInterface {
-	return a.getters.sourceMsgGetter()
+	if a.work == nil {
+		return a.getters.sourceMsgGetter()
+	}
+	if a.sourceMsg == nil {
+		a.sourceMsg = a.work.attach(a.getters.sourceMsgGetter())
+	}
+	return a.sourceMsg
 }
 
 //Output allow user to access the OutMsgFactoryInterface inside ActionHandler through the Context()
 func (a *Action) Output() OutMsgFactoryInterface {
-	return a.senderFactory(a.session)
+	var sender SenderInterface
+	if chat := a.Chat(); chat != nil {
+		sender = a.senderFactory(chatLocalizedSession{a.session, chat})
+	} else {
+		sender = a.senderFactory(a.session)
+	}
+	if s, ok := sender.(*Sender); ok && a.work != nil {
+		msgFactory, work := s.msgFactory, a.work
+		s.msgFactory = func() BotMessageInterface { return work.attach(msgFactory()) }
+		if work.outboxEnabled && (s.bot != nil || s.scheduler != nil) {
+			s.outbox = work
+		}
+	}
+	if s, ok := sender.(*Sender); ok {
+		s.sourceMsgID = a.sourceMessageID()
+	}
+	return sender
+}
+
+//sourceMessageID returns the id of the message the command came from
+func (a *Action) sourceMessageID() int64 {
+	if a.getters.argsGetter == nil {
+		return 0
+	}
+	if source, ok := a.getters.argsGetter().(interface {
+		sourceMessageID() int64
+	}); ok {
+		return source.sourceMessageID()
+	}
+	return 0
 }
 
 //Finish allow user to access finish command processing inside ActionHandler through the Context()
@@ -208,9 +312,11 @@ func (helper execHelper) Execute() {
 //Can be used to exec commands for chat created from another chat
 func (a *Action) ExecuteInSession(s ChatSession, f ActionHandler) {
 	if session, ok := s.(ActionSessionInterface); ok {
+		getters := a.getters
+		getters.userGetter = nil
 		a.execChan <- execHelper{&Action{
 			session:          session,
-			getters:          a.getters,
+			getters:          getters,
 			handlersProvider: a.handlersProvider,
 			senderFactory:    a.senderFactory,
 		}, f}
@@ -224,6 +330,8 @@ type ActionContextInterface interface {
 	Output() OutMsgFactoryInterface
 	Error(interface{})
 	Session() ChatSession
+	Chat() ChatInterface
+	User() UserInterface
 	SourceMessage() BotMessageInterface
 	Finish()
 	ExecuteInSession(s ChatSession, f ActionHandler)
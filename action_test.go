@@ -55,6 +55,7 @@ func TestActionExecute(t *testing.T) {
 			func() string { return "cmd1" },
 			func() Args { return args{[]arg{arg{"/cmd1"}, arg{"ffuuu"}, arg{9.75}}, ""} },
 			func() BotMessageInterface { return &BotMessage{} },
+			func() UserInterface { return nil },
 		},
 		func(senderSession) SenderInterface { return sender },
 		out,
@@ -0,0 +1,163 @@
+package botmeans
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+)
+
+//DataChange is the entry of the session data audit trail. Before and After keep the stored JSON
+//of the value under DataKey, empty if there was no value. Encrypted values are kept encrypted
+type DataChange struct {
+	ID        int64 `sql:"index;unique"`
+	SessionID int64 `sql:"index"`
+	Command   string
+	DataKey   string
+	Before    string `sql:"type:text"`
+	After     string `sql:"type:text"`
+	ChangedAt time.Time
+}
+
+//AuditStorage keeps the append-only audit trail of session data changes
+type AuditStorage interface {
+	AppendDataChanges(changes []*DataChange) error
+	//DataChanges returns the changes of the session, the oldest first
+	DataChanges(sessionID int64) ([]*DataChange, error)
+	//PruneDataChanges deletes the changes made before given time and returns their number
+	PruneDataChanges(before time.Time) (int, error)
+	//DeleteDataChanges deletes all changes of the session, e.g. when personal data is erased
+	DeleteDataChanges(sessionID int64) error
+}
+
+//auditingStorage records the changes of UserData made by saved sessions
+type auditingStorage struct {
+	Storage
+}
+
+//AuditSessionData makes the storage record every change of session UserData, e.g. made by SetData or SetLocale,
+//with the command being executed. The underlying storage should implement AuditStorage.
+//Internal command state of the sessions is not recorded
+func AuditSessionData(storage Storage) Storage {
+	return &auditingStorage{storage}
+}
+
+//SaveSession implements SessionStorage. The stored data is read, the session saved and the changes recorded in one transaction
+func (s *auditingStorage) SaveSession(session *Session) error {
+	id, version := session.ID, session.Version
+	err := inTransaction(s.Storage, func(tx Storage) error {
+		before := "{}"
+		if session.ID != 0 {
+			if stored, err := tx.SessionByID(session.ID); err == nil {
+				before = stored.UserData
+			}
+		}
+		if err := tx.SaveSession(session); err != nil {
+			return err
+		}
+		changes := dataChanges(before, session.UserData)
+		if len(changes) == 0 {
+			return nil
+		}
+		audit, ok := auditStorage(tx)
+		if !ok {
+			log.Printf("Storage %T does not support audit", underlyingStorage(tx))
+			return nil
+		}
+		now := time.Now()
+		for _, c := range changes {
+			c.SessionID = session.ID
+			c.Command = session.command
+			c.ChangedAt = now
+		}
+		return audit.AppendDataChanges(changes)
+	})
+	if err != nil {
+		session.ID, session.Version = id, version
+	}
+	return err
+}
+
+//Transaction implements TransactionalStorage
+func (s *auditingStorage) Transaction(f func(tx Storage) error) error {
+	return inTransaction(s.Storage, func(tx Storage) error {
+		return f(&auditingStorage{tx})
+	})
+}
+
+func (s *auditingStorage) unwrap() Storage {
+	return s.Storage
+}
+
+//dataChanges compares UserData values key by key
+func dataChanges(before string, after string) (ret []*DataChange) {
+	beforeContainer, afterContainer := dataContainer(before), dataContainer(after)
+	keys := []string{}
+	for key := range beforeContainer {
+		keys = append(keys, key)
+	}
+	for key := range afterContainer {
+		if _, ok := beforeContainer[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	actionKey := dataKeyFor(Action{})
+	for _, key := range keys {
+		if key == dataVersionsKey || key == actionKey {
+			continue
+		}
+		b, a := rawString(beforeContainer[key]), rawString(afterContainer[key])
+		if b == a || samePlainValue(key, beforeContainer[key], afterContainer[key]) {
+			continue
+		}
+		ret = append(ret, &DataChange{DataKey: key, Before: b, After: a})
+	}
+	return
+}
+
+//samePlainValue checks if both values are present and equal after decryption
+func samePlainValue(key string, a *json.RawMessage, b *json.RawMessage) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	plainA, _, errA := decryptValue(key, *a)
+	plainB, _, errB := decryptValue(key, *b)
+	return errA == nil && errB == nil && bytes.Equal(plainA, plainB)
+}
+
+//auditStorage returns AuditStorage behind the wrappers
+func auditStorage(storage Storage) (AuditStorage, bool) {
+	audit, ok := underlyingStorage(storage).(AuditStorage)
+	return audit, ok
+}
+
+//DataChanges returns the audit trail of the session, the oldest first
+func DataChanges(storage Storage, sessionID int64) ([]*DataChange, error) {
+	if audit, ok := auditStorage(storage); ok {
+		return audit.DataChanges(sessionID)
+	}
+	return nil, nil
+}
+
+//PruneDataChanges deletes the audit trail entries made before given time
+func PruneDataChanges(storage Storage, before time.Time) (int, error) {
+	if audit, ok := auditStorage(storage); ok {
+		return audit.PruneDataChanges(before)
+	}
+	return 0, nil
+}
+
+//deleteDataChanges deletes the audit trail of the session
+func deleteDataChanges(storage Storage, sessionID int64) error {
+	if audit, ok := auditStorage(storage); ok {
+		return audit.DeleteDataChanges(sessionID)
+	}
+	return nil
+}
+
+//SessionDataChanges returns the audit trail of the session
+func (ui *MeansBot) SessionDataChanges(session Identifiable) ([]*DataChange, error) {
+	return DataChanges(ui.storage, session.Id())
+}
@@ -0,0 +1,69 @@
+package botmeans
+
+import (
+	"testing"
+	"time"
+)
+
+type Settings struct {
+	Notify bool
+}
+
+func TestAuditSessionData(t *testing.T) {
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	for name, storage := range storages {
+		audited := AuditSessionData(storage)
+		session := &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramChatID: 100}, UserData: "{}", storage: audited}
+		session.command = "settings"
+		session.SetData(Settings{true})
+		session.SetData(Settings{true})
+		session.command = "lang"
+		session.SetLocale("ru")
+		session.SetData(Action{LastCommand: "lang"})
+
+		changes, err := DataChanges(audited, session.ID)
+		if err != nil || len(changes) != 2 {
+			t.Fatal(name, "Should be 2 changes", len(changes), err)
+		}
+		if c := changes[0]; c.Command != "settings" || c.DataKey != dataKeyFor(Settings{}) || c.Before != "" || c.After != `{"Notify":true}` {
+			t.Error(name, "Wrong change", c)
+		}
+		if c := changes[1]; c.Command != "lang" || c.DataKey != dataKeyFor(localeData("")) || c.After != `"ru"` || c.ChangedAt.IsZero() {
+			t.Error(name, "Wrong change", c)
+		}
+
+		err = inTransaction(audited, func(tx Storage) error {
+			s, _ := tx.SessionByID(session.ID)
+			s.UserData = serialize(s.UserData, Settings{false})
+			return tx.SaveSession(s)
+		})
+		if changes, _ := DataChanges(audited, session.ID); err != nil || len(changes) != 3 || changes[2].Before != `{"Notify":true}` {
+			t.Error(name, "Change in transaction should be recorded", len(changes), err)
+		}
+
+		if data, err := ExportPersonalData(audited, 1, nil); err != nil || len(data.Sessions) != 1 || len(data.Sessions[0].DataChanges) != 3 ||
+			string(data.Sessions[0].DataChanges[2].After) != `{"Notify":false}` {
+			t.Error(name, "Audit trail should be exported", err)
+		}
+		other := &Session{SessionBase: SessionBase{TelegramUserID: 2, TelegramChatID: 100}, UserData: "{}", storage: audited}
+		other.SetData(Settings{true})
+		if err := ErasePersonalData(audited, 1, AnonymizePersonalData, nil); err != nil {
+			t.Error(name, err)
+		}
+		if changes, _ := DataChanges(audited, session.ID); len(changes) != 0 {
+			t.Error(name, "Audit trail should be erased with personal data", changes)
+		}
+		if changes, _ := DataChanges(audited, other.ID); len(changes) != 1 {
+			t.Error(name, "Audit trail of other users should be kept", changes)
+		}
+
+		if n, err := PruneDataChanges(audited, time.Now().Add(time.Hour)); err != nil || n != 1 {
+			t.Error(name, "Changes should be pruned", n, err)
+		}
+		if changes, _ := DataChanges(audited, session.ID); len(changes) != 0 {
+			t.Error(name, "Should be no changes after pruning", len(changes))
+		}
+	}
+}
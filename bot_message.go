@@ -2,7 +2,6 @@ package botmeans
 
 import (
 	"fmt"
-	"github.com/jinzhu/gorm"
 	"time"
 )
 
@@ -21,7 +20,7 @@ type BotMessage struct {
 	TelegramMsgID  int64  `sql:"index"`
 	TelegramChatID int64  `sql:"index"`
 	UserData       string `sql:"type:jsonb"`
-	db             *gorm.DB
+	storage        BotMessageStorage
 	callbackID     string
 	Timestamp      time.Time
 }
@@ -35,20 +34,18 @@ func (botMessage *BotMessage) SetData(value interface{}) {
 
 //GetData extracts internal UserData field to given value
 func (botMessage *BotMessage) GetData(value interface{}) {
-	deserialize(botMessage.UserData, value)
+	if upgraded, changed := deserialize(botMessage.UserData, value); changed {
+		botMessage.UserData = upgraded
+		botMessage.Save()
+	}
 }
 
 //Save implements PersistentSaver
 func (botMessage *BotMessage) Save() error {
-	if botMessage.db != nil {
-		return botMessage.db.Save(botMessage).Error
+	if botMessage.storage != nil {
+		return botMessage.storage.SaveBotMessage(botMessage)
 	}
-	return fmt.Errorf("db not set")
-}
-
-//BotMessageInitDB prepares sql tables for BotMessage
-func BotMessageInitDB(db *gorm.DB) {
-	db.AutoMigrate(&BotMessage{})
+	return fmt.Errorf("storage not set")
 }
 
 //Id identifies the message
@@ -66,13 +63,15 @@ func (botMessage *BotMessage) CallbackID() string {
 	return botMessage.callbackID
 }
 
-//BotMessageDBLoader loads the message from db
-func BotMessageDBLoader(TelegramChatID int64, TelegramMsgID int64, CallbackID string, db *gorm.DB) BotMessageInterface {
+//BotMessageDBLoader loads the message from the storage
+func BotMessageDBLoader(TelegramChatID int64, TelegramMsgID int64, CallbackID string, storage BotMessageStorage) BotMessageInterface {
 	ret := &BotMessage{}
 	if TelegramMsgID != 0 {
-		db.Where("telegram_chat_id=? and telegram_msg_id=?", TelegramChatID, TelegramMsgID).Find(ret)
+		if msg, err := storage.FindBotMessage(TelegramChatID, TelegramMsgID); err == nil {
+			ret = msg
+		}
 	}
-	ret.db = db
+	ret.storage = storage
 	ret.callbackID = CallbackID
 	ret.TelegramChatID = TelegramChatID
 	ret.TelegramMsgID = TelegramMsgID
@@ -80,9 +79,9 @@ func BotMessageDBLoader(TelegramChatID int64, TelegramMsgID int64, CallbackID st
 }
 
 //NewBotMessage creates empty message
-func NewBotMessage(TelegramChatID int64, db *gorm.DB) BotMessageInterface {
+func NewBotMessage(TelegramChatID int64, storage BotMessageStorage) BotMessageInterface {
 	ret := &BotMessage{}
-	ret.db = db
+	ret.storage = storage
 	ret.TelegramChatID = TelegramChatID
 	ret.UserData = "{}"
 	ret.Timestamp = time.Now()
@@ -0,0 +1,246 @@
+package botmeans
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+//ErrBroadcastRunning is returned when the broadcast with the same name is running already
+var ErrBroadcastRunning = fmt.Errorf("Broadcast is running already")
+
+//BroadcastTarget selects the chats receiving the broadcast
+type BroadcastTarget int
+
+const (
+	//BroadcastUsers sends to one-to-one chats
+	BroadcastUsers BroadcastTarget = iota
+	//BroadcastGroups sends once to each group chat
+	BroadcastGroups
+	//BroadcastAll sends to one-to-one chats and once to each group chat
+	BroadcastAll
+)
+
+//Broadcast is the job sending the template to many sessions
+type Broadcast struct {
+	//Name identifies the job. The progress is stored under the name, so the job started again resumes
+	Name     string
+	Template string
+	Target   BroadcastTarget
+	//Recipients selects the sessions, all sessions if nil. Sessions are processed in the order of their ids,
+	//so order, offset and limit of the query are ignored
+	Recipients *DataQuery
+	//Data returns the template data for the recipient. Optional
+	Data func(session ChatSession) interface{}
+	//Options are passed to Create, e.g. Silent(true). Optional
+	Options []MessageOption
+	//OnProgress is called after each recipient. Optional
+	OnProgress func(BroadcastState)
+}
+
+//BroadcastState is the progress of the broadcast
+type BroadcastState struct {
+	ID   int64  `sql:"index;unique"`
+	Name string `sql:"index;unique"`
+	//LastSessionID is the id of the last processed session
+	LastSessionID int64
+	//Total is the number of recipients counted when the broadcast has started
+	Total     int
+	Delivered int
+	//Blocked counts chats which blocked the bot or removed it
+	Blocked   int
+	Failed    int
+	Done      bool
+	StartedAt time.Time
+	UpdatedAt time.Time
+}
+
+//BroadcastStorage keeps the progress of broadcasts
+type BroadcastStorage interface {
+	FindBroadcast(name string) (*BroadcastState, error)
+	SaveBroadcast(state *BroadcastState) error
+}
+
+//broadcastStorage returns BroadcastStorage behind the wrappers
+func broadcastStorage(storage Storage) (BroadcastStorage, bool) {
+	broadcasts, ok := underlyingStorage(storage).(BroadcastStorage)
+	return broadcasts, ok
+}
+
+type sessionsByID []*Session
+
+func (s sessionsByID) Len() int           { return len(s) }
+func (s sessionsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s sessionsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//broadcastRecipients selects the sessions of the target chats, keeping the first matching session of each group chat
+type broadcastRecipients struct {
+	storage SessionStorage
+	query   *DataQuery
+	target  BroadcastTarget
+	//groups keeps the id of the first matching session of the group chats seen
+	groups map[int64]int64
+}
+
+func newBroadcastRecipients(storage SessionStorage, q *DataQuery, target BroadcastTarget) *broadcastRecipients {
+	return &broadcastRecipients{storage, q, target, make(map[int64]int64)}
+}
+
+//has checks if the matching session is the recipient. The group chat is looked up, so the broadcast resumed
+//after the first session of the group doesn't send to the group again
+func (r *broadcastRecipients) has(s *Session) (bool, error) {
+	if s.IsOneToOne() {
+		return r.target != BroadcastGroups, nil
+	}
+	if r.target == BroadcastUsers {
+		return false, nil
+	}
+	first, ok := r.groups[s.TelegramChatID]
+	if !ok {
+		first = s.ID
+		sessions, err := r.storage.ChatSessions(s.TelegramChatID)
+		if err != nil {
+			return false, err
+		}
+		for _, other := range sessions {
+			if _, match := r.query.matchSession(other); match && other.ID < first {
+				first = other.ID
+			}
+		}
+		r.groups[s.TelegramChatID] = first
+	}
+	return s.ID == first, nil
+}
+
+//each calls f for the recipients with session ids greater than given one, in the order of ids
+func (r *broadcastRecipients) each(afterID int64, f func(*Session) error) error {
+	return r.query.eachSession(r.storage, afterID, func(s *Session, _ *queryRecord) error {
+		if ok, err := r.has(s); !ok || err != nil {
+			return err
+		}
+		return f(s)
+	})
+}
+
+//runBroadcast sends the template to the recipients not processed yet, saving the progress after each one
+func runBroadcast(storage Storage, b Broadcast, newSender senderFactory) (BroadcastState, error) {
+	if b.Name == "" || b.Template == "" {
+		return BroadcastState{}, fmt.Errorf("Broadcast should have name and template")
+	}
+	broadcasts, persistent := broadcastStorage(storage)
+	if !persistent {
+		log.Printf("Storage %T does not support broadcasts, progress of %v will not be saved", underlyingStorage(storage), b.Name)
+	}
+	state := &BroadcastState{Name: b.Name, StartedAt: time.Now()}
+	if persistent {
+		if stored, err := broadcasts.FindBroadcast(b.Name); err == nil && stored != nil {
+			state = stored
+		} else if err != nil && err != ErrNotFound {
+			return BroadcastState{}, err
+		}
+	}
+	if state.Done {
+		return *state, nil
+	}
+	save := func() error {
+		state.UpdatedAt = time.Now()
+		if persistent {
+			return broadcasts.SaveBroadcast(state)
+		}
+		return nil
+	}
+
+	q := b.Recipients
+	if q == nil {
+		q = NewDataQuery()
+	}
+	recipients := newBroadcastRecipients(storage, q, b.Target)
+	if state.Total == 0 {
+		//counted once, so the total doesn't change when the broadcast resumes
+		err := recipients.each(0, func(*Session) error {
+			state.Total++
+			return nil
+		})
+		if err != nil {
+			return *state, err
+		}
+	}
+	inactive := inactiveChatIDs(storage)
+	err := recipients.each(state.LastSessionID, func(s *Session) error {
+		s.storage = storage
+		if _, ok := inactive[s.TelegramChatID]; ok {
+			state.Blocked++
+		} else {
+			var data interface{}
+			if b.Data != nil {
+				data = b.Data(s)
+			}
+			switch err := newSender(chatLocalizedSession{s, s.Chat()}).Create(b.Template, data, b.Options...); {
+			case err == nil:
+				state.Delivered++
+			case err == ErrChatBlocked || isBlockedError(err):
+				state.Blocked++
+			default:
+				log.Printf("Cannot send broadcast %v to chat %v: %v", b.Name, s.TelegramChatID, err)
+				state.Failed++
+			}
+		}
+		state.LastSessionID = s.ID
+		if err := save(); err != nil {
+			return err
+		}
+		if b.OnProgress != nil {
+			b.OnProgress(*state)
+		}
+		return nil
+	})
+	if err != nil {
+		return *state, err
+	}
+	state.Done = true
+	return *state, save()
+}
+
+//StartBroadcast runs the broadcast in background within the limits of the send scheduler.
+//The channel receives the final state. Start the broadcast with the same name after restart to resume it.
+//Returns ErrBroadcastRunning if the broadcast with the same name is running in this bot
+func (ui *MeansBot) StartBroadcast(b Broadcast) (<-chan BroadcastState, error) {
+	ui.broadcastsMutex.Lock()
+	defer ui.broadcastsMutex.Unlock()
+	if _, running := ui.broadcasts[b.Name]; running {
+		return nil, ErrBroadcastRunning
+	}
+	if ui.broadcasts == nil {
+		ui.broadcasts = make(map[string]struct{})
+	}
+	ui.broadcasts[b.Name] = struct{}{}
+	ret := make(chan BroadcastState, 1)
+	go func() {
+		state, err := runBroadcast(ui.storage, b, ui.newSender)
+		if err != nil {
+			log.Printf("Broadcast %v stopped: %v", b.Name, err)
+		}
+		ui.broadcastsMutex.Lock()
+		delete(ui.broadcasts, b.Name)
+		ui.broadcastsMutex.Unlock()
+		ret <- state
+		close(ret)
+	}()
+	return ret, nil
+}
+
+//BroadcastProgress returns the stored progress of the broadcast
+func (ui *MeansBot) BroadcastProgress(name string) (BroadcastState, error) {
+	broadcasts, ok := broadcastStorage(ui.storage)
+	if !ok {
+		return BroadcastState{}, ErrNotFound
+	}
+	state, err := broadcasts.FindBroadcast(name)
+	if err != nil {
+		return BroadcastState{}, err
+	}
+	if state == nil {
+		return BroadcastState{}, ErrNotFound
+	}
+	return *state, nil
+}
@@ -0,0 +1,167 @@
+package botmeans
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBroadcast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botmeans_broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "news.json"), []byte(`{"Template": {"": "News for {{.}}", "ru": "Новости для {{.}}"}}`), 0600)
+
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	type Subscription struct{ Active bool }
+
+	for name, storage := range storages {
+		newSession := func(userID int64, chatID int64, locale string, subscribed bool) *Session {
+			s := &Session{SessionBase: SessionBase{TelegramUserID: userID, TelegramChatID: chatID}, UserData: "{}", storage: storage}
+			s.Save()
+			s.SetData(Subscription{subscribed})
+			if locale != "" {
+				s.SetLocale(locale)
+			}
+			return s
+		}
+		newSession(1, 1, "", true)
+		newSession(2, 2, "ru", true)
+		newSession(3, 3, "", true)
+		newSession(4, 4, "", false)
+		newSession(5, 5, "", true)
+		newSession(6, -100, "", true)
+		newSession(7, -100, "", true)
+		inactive := ChatLoader(5, storage)
+		inactive.Inactive = true
+		inactive.Save()
+
+		texts := map[int64]string{}
+		send := func(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+			msg := c.(tgbotapi.MessageConfig)
+			if msg.ChatID == 3 {
+				return tgbotapi.Message{}, tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"}
+			}
+			texts[msg.ChatID] = msg.Text
+			return tgbotapi.Message{MessageID: len(texts)}, nil
+		}
+		scheduler := NewSendScheduler(send, SendLimits{Global: 1000, PerChat: 1000, PerGroup: 1000}, nil)
+		newSender := func(s senderSession) SenderInterface {
+			return &Sender{session: s, bot: &tgbotapi.BotAPI{}, scheduler: scheduler, templateDir: dir, msgFactory: func() BotMessageInterface {
+				return NewBotMessage(s.ChatId(), storage)
+			}}
+		}
+
+		progress := 0
+		b := Broadcast{
+			Name:       "news",
+			Template:   "news",
+			Target:     BroadcastAll,
+			Recipients: NewDataQuery().Where(func(s *Subscription) bool { return s.Active }),
+			Data:       func(s ChatSession) interface{} { return s.UserId() },
+			OnProgress: func(BroadcastState) { progress++ },
+		}
+		state, err := runBroadcast(storage, b, newSender)
+		if err != nil || !state.Done || state.Total != 5 || state.Delivered != 3 || state.Blocked != 2 || state.Failed != 0 || progress != 5 {
+			t.Error(name, "Wrong broadcast state", err, state, progress)
+		}
+		if len(texts) != 3 || texts[1] != "News for 1" || texts[2] != "Новости для 2" || texts[-100] != "News for 6" {
+			t.Error(name, "Wrong messages", texts)
+		}
+		if msgs, _ := storage.BotMessagesAfter(0, 10); len(msgs) != 3 {
+			t.Error(name, "Bot messages should be saved", len(msgs))
+		}
+
+		texts = map[int64]string{}
+		if state, _ := runBroadcast(storage, b, newSender); !state.Done || len(texts) != 0 {
+			t.Error(name, "Finished broadcast should not be sent again", len(texts))
+		}
+
+		first, _ := storage.FindSession(1, 1, "")
+		storage.(BroadcastStorage).SaveBroadcast(&BroadcastState{Name: "resumed", LastSessionID: first.ID, Delivered: 1})
+		b.Name, b.Target = "resumed", BroadcastUsers
+		state, err = runBroadcast(storage, b, newSender)
+		if err != nil || state.Delivered != 2 || state.Blocked != 2 || len(texts) != 1 || texts[2] == "" {
+			t.Error(name, "Broadcast should resume after the last processed session", err, state, texts)
+		}
+		if stored, err := storage.(BroadcastStorage).FindBroadcast("resumed"); err != nil || !stored.Done || stored.Delivered != 2 || stored.Total != 4 {
+			t.Error(name, "Progress should be stored", err, stored)
+		}
+
+		texts = map[int64]string{}
+		groupSession, _ := storage.FindSession(-100, 6, "")
+		storage.(BroadcastStorage).SaveBroadcast(&BroadcastState{Name: "groups", LastSessionID: groupSession.ID, Total: 5, Delivered: 1})
+		b.Name, b.Target = "groups", BroadcastGroups
+		newSession(8, -100, "", true)
+		state, err = runBroadcast(storage, b, newSender)
+		if err != nil || !state.Done || state.Delivered != 1 || state.Total != 5 || len(texts) != 0 {
+			t.Error(name, "Resumed broadcast should not send to the group again and keep the total", err, state, texts)
+		}
+	}
+}
+
+//nilBroadcasts returns no state with the error, as the storage contract allows
+type nilBroadcasts struct {
+	*MemoryStorage
+}
+
+func (nilBroadcasts) FindBroadcast(name string) (*BroadcastState, error) {
+	return nil, ErrNotFound
+}
+
+func TestBroadcastRunsOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botmeans_broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "news.json"), []byte(`{"Template": {"": "News"}}`), 0600)
+
+	storage := NewMemoryStorage()
+	s := &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramChatID: 1}, UserData: "{}", storage: storage}
+	s.Save()
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	send := func(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+		entered <- struct{}{}
+		<-release
+		return tgbotapi.Message{MessageID: 1}, nil
+	}
+	ui := &MeansBot{
+		bot:       &tgbotapi.BotAPI{},
+		storage:   storage,
+		tlgConfig: TelegramConfig{TemplateDir: dir},
+		scheduler: NewSendScheduler(send, SendLimits{Global: 1000, PerChat: 1000, PerGroup: 1000}, nil),
+	}
+	b := Broadcast{Name: "news", Template: "news"}
+	done, err := ui.StartBroadcast(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-entered
+	if _, err := ui.StartBroadcast(b); err != ErrBroadcastRunning {
+		t.Error("Second run should be rejected", err)
+	}
+	close(release)
+	if state := <-done; !state.Done || state.Delivered != 1 {
+		t.Error("Wrong broadcast state", state)
+	}
+	if again, err := ui.StartBroadcast(b); err != nil {
+		t.Error("Finished broadcast should be started again", err)
+	} else if state := <-again; !state.Done || state.Delivered != 1 {
+		t.Error("Finished broadcast should not be sent again", state)
+	}
+
+	ui.storage = nilBroadcasts{storage}
+	if _, err := ui.BroadcastProgress("news"); err != ErrNotFound {
+		t.Error("Missing progress should be reported", err)
+	}
+	if state, err := runBroadcast(ui.storage, Broadcast{Name: "other", Template: "news", Target: BroadcastGroups}, ui.newSender); err != nil || !state.Done {
+		t.Error("Broadcast should start without stored state", err, state)
+	}
+}
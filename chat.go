@@ -0,0 +1,129 @@
+package botmeans
+
+import (
+	"fmt"
+	"time"
+)
+
+//Chat keeps the state of the telegram chat the bot has met
+type Chat struct {
+	ID             int64 `sql:"index;unique"`
+	TelegramChatID int64 `sql:"index;unique"`
+	Title          string
+	Type           string
+	Inactive       bool
+	BotStatus      string
+	UserData       string `sql:"type:jsonb"`
+	UpdatedAt      time.Time
+	storage        ChatStorage
+	isNew          bool
+}
+
+//ChatId returns chat id
+func (chat *Chat) ChatId() int64 {
+	return chat.TelegramChatID
+}
+
+//ChatTitle returns the title of the chat
+func (chat *Chat) ChatTitle() string {
+	return chat.Title
+}
+
+//ChatType returns the type of the chat: private, group, supergroup or channel
+func (chat *Chat) ChatType() string {
+	return chat.Type
+}
+
+//IsOneToOne returns true if the chat is a private chat with the bot
+func (chat *Chat) IsOneToOne() bool {
+	return chat.Type == "private" || chat.TelegramChatID > 0
+}
+
+//IsNew returns true if the chat has not been saved yet
+func (chat *Chat) IsNew() bool {
+	return chat.isNew
+}
+
+//IsActive returns false if the bot has left or has been removed from the chat
+func (chat *Chat) IsActive() bool {
+	return !chat.Inactive
+}
+
+//SetData sets internal UserData field to JSON representation of given value
+func (chat *Chat) SetData(value interface{}) {
+	if chat.storage != nil && !chat.isNew {
+		if c, err := chat.storage.FindChat(chat.TelegramChatID); err == nil {
+			chat.UserData = c.UserData
+		}
+	}
+	chat.UserData = serialize(chat.UserData, value)
+	chat.Save()
+}
+
+//GetData extracts internal UserData field to given value
+func (chat *Chat) GetData(value interface{}) {
+	if upgraded, changed := deserialize(chat.UserData, value); changed {
+		chat.UserData = upgraded
+		chat.Save()
+	}
+}
+
+//Locale returns the locale of the chat, empty if not set
+func (chat *Chat) Locale() string {
+	var lo localeData
+	chat.GetData(&lo)
+	return string(lo)
+}
+
+//SetLocale sets the locale for the whole chat
+func (chat *Chat) SetLocale(locale string) {
+	chat.SetData(localeData(locale))
+}
+
+//Save saves the chat to the storage
+func (chat *Chat) Save() error {
+	if chat.storage != nil {
+		if err := chat.storage.SaveChat(chat); err != nil {
+			return err
+		}
+		chat.isNew = false
+		return nil
+	}
+	return fmt.Errorf("storage not set")
+}
+
+//ChatLoader loads the chat from the storage or creates the new one
+func ChatLoader(TelegramChatID int64, storage ChatStorage) *Chat {
+	chat, err := storage.FindChat(TelegramChatID)
+	if err != nil {
+		chat = &Chat{}
+		chat.isNew = true
+		chat.TelegramChatID = TelegramChatID
+		chat.UserData = "{}"
+	}
+	chat.storage = storage
+	return chat
+}
+
+//ChatInterface defines the chat-wide state shared by all sessions of the chat
+type ChatInterface interface {
+	ChatIdentifier
+	DataGetSetter
+	PersistentSaver
+	ChatTitle() string
+	ChatType() string
+	IsOneToOne() bool
+	IsActive() bool
+	Locale() string
+	SetLocale(string)
+}
+
+//inactiveChatIDs returns ids of chats the bot is not a member of anymore
+func inactiveChatIDs(storage ChatStorage) map[int64]struct{} {
+	ret := make(map[int64]struct{})
+	chats, _ := storage.Chats(false)
+	for _, c := range chats {
+		ret[c.TelegramChatID] = struct{}{}
+	}
+	return ret
+}
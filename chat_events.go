@@ -0,0 +1,247 @@
+package botmeans
+
+import (
+	"encoding/json"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"io/ioutil"
+	"net/http"
+)
+
+//ChatEventType defines the kind of chat lifecycle event
+type ChatEventType int
+
+const (
+	//BotAdded is emitted when the bot has been added to the chat
+	BotAdded ChatEventType = iota
+	//BotRemoved is emitted when the bot has left or has been removed from the chat
+	BotRemoved
+	//BotPermissionsChanged is emitted when the bot has been promoted, demoted or restricted in the chat
+	BotPermissionsChanged
+	//ChatTitleChanged is emitted when the title of the chat has been changed
+	ChatTitleChanged
+)
+
+func (t ChatEventType) String() string {
+	switch t {
+	case BotAdded:
+		return "BotAdded"
+	case BotRemoved:
+		return "BotRemoved"
+	case BotPermissionsChanged:
+		return "BotPermissionsChanged"
+	case ChatTitleChanged:
+		return "ChatTitleChanged"
+	}
+	return "Unknown"
+}
+
+//ChatEvent describes the change of the chat or of the bot membership in it
+type ChatEvent struct {
+	Type      ChatEventType
+	ChatID    int64
+	ChatType  string
+	Title     string
+	ByUserID  int64
+	BotMember *tgbotapi.ChatMember
+	output    func() OutMsgFactoryInterface
+}
+
+//Output allows to send messages to the chat the event belongs to
+func (event ChatEvent) Output() OutMsgFactoryInterface {
+	if event.output == nil {
+		return nil
+	}
+	return event.output()
+}
+
+//ChatEventHandler defines the type of chat events handler function
+type ChatEventHandler func(event ChatEvent)
+
+//chatMemberUpdate is the my_chat_member or chat_member part of the update, which telegram-bot-api doesn't parse
+type chatMemberUpdate struct {
+	Chat          tgbotapi.Chat       `json:"chat"`
+	From          tgbotapi.User       `json:"from"`
+	OldChatMember tgbotapi.ChatMember `json:"old_chat_member"`
+	NewChatMember tgbotapi.ChatMember `json:"new_chat_member"`
+	//mine is true for my_chat_member updates, which are about the bot itself
+	mine bool
+}
+
+type rawUpdate struct {
+	tgbotapi.Update
+	MyChatMember *chatMemberUpdate `json:"my_chat_member"`
+	ChatMember   *chatMemberUpdate `json:"chat_member"`
+}
+
+//webhookUpdates are the update types requested from Telegram. chat_member updates are only sent when requested
+var webhookUpdates = []string{"message", "edited_message", "channel_post", "edited_channel_post", "inline_query",
+	"chosen_inline_result", "callback_query", "shipping_query", "pre_checkout_query", "poll", "poll_answer",
+	"my_chat_member", "chat_member"}
+
+//setWebhook works like BotAPI.SetWebhook with a certificate, but also requests webhookUpdates
+func setWebhook(bot *tgbotapi.BotAPI, config tgbotapi.WebhookConfig) error {
+	allowed, err := json.Marshal(webhookUpdates)
+	if err != nil {
+		return err
+	}
+	params := map[string]string{"url": config.URL.String(), "allowed_updates": string(allowed)}
+	_, err = bot.UploadFile("setWebhook", params, "certificate", config.Certificate)
+	return err
+}
+
+func isMemberStatus(status string) bool {
+	switch status {
+	case "creator", "administrator", "member", "restricted":
+		return true
+	}
+	return false
+}
+
+//ChatEventsParser extracts chat lifecycle events from the service messages of the update
+func ChatEventsParser(tgUpdate tgbotapi.Update, botID int64) (events []ChatEvent) {
+	msg := tgUpdate.Message
+	if msg == nil || msg.Chat == nil {
+		return
+	}
+	base := ChatEvent{ChatID: msg.Chat.ID, ChatType: msg.Chat.Type, Title: msg.Chat.Title}
+	if msg.From != nil {
+		base.ByUserID = int64(msg.From.ID)
+	}
+	if msg.NewChatMembers != nil {
+		for _, member := range *msg.NewChatMembers {
+			if int64(member.ID) == botID {
+				ev := base
+				ev.Type = BotAdded
+				events = append(events, ev)
+			}
+		}
+	}
+	if msg.GroupChatCreated || msg.SuperGroupChatCreated {
+		ev := base
+		ev.Type = BotAdded
+		events = append(events, ev)
+	}
+	if msg.LeftChatMember != nil && int64(msg.LeftChatMember.ID) == botID {
+		ev := base
+		ev.Type = BotRemoved
+		events = append(events, ev)
+	}
+	if msg.NewChatTitle != "" {
+		ev := base
+		ev.Type = ChatTitleChanged
+		ev.Title = msg.NewChatTitle
+		events = append(events, ev)
+	}
+	return
+}
+
+//chatMemberEvents converts my_chat_member update to chat events
+func chatMemberEvents(upd chatMemberUpdate) (events []ChatEvent) {
+	ev := ChatEvent{
+		ChatID:   upd.Chat.ID,
+		ChatType: upd.Chat.Type,
+		Title:    upd.Chat.Title,
+		ByUserID: int64(upd.From.ID),
+	}
+	member := upd.NewChatMember
+	ev.BotMember = &member
+	wasMember := isMemberStatus(upd.OldChatMember.Status)
+	isMember := isMemberStatus(upd.NewChatMember.Status)
+	switch {
+	case !wasMember && isMember:
+		ev.Type = BotAdded
+	case wasMember && !isMember:
+		ev.Type = BotRemoved
+	case wasMember && isMember:
+		ev.Type = BotPermissionsChanged
+	default:
+		return
+	}
+	return []ChatEvent{ev}
+}
+
+//applyChatEvent updates the chat state and returns false if the event changes nothing and should not be emitted
+func applyChatEvent(chat *Chat, event ChatEvent) bool {
+	if event.ChatType != "" {
+		chat.Type = event.ChatType
+	}
+	switch event.Type {
+	case BotAdded:
+		if !chat.IsNew() && chat.IsActive() && chat.BotStatus != "" {
+			return false
+		}
+		chat.Inactive = false
+		chat.BotStatus = "member"
+		if event.BotMember != nil {
+			chat.BotStatus = event.BotMember.Status
+		}
+		if event.Title != "" {
+			chat.Title = event.Title
+		}
+	case BotRemoved:
+		if !chat.IsNew() && !chat.IsActive() {
+			return false
+		}
+		chat.Inactive = true
+		chat.BotStatus = "left"
+		if event.BotMember != nil {
+			chat.BotStatus = event.BotMember.Status
+		}
+	case BotPermissionsChanged:
+		chat.Inactive = false
+		if event.BotMember != nil {
+			chat.BotStatus = event.BotMember.Status
+		}
+	case ChatTitleChanged:
+		if chat.Title == event.Title {
+			return false
+		}
+		chat.Title = event.Title
+	}
+	return true
+}
+
+//chatEventExecuter delivers the chat event to handlers in the chat's goroutine of the BotMachine
+type chatEventExecuter struct {
+	event       ChatEvent
+	chatFactory func(int64) *Chat
+	handlers    []ChatEventHandler
+}
+
+func (e chatEventExecuter) Id() int64 {
+	return e.event.ChatID
+}
+
+func (e chatEventExecuter) Execute() {
+	chat := e.chatFactory(e.event.ChatID)
+	if !applyChatEvent(chat, e.event) {
+		return
+	}
+	chat.Save()
+	for _, h := range e.handlers {
+		h(e.event)
+	}
+}
+
+//listenForWebhook works like BotAPI.ListenForWebhook, but also parses my_chat_member and chat_member updates
+func listenForWebhook(pattern string, buffer int) (chan tgbotapi.Update, chan chatMemberUpdate) {
+	updates := make(chan tgbotapi.Update, buffer)
+	memberUpdates := make(chan chatMemberUpdate, buffer)
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		bytes, _ := ioutil.ReadAll(r.Body)
+
+		var update rawUpdate
+		json.Unmarshal(bytes, &update)
+		if update.MyChatMember != nil {
+			update.MyChatMember.mine = true
+			memberUpdates <- *update.MyChatMember
+			return
+		}
+		if update.ChatMember != nil {
+			memberUpdates <- *update.ChatMember
+			return
+		}
+		updates <- update.Update
+	})
+	return updates, memberUpdates
+}
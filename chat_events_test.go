@@ -0,0 +1,97 @@
+package botmeans
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"testing"
+)
+
+func TestChatEventsParser(t *testing.T) {
+	chat := &tgbotapi.Chat{ID: -24, Type: "group", Title: "Chat2"}
+	from := &tgbotapi.User{ID: 42, UserName: "fuuu"}
+
+	events := ChatEventsParser(tgbotapi.Update{Message: &tgbotapi.Message{
+		From:           from,
+		Chat:           chat,
+		NewChatMembers: &[]tgbotapi.User{{ID: 43}, {ID: 100}},
+	}}, 100)
+	if len(events) != 1 || events[0].Type != BotAdded || events[0].ChatID != -24 || events[0].ByUserID != 42 {
+		t.Errorf("Wrong events %+v", events)
+	}
+
+	events = ChatEventsParser(tgbotapi.Update{Message: &tgbotapi.Message{
+		From:           from,
+		Chat:           chat,
+		LeftChatMember: &tgbotapi.User{ID: 43},
+	}}, 100)
+	if len(events) != 0 {
+		t.Errorf("Should be empty %+v", events)
+	}
+
+	events = ChatEventsParser(tgbotapi.Update{Message: &tgbotapi.Message{
+		From:           from,
+		Chat:           chat,
+		LeftChatMember: &tgbotapi.User{ID: 100},
+	}}, 100)
+	if len(events) != 1 || events[0].Type != BotRemoved {
+		t.Errorf("Wrong events %+v", events)
+	}
+
+	events = ChatEventsParser(tgbotapi.Update{Message: &tgbotapi.Message{
+		From:         from,
+		Chat:         chat,
+		NewChatTitle: "Chat3",
+	}}, 100)
+	if len(events) != 1 || events[0].Type != ChatTitleChanged || events[0].Title != "Chat3" {
+		t.Errorf("Wrong events %+v", events)
+	}
+}
+
+func TestChatMemberEvents(t *testing.T) {
+	upd := chatMemberUpdate{
+		Chat:          tgbotapi.Chat{ID: -24, Type: "supergroup"},
+		From:          tgbotapi.User{ID: 42},
+		OldChatMember: tgbotapi.ChatMember{Status: "left"},
+		NewChatMember: tgbotapi.ChatMember{Status: "member"},
+	}
+	if events := chatMemberEvents(upd); len(events) != 1 || events[0].Type != BotAdded {
+		t.Errorf("Wrong events %+v", events)
+	}
+	upd.OldChatMember, upd.NewChatMember = upd.NewChatMember, tgbotapi.ChatMember{Status: "administrator", CanPinMessages: true}
+	if events := chatMemberEvents(upd); len(events) != 1 || events[0].Type != BotPermissionsChanged {
+		t.Errorf("Wrong events %+v", events)
+	}
+	upd.OldChatMember, upd.NewChatMember = upd.NewChatMember, tgbotapi.ChatMember{Status: "kicked"}
+	if events := chatMemberEvents(upd); len(events) != 1 || events[0].Type != BotRemoved {
+		t.Errorf("Wrong events %+v", events)
+	}
+}
+
+func TestApplyChatEvent(t *testing.T) {
+	chat := &Chat{TelegramChatID: -24, isNew: true}
+
+	if !applyChatEvent(chat, ChatEvent{Type: BotAdded, ChatID: -24, ChatType: "group", Title: "Chat2"}) {
+		t.Error("Should be emitted")
+	}
+	chat.isNew = false
+	if !chat.IsActive() || chat.Title != "Chat2" || chat.Type != "group" {
+		t.Errorf("Wrong chat state %+v", chat)
+	}
+	if applyChatEvent(chat, ChatEvent{Type: BotAdded, ChatID: -24}) {
+		t.Error("Duplicate BotAdded should not be emitted")
+	}
+	if applyChatEvent(chat, ChatEvent{Type: ChatTitleChanged, ChatID: -24, Title: "Chat2"}) {
+		t.Error("Same title should not be emitted")
+	}
+	if !applyChatEvent(chat, ChatEvent{Type: BotRemoved, ChatID: -24}) {
+		t.Error("Should be emitted")
+	}
+	if chat.IsActive() {
+		t.Error("Should be inactive")
+	}
+	if applyChatEvent(chat, ChatEvent{Type: BotRemoved, ChatID: -24}) {
+		t.Error("Duplicate BotRemoved should not be emitted")
+	}
+	if !applyChatEvent(chat, ChatEvent{Type: BotAdded, ChatID: -24}) || !chat.IsActive() {
+		t.Error("Should be emitted and active again")
+	}
+}
@@ -0,0 +1,40 @@
+package botmeans
+
+import (
+	"testing"
+)
+
+func TestChat(t *testing.T) {
+	chat := &Chat{TelegramChatID: -24, Type: "group", UserData: "{}", isNew: true}
+	if chat.IsOneToOne() {
+		t.Error("Group chat is not one-to-one")
+	}
+	if chat.Locale() != "" {
+		t.Error("Should be empty")
+	}
+
+	session := &Session{SessionBase: SessionBase{42, "fuuu", -24, false, false}, UserData: "{}", chat: chat}
+	session.SetLocale("en")
+
+	localized := chatLocalizedSession{session, session.Chat()}
+	if localized.Locale() != "en" {
+		t.Error("Should fall back to the session locale")
+	}
+
+	chat.SetLocale("ru")
+	type Settings struct {
+		Silent bool
+	}
+	chat.SetData(Settings{true})
+	if localized.Locale() != "ru" {
+		t.Error("Chat locale should be preferred")
+	}
+	if session.Locale() != "en" {
+		t.Error("Session locale should stay untouched")
+	}
+	settings := Settings{}
+	session.Chat().GetData(&settings)
+	if !settings.Silent {
+		t.Error("Should be true")
+	}
+}
@@ -0,0 +1,279 @@
+package botmeans
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+//encryptedValuePrefix marks encrypted values in UserData. The value is stored as JSON string
+//"botmeans.enc:<key id>:<base64 of nonce and ciphertext>", so UserData stays valid JSON and data keys stay readable.
+//The data key is authenticated as additional data, so the value cannot be moved under another key
+const encryptedValuePrefix = "botmeans.enc:"
+
+//KeyProvider supplies keys for UserData encryption. Keys should be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+//CurrentKey is called for each SetData and GetData, so providers backed by external services should cache keys
+type KeyProvider interface {
+	//CurrentKey returns the key used to encrypt new values and its id
+	CurrentKey() (id string, key []byte, err error)
+	//Key returns the key by id. Old keys should stay available until all values are re-encrypted with ReencryptData
+	Key(id string) ([]byte, error)
+}
+
+//StaticKeyProvider keeps the keys in memory
+type StaticKeyProvider struct {
+	mutex   sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+//NewStaticKeyProvider creates the provider with the current key
+func NewStaticKeyProvider(id string, key []byte) *StaticKeyProvider {
+	return &StaticKeyProvider{current: id, keys: map[string][]byte{id: key}}
+}
+
+//AddKey adds the key used to decrypt old values
+func (p *StaticKeyProvider) AddKey(id string, key []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keys[id] = key
+}
+
+//Rotate makes the key current. Previous keys are kept for decryption
+func (p *StaticKeyProvider) Rotate(id string, key []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keys[id] = key
+	p.current = id
+}
+
+//CurrentKey implements KeyProvider
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.current, p.keys[p.current], nil
+}
+
+//Key implements KeyProvider
+func (p *StaticKeyProvider) Key(id string) ([]byte, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown encryption key %q", id)
+}
+
+var dataEncryption = struct {
+	sync.RWMutex
+	provider KeyProvider
+	types    []reflect.Type
+}{}
+
+//EncryptData enables transparent encryption of UserData values in SetData and GetData.
+//Without samples every value is encrypted, otherwise only values of samples' types are.
+//Data keys are never encrypted, so lookups by type keep working.
+//Values stored before are encrypted by GetData or ReencryptData. Pass nil provider to disable encryption
+func EncryptData(provider KeyProvider, samples ...interface{}) {
+	types := []reflect.Type{}
+	for _, sample := range samples {
+		if t := dataType(sample); t != nil {
+			types = append(types, t)
+		}
+	}
+	dataEncryption.Lock()
+	defer dataEncryption.Unlock()
+	dataEncryption.provider = provider
+	dataEncryption.types = types
+}
+
+func encryptionProvider() KeyProvider {
+	dataEncryption.RLock()
+	defer dataEncryption.RUnlock()
+	return dataEncryption.provider
+}
+
+//encryptedKey checks if the value stored under the data key should be encrypted
+func encryptedKey(key string) bool {
+	dataEncryption.RLock()
+	provider, types := dataEncryption.provider, dataEncryption.types
+	dataEncryption.RUnlock()
+	if provider == nil || key == dataVersionsKey {
+		return false
+	}
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		k, legacyKeys := dataTypeKeys(t)
+		if k == key {
+			return true
+		}
+		for _, l := range legacyKeys {
+			if l == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//encryptValue returns the value as stored under the data key: encrypted with the current key or as is
+func encryptValue(key string, plain json.RawMessage) (json.RawMessage, error) {
+	if !encryptedKey(key) {
+		return plain, nil
+	}
+	id, k, err := encryptionProvider().CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(k)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, []byte(key))
+	return json.Marshal(encryptedValuePrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed))
+}
+
+//decryptValue returns the plain value stored under the data key and the id of the key it was encrypted with,
+//or empty id for plain values
+func decryptValue(key string, stored json.RawMessage) (plain json.RawMessage, keyID string, err error) {
+	if !bytes.HasPrefix(stored, []byte(`"`+encryptedValuePrefix)) {
+		return stored, "", nil
+	}
+	var s string
+	if err = json.Unmarshal(stored, &s); err != nil {
+		return nil, "", err
+	}
+	s = strings.TrimPrefix(s, encryptedValuePrefix)
+	sep := strings.LastIndex(s, ":")
+	if sep < 0 {
+		return nil, "", fmt.Errorf("Malformed encrypted value")
+	}
+	keyID = s[:sep]
+	sealed, err := base64.StdEncoding.DecodeString(s[sep+1:])
+	if err != nil {
+		return nil, keyID, err
+	}
+	provider := encryptionProvider()
+	if provider == nil {
+		return nil, keyID, fmt.Errorf("Value is encrypted, but encryption is not enabled")
+	}
+	k, err := provider.Key(keyID)
+	if err != nil {
+		return nil, keyID, err
+	}
+	gcm, err := newGCM(k)
+	if err != nil {
+		return nil, keyID, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, keyID, fmt.Errorf("Malformed encrypted value")
+	}
+	plain, err = gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(key))
+	return plain, keyID, err
+}
+
+//needsReencryption checks if the value stored with the key id differs from the form SetData would store
+func needsReencryption(key string, keyID string) bool {
+	if !encryptedKey(key) {
+		return keyID != ""
+	}
+	currentID, _, err := encryptionProvider().CurrentKey()
+	return err == nil && keyID != currentID
+}
+
+//reencrypt converts every value of UserData to the form SetData would store
+func reencrypt(current string) (string, bool, error) {
+	container := dataContainer(current)
+	changed := false
+	for key, v := range container {
+		if v == nil || key == dataVersionsKey {
+			continue
+		}
+		plain, keyID, err := decryptValue(key, *v)
+		if err != nil {
+			return current, false, fmt.Errorf("Cannot decrypt %v: %v", key, err)
+		}
+		if !needsReencryption(key, keyID) {
+			continue
+		}
+		stored, err := encryptValue(key, plain)
+		if err != nil {
+			return current, false, fmt.Errorf("Cannot encrypt %v: %v", key, err)
+		}
+		container[key] = &stored
+		changed = true
+	}
+	if !changed {
+		return current, false, nil
+	}
+	d, _ := json.Marshal(container)
+	return string(d), true, nil
+}
+
+//decryptedData returns UserData with all values decrypted. Values which cannot be decrypted are kept as is
+func decryptedData(current string) string {
+	container := dataContainer(current)
+	changed := false
+	for key, v := range container {
+		if v == nil {
+			continue
+		}
+		if plain, keyID, err := decryptValue(key, *v); err == nil && keyID != "" {
+			container[key] = &plain
+			changed = true
+		}
+	}
+	if !changed {
+		return current
+	}
+	d, _ := json.Marshal(container)
+	return string(d)
+}
+
+//DataEncryptionReport describes the result of ReencryptData
+type DataEncryptionReport struct {
+	Sessions    int
+	BotMessages int
+	Chats       int
+	Users       int
+}
+
+//ReencryptData rewrites UserData of all stored records, so every value is encrypted with the current key,
+//or decrypted if encryption is disabled for its type. Run it after the key rotation before removing old keys
+func ReencryptData(storage Storage) (report DataEncryptionReport, err error) {
+	var failed error
+	rewrite := func(current string) (string, bool) {
+		data, changed, err := reencrypt(current)
+		if err != nil && failed == nil {
+			failed = err
+		}
+		return data, changed
+	}
+	if report.Sessions, report.BotMessages, report.Chats, report.Users, err = rewriteUserData(storage, rewrite); err != nil {
+		return
+	}
+	err = failed
+	return
+}
@@ -0,0 +1,86 @@
+package botmeans
+
+import (
+	"strings"
+	"testing"
+)
+
+type Address struct {
+	Street string
+	Phone  string
+}
+
+func TestDataEncryption(t *testing.T) {
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+	defer EncryptData(nil)
+
+	type Counter struct{ N int }
+
+	for name, storage := range storages {
+		provider := NewStaticKeyProvider("k1", []byte("0123456789abcdef0123456789abcdef"))
+		EncryptData(provider)
+
+		s := &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramChatID: 100}, UserData: "{}", storage: storage}
+		s.SetData(Address{"Baker st", "+44"})
+		stored, _ := storage.SessionByID(s.ID)
+		if strings.Contains(stored.UserData, "Baker") || !strings.Contains(stored.UserData, dataKeyFor(Address{})) {
+			t.Error(name, "Value should be encrypted and the key should stay plain", stored.UserData)
+		}
+		var a Address
+		stored.GetData(&a)
+		if a.Street != "Baker st" {
+			t.Error(name, "Value should be decrypted", a)
+		}
+
+		m := NewBotMessage(100, storage)
+		m.SetData(Address{"Elm st", ""})
+		m.Save()
+		if msgs, _ := storage.BotMessagesByDataKey(100, dataKeyFor(Address{})); len(msgs) != 1 {
+			t.Error(name, "Lookup by type key should work", len(msgs))
+		}
+
+		provider.Rotate("k2", []byte("fedcba9876543210"))
+		stored.storage = storage
+		stored.GetData(&a)
+		if s, _ := storage.SessionByID(s.ID); !strings.Contains(s.UserData, encryptedValuePrefix+"k2:") {
+			t.Error(name, "GetData should re-encrypt with the current key", s.UserData)
+		}
+		report, err := ReencryptData(storage)
+		if err != nil || report.BotMessages != 1 || report.Sessions != 0 {
+			t.Error(name, "Wrong re-encryption report", report, err)
+		}
+
+		EncryptData(provider, Address{})
+		s.SetData(Counter{3})
+		stored, _ = storage.SessionByID(s.ID)
+		if !strings.Contains(stored.UserData, `{"N":3}`) || strings.Contains(stored.UserData, "Baker") {
+			t.Error(name, "Only selected types should be encrypted", stored.UserData)
+		}
+		if data, err := ExportPersonalData(storage, 1, nil); err != nil || !strings.Contains(string(data.Sessions[0].Data), "Baker") {
+			t.Error(name, "Export should contain decrypted data", err)
+		}
+
+		EncryptData(nil)
+		a = Address{}
+		if stored.GetData(&a); a.Street != "" {
+			t.Error(name, "Encrypted values should not be readable without the provider", a)
+		}
+	}
+}
+
+func TestDataEncryptionKeys(t *testing.T) {
+	defer EncryptData(nil)
+	EncryptData(NewStaticKeyProvider("k1", []byte("0123456789abcdef")))
+
+	migrated, changed := deserialize(`{"Address":{"Street":"Baker st"}}`, &Address{})
+	if !changed || strings.Contains(migrated, "Baker") || strings.Contains(migrated, `"Address"`) {
+		t.Error("Legacy plain copy should be replaced by the encrypted value", migrated)
+	}
+
+	container := dataContainer(serialize("", Address{"Elm st", ""}))
+	container["Copied"] = container[dataKeyFor(Address{})]
+	if _, _, err := decryptValue("Copied", *container["Copied"]); err == nil {
+		t.Error("Value moved under another data key should not be decrypted")
+	}
+}
@@ -0,0 +1,130 @@
+package botmeans
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+//DataKeyMigrationReport describes the result of MigrateDataKeys
+type DataKeyMigrationReport struct {
+	Sessions    int
+	BotMessages int
+	Chats       int
+	Users       int
+	//Collisions lists legacy keys found in stored data which are claimed by several types.
+	//The value is copied to every such type
+	Collisions []DataKeyCollision
+}
+
+//MigrateDataKeys rewrites UserData of all stored records, moving values from legacy type-name keys
+//to fully-qualified keys of the given sample types and of all registered types
+func MigrateDataKeys(storage Storage, samples ...interface{}) (report DataKeyMigrationReport, err error) {
+	legacy := make(map[string][]string)
+	add := func(key string, legacyKeys []string) {
+		for _, l := range legacyKeys {
+			if l == key {
+				continue
+			}
+			found := false
+			for _, k := range legacy[l] {
+				found = found || k == key
+			}
+			if !found {
+				legacy[l] = append(legacy[l], key)
+			}
+		}
+	}
+	for _, sample := range samples {
+		add(dataTypeKeys(dataType(sample)))
+	}
+	dataTypes.RLock()
+	for _, info := range dataTypes.byType {
+		add(info.key, info.legacyKeys)
+	}
+	dataTypes.RUnlock()
+
+	collisions := make(map[string]DataKeyCollision)
+	migrate := func(current string) (string, bool) {
+		container := dataContainer(current)
+		changed := false
+		for l, keys := range legacy {
+			v, ok := container[l]
+			if !ok {
+				continue
+			}
+			if len(keys) > 1 {
+				sort.Strings(keys)
+				collisions[l] = DataKeyCollision{LegacyKey: l, Keys: keys}
+			}
+			for _, k := range keys {
+				if _, exists := container[k]; !exists {
+					container[k] = v
+				}
+			}
+			delete(container, l)
+			changed = true
+		}
+		if !changed {
+			return current, false
+		}
+		d, _ := json.Marshal(container)
+		return string(d), true
+	}
+
+	if report.Sessions, report.BotMessages, report.Chats, report.Users, err = rewriteUserData(storage, migrate); err != nil {
+		return
+	}
+
+	legacyKeys := []string{}
+	for l := range collisions {
+		legacyKeys = append(legacyKeys, l)
+	}
+	sort.Strings(legacyKeys)
+	for _, l := range legacyKeys {
+		report.Collisions = append(report.Collisions, collisions[l])
+	}
+	return
+}
+
+//rewriteUserData saves every stored record for which f changes UserData. Returns the numbers of changed records
+func rewriteUserData(storage Storage, f func(string) (string, bool)) (sessions, botMessages, chats, users int, err error) {
+	if err = forEachSession(storage, func(s *Session) error {
+		if data, changed := f(s.UserData); changed {
+			s.UserData = data
+			sessions++
+			return storage.SaveSession(s)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = forEachBotMessage(storage, func(m *BotMessage) error {
+		if data, changed := f(m.UserData); changed {
+			m.UserData = data
+			botMessages++
+			return storage.SaveBotMessage(m)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = forEachChat(storage, func(c *Chat) error {
+		if data, changed := f(c.UserData); changed {
+			c.UserData = data
+			chats++
+			return storage.SaveChat(c)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	err = forEachUser(storage, func(u *User) error {
+		if data, changed := f(u.UserData); changed {
+			u.UserData = data
+			users++
+			return storage.SaveUser(u)
+		}
+		return nil
+	})
+	return
+}
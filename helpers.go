@@ -2,10 +2,9 @@ package botmeans
 
 import (
 	// 	"encoding/json"
-	// 	"fmt"
+	"fmt"
 	// 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	// 	"io/ioutil"
-	"reflect"
 	// 	"strings"
 	// 	"text/template"
 	// "log"
@@ -19,20 +18,18 @@ type UserIdentifier interface {
 	UserId() int64
 }
 
+//Find loads records of arbitrary types by their ids. Supported by GormStorage only
 func (ui *MeansBot) Find(val ...Identifiable) (err error) {
-	for _, v := range val {
-		if err = ui.db.Where("id=?", v.Id()).First(v).Error; err != nil {
-			return
-		}
+	if s, ok := underlyingStorage(ui.storage).(*GormStorage); ok {
+		return s.find(val...)
 	}
-	return
+	return fmt.Errorf("Find is not supported by the storage")
 }
 
 func (ui *MeansBot) FindSession(id int64) ChatSession {
-	r := Session{}
-	if err := ui.db.Where("id=?", id).First(&r).Error; err == nil {
-		r.db = ui.db
-		return &r
+	if r, err := ui.storage.SessionByID(id); err == nil {
+		r.storage = ui.storage
+		return r
 	}
 	return nil
 }
@@ -40,44 +37,48 @@ func (ui *MeansBot) FindSession(id int64) ChatSession {
 //GetNeighborSessions returns all sessions that are in the same chat as given session
 func (ui *MeansBot) GetChatSessions(session ChatSession) (ret []ChatSession) {
 
-	sessions := []*Session{}
-	ui.db.Where("telegram_chat_id=?", session.ChatId()).Find(&sessions)
+	sessions, _ := ui.storage.ChatSessions(session.ChatId())
 	for _, s := range sessions {
-		s.db = ui.db
+		s.storage = ui.storage
 		ret = append(ret, s)
 	}
 	return
 }
 
-//SetChatLocale sets the locale of all sessions in this chat
-func (ui *MeansBot) SetChatLocale(session ChatSession, locale string) {
-	session.SetLocale(locale)
-	sL := []Session{}
-	ui.db.Where("telegram_chat_id=?", session.ChatId()).Find(&sL)
-	for _, s := range sL {
-		s.SetLocale(locale)
-		s.db = ui.db
-		s.Save()
-	}
+//SetChatLocale sets the locale of the chat, which is used for all sessions in this chat
+func (ui *MeansBot) SetChatLocale(session ChatIdentifier, locale string) {
+	ui.FindChat(session.ChatId()).SetLocale(locale)
+}
 
+//FindUser returns the global profile of the user with given telegram id
+func (ui *MeansBot) FindUser(user UserIdentifier) UserInterface {
+	return userStorageLoader(user.UserId(), ui.storage)
 }
 
-// //GetSessionsByUserData returns all sessions in this chat that have given value in UserData field
-// func (ui *MeansBot) GetSessionsByUserData(filters map[string]interface{}) (ret []TelegramUserSession) {
-// 	query := ui.db.Model(TelegramUserSession{})
-// 	for k, v := range filters {
-// 		query = query.Where("(user_data->> ?)::text = ?::text", k, v)
-// 	}
-// 	query.Find(&ret)
-// 	return
-// }
+//FindChat returns the chat-wide state for given chat id
+func (ui *MeansBot) FindChat(chatID int64) ChatInterface {
+	return ChatLoader(chatID, ui.storage)
+}
+
+//GetActiveChats returns all chats the bot is still a member of
+func (ui *MeansBot) GetActiveChats() (ret []*Chat) {
+	ret, _ = ui.storage.Chats(true)
+	for _, c := range ret {
+		c.storage = ui.storage
+	}
+	return
+}
 
-//GetSessionsByTelegramUserID returns all sessions with given Telegram User ID
+//GetSessionsByTelegramUserID returns all sessions with given Telegram User ID.
+//Sessions from chats the bot has left are skipped
 func (ui *MeansBot) GetUserSessions(session UserIdentifier) (ret []ChatSession) {
-	s := []*Session{}
-	ui.db.Where("telegram_user_id=?", session.UserId()).Find(&s)
+	s, _ := ui.storage.UserSessions(session.UserId())
+	inactive := inactiveChatIDs(ui.storage)
 	for _, ses := range s {
-		ses.db = ui.db
+		if _, ok := inactive[ses.TelegramChatID]; ok {
+			continue
+		}
+		ses.storage = ui.storage
 		ret = append(ret, ses)
 	}
 	return
@@ -91,29 +92,22 @@ func (ui *MeansBot) GetUserSessions(session UserIdentifier) (ret []ChatSession)
 
 //GetBotMessagesByChatAndType returns Bot messages from session's chat with given UserData type
 func (ui *MeansBot) GetBotMessagesByChatAndType(session ChatIdentifier, typeSample interface{}) (ret []BotMessageInterface) {
-	t := reflect.TypeOf(typeSample).Name()
-	msgs := []*BotMessage{}
-	ui.db.Where("telegram_chat_id=?", session.ChatId()).
-		Where("jsonb_exists(user_data, ?::text)", t).Find(&msgs)
-	for _, m := range msgs {
-		m.db = ui.db
-		ret = append(ret, m)
+	key, legacyKeys := dataTypeKeys(dataType(typeSample))
+	found := make(map[int64]struct{})
+	for _, k := range append([]string{key}, readableLegacyKeys(key, legacyKeys)...) {
+		msgs, _ := ui.storage.BotMessagesByDataKey(session.ChatId(), k)
+		for _, m := range msgs {
+			if _, ok := found[m.ID]; ok {
+				continue
+			}
+			found[m.ID] = struct{}{}
+			m.storage = ui.storage
+			ret = append(ret, m)
+		}
 	}
 	return
 }
 
-// //FindBotMessagesByChatAndUserData returns Bot messages from session's chat with given UserData type and given values in UserData
-// func (ui *MeansBot) FindBotMessagesByChatAndUserData(session TelegramUserSession, typeSample interface{}, filters map[string]interface{}) (ret []TelegramBotMessage) {
-// 	t := reflect.TypeOf(typeSample).Name()
-// 	query := ui.db.Where("telegram_chat_id=?", session.TelegramChatID).
-// 		Where("(user_data->>'Type')::text = ?::text", t)
-// 	for k, v := range filters {
-// 		query = query.Where("(user_data->'UserData'->> ?)::text = ?::text", k, v)
-// 	}
-// 	query.Find(&ret)
-// 	return
-// }
-
 // //CreateSession creates the new session for given credentials
 // func (ui *MeansBot) CreateSession(ses *TelegramUserSession) (session *TelegramUserSession, err error) {
 // 	session, err = ui.findOrCreateSession(ses.TelegramChatID, ses.TelegramUserID, ses.TelegramUserName)
@@ -0,0 +1,113 @@
+package botmeans
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//TemplateLocales returns the locales the templates in the directory are translated to. The default locale is not included
+func TemplateLocales(templateDir string) []string {
+	files, err := ioutil.ReadDir(templateDir)
+	if err != nil {
+		return nil
+	}
+	found := make(map[string]struct{})
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		msgTemplate, err := readMsgTemplate(filepath.Join(templateDir, f.Name()))
+		if err != nil {
+			continue
+		}
+		for locale := range msgTemplate.Template {
+			if locale != "" {
+				found[locale] = struct{}{}
+			}
+		}
+	}
+	ret := []string{}
+	for locale := range found {
+		ret = append(ret, locale)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+//localeFallbacks returns the locales to try for the locale, e.g. pt-BR, pt and the default one
+func localeFallbacks(locale string) []string {
+	locale = strings.Replace(locale, "_", "-", -1)
+	ret := []string{}
+	for locale != "" {
+		ret = append(ret, locale)
+		if i := strings.LastIndex(locale, "-"); i >= 0 {
+			locale = locale[:i]
+		} else {
+			locale = ""
+		}
+	}
+	return append(ret, "")
+}
+
+//matchLocale finds the locale among available ones ignoring case and separator style
+func matchLocale(locale string, available []string) (string, bool) {
+	for _, l := range available {
+		if strings.EqualFold(strings.Replace(l, "_", "-", -1), locale) {
+			return l, true
+		}
+	}
+	return "", false
+}
+
+//NormalizeLocale returns the available locale best matching the Telegram language code.
+//Region is dropped if there is no regional locale, e.g. pt-BR falls back to pt. Returns empty string if nothing matches
+func NormalizeLocale(languageCode string, available []string) string {
+	for _, l := range localeFallbacks(languageCode) {
+		if l == "" {
+			break
+		}
+		if ret, ok := matchLocale(l, available); ok {
+			return ret
+		}
+	}
+	return ""
+}
+
+//resolveTemplateLocale returns the locale of the template to render for given locale
+func resolveTemplateLocale(translations map[string]string, locale string) string {
+	available := []string{}
+	for l := range translations {
+		available = append(available, l)
+	}
+	sort.Strings(available)
+	return NormalizeLocale(locale, available)
+}
+
+//localeStored checks if the locale has ever been stored in UserData, including the default one chosen by the user
+func localeStored(userData string) bool {
+	key, legacyKeys := dataTypeKeys(dataType(localeData("")))
+	for _, k := range append([]string{key}, legacyKeys...) {
+		if hasDataKey(userData, k) {
+			return true
+		}
+	}
+	return false
+}
+
+//detectLocale sets the session locale from the language code, unless the locale has been stored already.
+//New sessions are not saved, so they stay new and store the locale with their first save
+func detectLocale(session *Session, languageCode string, available []string) {
+	if languageCode == "" || localeStored(session.UserData) {
+		return
+	}
+	locale := NormalizeLocale(languageCode, available)
+	switch {
+	case locale == "":
+	case session.IsNew():
+		session.UserData = serialize(session.UserData, localeData(locale))
+	default:
+		session.SetLocale(locale)
+	}
+}
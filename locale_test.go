@@ -0,0 +1,57 @@
+package botmeans
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocales(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botmeans_locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "hello.json"), []byte(`{"Template": {"": "Hello", "pt": "Olá", "ru": "Привет"}}`), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "bye.json"), []byte(`{"Template": {"": "Bye", "pt-BR": "Tchau"}}`), 0600)
+
+	locales := TemplateLocales(dir)
+	if len(locales) != 3 || locales[0] != "pt" || locales[1] != "pt-BR" || locales[2] != "ru" {
+		t.Error("Wrong locales", locales)
+	}
+	for code, expected := range map[string]string{"pt-br": "pt-BR", "pt-PT": "pt", "ru_RU": "ru", "de": "", "": ""} {
+		if l := NormalizeLocale(code, locales); l != expected {
+			t.Error("Wrong locale for", code, l, "should be", expected)
+		}
+	}
+
+	for locale, expected := range map[string]string{"pt-BR": "Olá", "ru": "Привет", "de": "Hello", "": "Hello"} {
+		if params, err := renderFromTemplate(dir, "hello", locale, nil); err != nil || params.text != expected {
+			t.Error("Wrong text for", locale, params.text, err)
+		}
+	}
+	if params, _ := renderFromTemplate(dir, "bye", "pt-br", nil); params.text != "Tchau" {
+		t.Error("Regional template should be used", params.text)
+	}
+
+	session := &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramChatID: 1}, UserData: "{}", isNew: true}
+	detectLocale(session, "pt-BR", locales)
+	if session.Locale() != "pt-BR" || !session.IsNew() {
+		t.Error("Locale should be detected", session.Locale())
+	}
+	detectLocale(session, "ru", locales)
+	if session.Locale() != "pt-BR" {
+		t.Error("Locale set before should be kept", session.Locale())
+	}
+
+	type Note struct{ Text string }
+	storage := NewMemoryStorage()
+	stored := &Session{SessionBase: SessionBase{TelegramUserID: 2, TelegramChatID: 2}, UserData: "{}", storage: storage}
+	stored.Save()
+	detectLocale(stored, "ru", locales)
+	stored.SetData(Note{"after detection"})
+	if s, err := storage.SessionByID(stored.ID); err != nil || s.Locale() != "ru" || stored.Locale() != "ru" {
+		t.Error("Detected locale should be stored", err, stored.Locale())
+	}
+}
@@ -10,15 +10,24 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 //MeansBot is a body of botmeans framework instance.
 type MeansBot struct {
-	bot       *tgbotapi.BotAPI
-	db        *gorm.DB
-	netConfig NetConfig
-	tlgConfig TelegramConfig
+	bot               *tgbotapi.BotAPI
+	storage           Storage
+	netConfig         NetConfig
+	tlgConfig         TelegramConfig
+	chatEventHandlers []ChatEventHandler
+
+	personalDataHandlers map[string]PersonalDataHandler
+	access               *AccessControl
+	scheduler            *SendScheduler
+	//broadcasts are the names of the broadcasts running
+	broadcasts      map[string]struct{}
+	broadcastsMutex sync.Mutex
 }
 
 //NetConfig is a MeansBot network config for using with New function
@@ -36,11 +45,19 @@ type TelegramConfig struct {
 	TemplateDir string
 }
 
-//New creates new MeansBot instance
+//New creates new MeansBot instance using gorm connection as the storage
 func New(DB *gorm.DB, netConfig NetConfig, tlgConfig TelegramConfig) (*MeansBot, error) {
 	if DB == nil {
 		return &MeansBot{}, fmt.Errorf("No db connection given")
 	}
+	return NewWithStorage(NewGormStorage(DB), netConfig, tlgConfig)
+}
+
+//NewWithStorage creates new MeansBot instance with given storage
+func NewWithStorage(storage Storage, netConfig NetConfig, tlgConfig TelegramConfig) (*MeansBot, error) {
+	if storage == nil {
+		return &MeansBot{}, fmt.Errorf("No storage given")
+	}
 	bot, err := tgbotapi.NewBotAPI(tlgConfig.BotToken)
 	if err != nil {
 		return &MeansBot{}, err
@@ -48,14 +65,15 @@ func New(DB *gorm.DB, netConfig NetConfig, tlgConfig TelegramConfig) (*MeansBot,
 
 	ret := &MeansBot{
 		bot:       bot,
-		db:        DB,
+		storage:   storage,
 		netConfig: netConfig,
 		tlgConfig: tlgConfig,
+		scheduler: NewSendScheduler(botSend(bot), DefaultSendLimits, storage),
 	}
 	if os.Getenv("BOTMEANS_SET_WEBHOOK") == "TRUE" {
 
 		ret.bot.RemoveWebhook()
-		_, err = ret.bot.SetWebhook(tgbotapi.NewWebhookWithCert(fmt.Sprintf("https://%v:8443/%v", ret.tlgConfig.WebhookHost, ret.bot.Token),
+		err = setWebhook(ret.bot, tgbotapi.NewWebhookWithCert(fmt.Sprintf("https://%v:8443/%v", ret.tlgConfig.WebhookHost, ret.bot.Token),
 			ret.tlgConfig.SSLCertFile))
 		if err != nil {
 			return nil, err
@@ -64,19 +82,60 @@ func New(DB *gorm.DB, netConfig NetConfig, tlgConfig TelegramConfig) (*MeansBot,
 		}
 	}
 
-	SessionInitDB(DB)
-	BotMessageInitDB(DB)
+	if err := storage.Init(); err != nil {
+		return nil, err
+	}
 
 	return ret, nil
 }
 
+//HandleChatEvents registers the handler for chat lifecycle events. Should be called before Run
+func (ui *MeansBot) HandleChatEvents(handler ChatEventHandler) {
+	ui.chatEventHandlers = append(ui.chatEventHandlers, handler)
+}
+
+func (ui *MeansBot) newSender(s senderSession) SenderInterface {
+	return &Sender{
+		session:     s,
+		bot:         ui.bot,
+		scheduler:   ui.scheduler,
+		templateDir: ui.tlgConfig.TemplateDir,
+		msgFactory:  func() BotMessageInterface { return NewBotMessage(s.ChatId(), ui.storage) },
+	}
+}
+
+func (ui *MeansBot) chatEventExecuter(event ChatEvent) Executer {
+	event.output = func() OutMsgFactoryInterface { return ui.newSender(ChatLoader(event.ChatID, ui.storage)) }
+	return chatEventExecuter{
+		event:       event,
+		chatFactory: func(id int64) *Chat { return ChatLoader(id, ui.storage) },
+		handlers:    ui.chatEventHandlers,
+	}
+}
+
+//profileTTL sets how often user names and chat titles are refreshed from Telegram API
+const profileTTL = 24 * time.Hour
+
 //Run starts updates handling. Returns stop chan
 func (ui *MeansBot) Run(handlersProvider ActionHandlersProvider) chan interface{} {
 	templateDir := ui.tlgConfig.TemplateDir
 	botID, _ := strconv.ParseInt(strings.Split(ui.bot.Token, ":")[0], 10, 64)
 
+	if ui.access != nil {
+		handlersProvider = ui.access.Guard(handlersProvider)
+	}
+	if _, err := ui.DeliverOutbox(); err != nil {
+		log.Printf("Cannot deliver outbox: %v", err)
+	}
+
+	profiles := NewProfileCache(ui.bot, ui.storage, profileTTL)
+	locales := TemplateLocales(templateDir)
 	sessionFactory := func(base SessionBase) (SessionInterface, error) {
-		return SessionLoader(base, ui.db, botID, ui.bot)
+		session, err := SessionLoader(base, ui.storage, botID, profiles)
+		if s, ok := session.(*Session); ok && err == nil {
+			detectLocale(s, profiles.languageCode(base.TelegramUserID), locales)
+		}
+		return session, err
 	}
 
 	actionFactory := func(
@@ -89,14 +148,7 @@ func (ui *MeansBot) Run(handlersProvider ActionHandlersProvider) chan interface{
 			sessionBase,
 			sessionFactory,
 			getters,
-			func(s senderSession) SenderInterface {
-				return &Sender{
-					session:     s,
-					bot:         ui.bot,
-					templateDir: templateDir,
-					msgFactory:  func() BotMessageInterface { return NewBotMessage(s.ChatId(), ui.db) },
-				}
-			},
+			ui.newSender,
 			out,
 			handlersProvider,
 		)
@@ -110,12 +162,41 @@ func (ui *MeansBot) Run(handlersProvider ActionHandlersProvider) chan interface{
 		return CmdParser(tgUpdate, aliaser)
 	}
 	botMsgFactory := func(chatID int64, msgId int64, callbackID string) BotMessageInterface {
-		return BotMessageDBLoader(chatID, msgId, callbackID, ui.db)
+		return BotMessageDBLoader(chatID, msgId, callbackID, ui.storage)
 	}
-	updatesChan := ui.bot.ListenForWebhook("/" + ui.bot.Token)
+	webhookChan, memberUpdatesChan := listenForWebhook("/"+ui.bot.Token, ui.bot.Buffer)
 
 	go http.ListenAndServe(fmt.Sprintf("%v:%v", ui.netConfig.ListenIP, ui.netConfig.ListenPort), nil)
 
+	queueChan := make(chan Executer)
+	updatesChan := make(chan tgbotapi.Update)
+	go func() {
+		for {
+			select {
+			case tgUpdate := <-webhookChan:
+				profiles.Observe(tgUpdate)
+				if msg := tgUpdate.Message; msg != nil && msg.Chat != nil && ui.scheduler != nil {
+					ui.scheduler.Unblock(msg.Chat.ID)
+				}
+				for _, event := range ChatEventsParser(tgUpdate, botID) {
+					queueChan <- ui.chatEventExecuter(event)
+				}
+				updatesChan <- tgUpdate
+			case memberUpdate := <-memberUpdatesChan:
+				profiles.observeMemberUpdate(memberUpdate)
+				if ui.access != nil {
+					ui.access.observeMemberUpdate(memberUpdate)
+				}
+				if !memberUpdate.mine {
+					continue
+				}
+				for _, event := range chatMemberEvents(memberUpdate) {
+					queueChan <- ui.chatEventExecuter(event)
+				}
+			}
+		}
+	}()
+
 	actionsChan := createTGUpdatesParser(
 		updatesChan,
 		parserConfig{
@@ -124,7 +205,13 @@ func (ui *MeansBot) Run(handlersProvider ActionHandlersProvider) chan interface{
 			botMsgFactory,
 			cmdParser,
 			argsParser,
+			func(from *tgbotapi.User) UserInterface { return UserLoader(from, ui.storage) },
 		},
 	)
-	return RunMachine(actionsChan, time.Minute)
+	go func() {
+		for action := range actionsChan {
+			queueChan <- action
+		}
+	}()
+	return RunMachine(queueChan, time.Minute)
 }
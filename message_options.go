@@ -0,0 +1,129 @@
+package botmeans
+
+import (
+	"encoding/json"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"net/url"
+	"strconv"
+)
+
+//MessageOptions change how the message is sent. They are read from the template JSON
+//and can be overridden by MessageOption arguments of Create, SimpleText and Edit
+type MessageOptions struct {
+	//ReplyTo is the id of the message to reply to
+	ReplyTo int64
+	//ReplyToSource replies to the message the command came from
+	ReplyToSource bool
+	//Silent sends the message without notification
+	Silent bool
+	//NoPreview disables link previews. The only option applied by Edit
+	NoPreview bool
+	//Protected protects the message from forwarding and saving
+	Protected bool
+}
+
+//MessageOption sets the option of the sent message
+type MessageOption func(*MessageOptions)
+
+//ReplyTo sends the message as the reply to given one
+func ReplyTo(messageID int64) MessageOption {
+	return func(o *MessageOptions) { o.ReplyTo = messageID }
+}
+
+//ReplyToSource sends the message as the reply to the message the command came from
+func ReplyToSource() MessageOption {
+	return func(o *MessageOptions) { o.ReplyToSource = true }
+}
+
+//Silent turns the notification of the message off or on
+func Silent(on bool) MessageOption {
+	return func(o *MessageOptions) { o.Silent = on }
+}
+
+//NoPreview turns link previews off or on
+func NoPreview(on bool) MessageOption {
+	return func(o *MessageOptions) { o.NoPreview = on }
+}
+
+//Protected turns the protection from forwarding and saving on or off
+func Protected(on bool) MessageOption {
+	return func(o *MessageOptions) { o.Protected = on }
+}
+
+//apply returns the options changed by the arguments
+func (o MessageOptions) apply(opts []MessageOption) MessageOptions {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+//protectedMessage is sendMessage with protect_content, which tgbotapi does not support.
+//It is a Chattable due to embedded MessageConfig, but should be sent with sendProtected
+type protectedMessage struct {
+	tgbotapi.MessageConfig
+}
+
+//sendProtected sends the message with MakeRequest, adding protect_content to the parameters of sendMessage
+func sendProtected(bot *tgbotapi.BotAPI, c protectedMessage) (tgbotapi.Message, error) {
+	v := url.Values{}
+	if c.ChannelUsername != "" {
+		v.Add("chat_id", c.ChannelUsername)
+	} else {
+		v.Add("chat_id", strconv.FormatInt(c.ChatID, 10))
+	}
+	if c.ReplyToMessageID != 0 {
+		v.Add("reply_to_message_id", strconv.Itoa(c.ReplyToMessageID))
+	}
+	if c.ReplyMarkup != nil {
+		data, err := json.Marshal(c.ReplyMarkup)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		v.Add("reply_markup", string(data))
+	}
+	v.Add("disable_notification", strconv.FormatBool(c.DisableNotification))
+	v.Add("text", c.Text)
+	v.Add("disable_web_page_preview", strconv.FormatBool(c.DisableWebPagePreview))
+	if c.ParseMode != "" {
+		v.Add("parse_mode", c.ParseMode)
+	}
+	v.Add("protect_content", "true")
+
+	resp, err := bot.MakeRequest("sendMessage", v)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	var msg tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &msg)
+	return msg, err
+}
+
+//botSend returns the function sending requests with the bot, including the ones tgbotapi does not support
+func botSend(bot *tgbotapi.BotAPI) func(tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return func(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+		if p, ok := c.(protectedMessage); ok {
+			return sendProtected(bot, p)
+		}
+		return bot.Send(c)
+	}
+}
+
+//createsMessage checks if the request sends the new message
+func createsMessage(c tgbotapi.Chattable) bool {
+	switch c.(type) {
+	case tgbotapi.MessageConfig, protectedMessage:
+		return true
+	}
+	return false
+}
+
+//sourceArgs adds the id of the message the command came from to the parsed args
+type sourceArgs struct {
+	Args
+	messageID int64
+}
+
+func (a sourceArgs) sourceMessageID() int64 {
+	return a.messageID
+}
@@ -0,0 +1,76 @@
+package botmeans
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMessageOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botmeans_options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "quiet.json"), []byte(`{"Template": {"": "See http://example.com"}, "Silent": true, "NoPreview": true}`), 0600)
+
+	storage := NewMemoryStorage()
+	requests := []tgbotapi.Chattable{}
+	send := func(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+		requests = append(requests, c)
+		return tgbotapi.Message{MessageID: len(requests)}, nil
+	}
+	action := &Action{getters: actionExecuterFactoryConfig{argsGetter: func() Args { return sourceArgs{args{}, 7} }}}
+	sender := &Sender{
+		session:     &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramChatID: 1}, UserData: "{}"},
+		bot:         &tgbotapi.BotAPI{},
+		scheduler:   NewSendScheduler(send, SendLimits{Global: 1000, PerChat: 1000}, nil),
+		templateDir: dir,
+		msgFactory:  func() BotMessageInterface { return NewBotMessage(1, storage) },
+		sourceMsgID: action.sourceMessageID(),
+	}
+
+	if err := sender.Create("quiet", nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := requests[0].(tgbotapi.MessageConfig); !ok || !msg.DisableNotification || !msg.DisableWebPagePreview || msg.ReplyToMessageID != 0 {
+		t.Error("Template options should be applied", requests[0])
+	}
+
+	if err := sender.Create("quiet", nil, Silent(false), ReplyToSource()); err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := requests[1].(tgbotapi.MessageConfig); !ok || msg.DisableNotification || !msg.DisableWebPagePreview || msg.ReplyToMessageID != 7 {
+		t.Error("Options should override the template and reply to the source message", requests[1])
+	}
+
+	if err := sender.SimpleText("secret", ReplyTo(3), ReplyToSource(), Protected(true)); err != nil {
+		t.Fatal(err)
+	}
+	protected, ok := requests[2].(protectedMessage)
+	if !ok || protected.ReplyToMessageID != 3 || protected.Text != "secret" {
+		t.Fatal("Protected message should be sent with protect_content", requests[2])
+	}
+	if msg, err := storage.FindBotMessage(1, 3); err != nil || msg.Id() != 3 {
+		t.Error("Id of the protected message should be stored", err)
+	}
+
+	entry, err := newOutboxEntry(1, protected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := entry.chattable(nil); err != nil || c != protected || !createsMessage(c) {
+		t.Error("Protected message should survive the outbox", c, err)
+	}
+
+	msg, _ := storage.FindBotMessage(1, 1)
+	msg.storage = storage
+	if err := sender.Edit(msg, "quiet", nil, NoPreview(false)); err != nil {
+		t.Fatal(err)
+	}
+	if edit, ok := requests[3].(tgbotapi.EditMessageTextConfig); !ok || edit.DisableWebPagePreview {
+		t.Error("Edit should apply NoPreview option", requests[3])
+	}
+}
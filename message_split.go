@@ -0,0 +1,284 @@
+package botmeans
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+//maxMessageLength is the limit of the message text, in UTF-16 code units as counted by Telegram
+const maxMessageLength = 4096
+
+//markupEntity is the formatting which should be closed at the end of the part and reopened in the next one
+type markupEntity struct {
+	open  string
+	close string
+}
+
+//markupEvent opens the entity or, if entity is nil, closes the last opened one at the byte position
+type markupEvent struct {
+	pos    int
+	entity *markupEntity
+}
+
+//markupScan is the formatting found in the text
+type markupScan struct {
+	//spans are the byte ranges which must not be cut, e.g. HTML tags or Markdown links
+	spans  [][2]int
+	events []markupEvent
+}
+
+//canCut checks if the text can be cut before the byte position
+func (m markupScan) canCut(pos int) bool {
+	for _, s := range m.spans {
+		if s[0] < pos && pos < s[1] {
+			return false
+		}
+	}
+	return true
+}
+
+//openAt returns the entities open before the byte position
+func (m markupScan) openAt(pos int) (ret []*markupEntity) {
+	for _, e := range m.events {
+		if e.pos > pos {
+			break
+		}
+		if e.entity != nil {
+			ret = append(ret, e.entity)
+		} else if len(ret) > 0 {
+			ret = ret[:len(ret)-1]
+		}
+	}
+	return
+}
+
+func scanMarkup(text string, parseMode string) markupScan {
+	switch strings.ToLower(parseMode) {
+	case "html":
+		return scanHTML(text)
+	case "markdown", "markdownv2":
+		return scanMarkdown(text)
+	}
+	return markupScan{}
+}
+
+//htmlTags are the tags supported by Telegram. Other text in angle brackets is not formatting
+var htmlTags = map[string]bool{
+	"b": true, "strong": true, "i": true, "em": true, "u": true, "ins": true, "s": true, "strike": true, "del": true,
+	"a": true, "code": true, "pre": true, "span": true, "tg-spoiler": true, "tg-emoji": true, "blockquote": true,
+}
+
+func scanHTML(text string) (ret markupScan) {
+	opened := []string{}
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '<':
+			end := strings.IndexByte(text[i:], '>')
+			if end < 0 {
+				return
+			}
+			end += i + 1
+			tag := text[i+1 : end-1]
+			closing := strings.HasPrefix(tag, "/")
+			name := strings.Fields(strings.TrimPrefix(tag, "/"))
+			if len(name) == 0 || !htmlTags[strings.ToLower(name[0])] {
+				continue
+			}
+			ret.spans = append(ret.spans, [2]int{i, end})
+			if !closing {
+				opened = append(opened, strings.ToLower(name[0]))
+				ret.events = append(ret.events, markupEvent{end, &markupEntity{text[i:end], "</" + name[0] + ">"}})
+			} else if len(opened) > 0 && opened[len(opened)-1] == strings.ToLower(name[0]) {
+				opened = opened[:len(opened)-1]
+				ret.events = append(ret.events, markupEvent{end, nil})
+			}
+			i = end - 1
+		case '&':
+			if end := strings.IndexByte(text[i:], ';'); end > 0 && end < 10 {
+				ret.spans = append(ret.spans, [2]int{i, i + end + 1})
+				i += end
+			}
+		}
+	}
+	return
+}
+
+func scanMarkdown(text string) (ret markupScan) {
+	stack := []string{}
+	top := func() string {
+		if len(stack) == 0 {
+			return ""
+		}
+		return stack[len(stack)-1]
+	}
+	toggle := func(pos int, marker string) {
+		if top() == marker {
+			stack = stack[:len(stack)-1]
+			ret.events = append(ret.events, markupEvent{pos, nil})
+		} else {
+			stack = append(stack, marker)
+			ret.events = append(ret.events, markupEvent{pos, &markupEntity{marker, marker}})
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		inCode := top() == "`" || top() == "```"
+		switch {
+		case strings.HasPrefix(text[i:], "```") && (!inCode || top() == "```"):
+			ret.spans = append(ret.spans, [2]int{i, i + 3})
+			toggle(i+3, "```")
+			i += 2
+		case inCode && text[i] == '`' && top() == "`":
+			toggle(i+1, "`")
+		case inCode:
+		case text[i] == '\\' && i+1 < len(text):
+			ret.spans = append(ret.spans, [2]int{i, i + 2})
+			i++
+		case text[i] == '`' || text[i] == '*' || text[i] == '_':
+			toggle(i+1, text[i:i+1])
+		case text[i] == '[':
+			if mid := strings.Index(text[i:], "]("); mid > 0 {
+				if end := strings.IndexByte(text[i+mid:], ')'); end > 0 {
+					ret.spans = append(ret.spans, [2]int{i, i + mid + end + 1})
+				}
+			}
+		}
+	}
+	return
+}
+
+//textLength counts the text in UTF-16 code units
+func textLength(text string) (n int) {
+	for _, r := range text {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return
+}
+
+//prefixBytes returns the byte length of the longest prefix fitting the limit
+func prefixBytes(text string, limit int) int {
+	n := 0
+	for i, r := range text {
+		l := 1
+		if r >= 0x10000 {
+			l = 2
+		}
+		if n+l > limit {
+			return i
+		}
+		n += l
+	}
+	return len(text)
+}
+
+//cutPosition finds the last position before max to cut the text at, preferring paragraph, line and word boundaries
+func cutPosition(text string, max int, scan markupScan) int {
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		for i := strings.LastIndex(text[:max], sep); i > 0; i = strings.LastIndex(text[:i], sep) {
+			if pos := i + len(sep); scan.canCut(pos) {
+				return pos
+			}
+		}
+	}
+	for i := max; i > 0; i-- {
+		if utf8.RuneStart(text[i]) && scan.canCut(i) {
+			return i
+		}
+	}
+	for max > 0 && !utf8.RuneStart(text[max]) {
+		max--
+	}
+	return max
+}
+
+//splitText splits the text into parts fitting the limit. Formatting open at the cut is closed and reopened in the next part.
+//Each part takes at least one character of the text after the reopened formatting, so the split always ends.
+//Formatting is not reopened if its tags alone fill the part
+func splitText(text string, parseMode string, limit int) (ret []string) {
+	//carried is the byte length of the formatting reopened at the beginning of the text
+	carried := 0
+	for textLength(text) > limit {
+		scan := scanMarkup(text, parseMode)
+		budget := limit
+		var part, rest, reopening string
+		for {
+			pos := cutPosition(text, prefixBytes(text, budget), scan)
+			if pos <= carried {
+				pos = prefixBytes(text, budget)
+			}
+			if pos <= carried {
+				_, size := utf8.DecodeRuneInString(text[carried:])
+				pos = carried + size
+			}
+			open := scan.openAt(pos)
+			closing := ""
+			reopening = ""
+			for i := len(open) - 1; i >= 0; i-- {
+				closing += open[i].close
+			}
+			for _, e := range open {
+				reopening += e.open
+			}
+			if textLength(reopening)+textLength(closing) >= limit {
+				//the next part could not take any text
+				reopening = ""
+			}
+			part = strings.TrimRight(text[:pos], " \n") + closing
+			rest = reopening + strings.TrimLeft(text[pos:], "\n")
+			if over := textLength(part) - limit; over > 0 && budget > over {
+				budget -= over
+				continue
+			}
+			break
+		}
+		ret = append(ret, part)
+		text = rest
+		carried = len(reopening)
+	}
+	return append(ret, text)
+}
+
+//splitMessageText splits the rendered text into parts fitting Telegram message limit
+func splitMessageText(text string, parseMode string) []string {
+	return splitText(text, parseMode, maxMessageLength)
+}
+
+//messageParts keeps the ids of the earlier parts of the message split for length.
+//TelegramMsgID of the BotMessage is the last part, which carries the keyboard
+type messageParts []int64
+
+//MessageIDs returns the ids of all messages the BotMessage has been sent as, in order.
+//Long texts are split into several messages, the last one carries the keyboard and is returned by Id
+func (botMessage *BotMessage) MessageIDs() []int64 {
+	return messageIDs(botMessage)
+}
+
+func messageIDs(msg BotMessageInterface) []int64 {
+	var parts messageParts
+	msg.GetData(&parts)
+	return append([]int64(parts), msg.Id())
+}
+
+//addMessageID records the id of the next part sent for the message
+func addMessageID(msg BotMessageInterface, id int64) {
+	if msg.Id() != 0 {
+		var parts messageParts
+		msg.GetData(&parts)
+		msg.SetData(append(parts, msg.Id()))
+	}
+	msg.SetID(id)
+}
+
+//setMessageIDs replaces the ids of the message parts
+func setMessageIDs(msg BotMessageInterface, ids []int64) {
+	if len(ids) == 0 {
+		ids = []int64{0}
+	}
+	if parts := ids[:len(ids)-1]; len(parts) > 0 || len(messageIDs(msg)) > 1 {
+		msg.SetData(messageParts(parts))
+	}
+	msg.SetID(ids[len(ids)-1])
+}
@@ -0,0 +1,175 @@
+package botmeans
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitText(t *testing.T) {
+	if parts := splitText("short", "", 10); len(parts) != 1 || parts[0] != "short" {
+		t.Error("Short text should not be split", parts)
+	}
+	if parts := splitText("first line\n\nsecond line", "", 15); len(parts) != 2 || parts[0] != "first line" || parts[1] != "second line" {
+		t.Error("Text should be split on paragraphs", parts)
+	}
+	if parts := splitText("one two three four", "", 10); len(parts) != 2 || parts[0] != "one two" || parts[1] != "three four" {
+		t.Error("Text should be split on words", parts)
+	}
+	if parts := splitText("абвгдежзик", "", 4); len(parts) != 3 || parts[0] != "абвг" || parts[2] != "ик" {
+		t.Error("Long words should be split on characters", parts)
+	}
+	if parts := splitText("😀😀😀", "", 4); len(parts) != 2 || parts[0] != "😀😀" {
+		t.Error("Length should be counted in UTF-16", parts)
+	}
+
+	parts := splitText(`<b>bold text</b> <a href="http://x.y">link text</a> &amp; more`, "HTML", 30)
+	for _, p := range parts {
+		if textLength(p) > 30 || strings.Count(p, "<") != strings.Count(p, ">") || strings.Count(p, "<b>") != strings.Count(p, "</b>") || strings.Count(p, "<a ") != strings.Count(p, "</a>") {
+			t.Error("HTML entities should not be broken", parts)
+		}
+	}
+	if len(parts) < 2 || !strings.Contains(strings.Join(parts, ""), "&amp;") {
+		t.Error("Wrong HTML parts", parts)
+	}
+
+	parts = splitText("*bold one two three four* and [link](http://example.com) tail", "Markdown", 20)
+	for _, p := range parts {
+		if textLength(p) > 20 || strings.Count(p, "*")%2 != 0 || strings.Count(p, "[") != strings.Count(p, "](") {
+			t.Error("Markdown entities should not be broken", parts)
+		}
+	}
+	if parts[0] != "*bold one two three*" || parts[1] != "*four* and" {
+		t.Error("Open entities should be reopened in the next part", parts)
+	}
+}
+
+func TestSplitTextEnds(t *testing.T) {
+	for _, c := range []struct {
+		text  string
+		limit int
+	}{
+		{strings.Repeat("a<br>b ", 3000), maxMessageLength},
+		{strings.Repeat("1 < 2 and 3 > 2\n", 700), maxMessageLength},
+		{"<b><i><u>" + strings.Repeat("x ", 50) + "</u></i></b>", 12},
+	} {
+		done := make(chan []string, 1)
+		go func() { done <- splitText(c.text, "HTML", c.limit) }()
+		select {
+		case parts := <-done:
+			if len(parts) < 2 || strings.Count(strings.Join(parts, ""), "x") != strings.Count(c.text, "x") {
+				t.Error("Wrong parts of", c.text[:20], len(parts))
+			}
+			for _, p := range parts[:len(parts)-1] {
+				if c.limit == maxMessageLength && (textLength(p) > c.limit || strings.Contains(p, "</br>")) {
+					t.Error("Unsupported tags should not be reopened", c.text[:20], textLength(p))
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Split should end for", c.text[:20])
+		}
+	}
+}
+
+func TestSenderSplitsLongMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botmeans_split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "list.json"), []byte(`{"Template": {"": "{{.}}"}, "Keyboard": {"": [[{"Text": "Next", "Command": "next"}]]}}`), 0600)
+
+	storage := NewMemoryStorage()
+	requests := []tgbotapi.Chattable{}
+	sentID := 0
+	var fail func(c tgbotapi.Chattable) bool
+	send := func(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+		requests = append(requests, c)
+		if fail != nil && fail(c) {
+			return tgbotapi.Message{}, tgbotapi.Error{Message: "Bad Request: message can't be sent"}
+		}
+		sentID++
+		return tgbotapi.Message{MessageID: sentID}, nil
+	}
+	sender := &Sender{
+		session:     &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramChatID: 1}, UserData: "{}"},
+		bot:         &tgbotapi.BotAPI{},
+		scheduler:   NewSendScheduler(send, SendLimits{Global: 1000, PerChat: 1000}, nil),
+		templateDir: dir,
+		msgFactory:  func() BotMessageInterface { return NewBotMessage(1, storage) },
+	}
+	line := strings.Repeat("x", 99) + "\n"
+	if err := sender.Create("list", strings.Repeat(line, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Fatal("Long text should be sent in parts", len(requests))
+	}
+	for i, r := range requests {
+		msg := r.(tgbotapi.MessageConfig)
+		if textLength(msg.Text) > maxMessageLength || strings.HasSuffix(msg.Text, "x\nx") {
+			t.Error("Wrong part", i, len(msg.Text))
+		}
+		if (msg.ReplyMarkup != nil) != (i == 2) {
+			t.Error("Keyboard should be attached to the last part", i)
+		}
+	}
+	msg, err := storage.FindBotMessage(1, 3)
+	if err != nil {
+		t.Fatal("Message should be saved with the id of the last part", err)
+	}
+	if ids := msg.MessageIDs(); len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Error("All part ids should be recorded", ids)
+	}
+
+	requests = requests[:0]
+	msg.storage = storage
+	if err := sender.Edit(msg, "list", "short"); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Fatal("Extra parts should be deleted", len(requests))
+	}
+	if edit, ok := requests[0].(tgbotapi.EditMessageTextConfig); !ok || edit.MessageID != 1 || edit.ReplyMarkup == nil {
+		t.Error("First part should be edited with the keyboard", requests[0])
+	}
+	if del, ok := requests[2].(tgbotapi.DeleteMessageConfig); !ok || del.MessageID != 3 {
+		t.Error("Extra parts should be deleted", requests[1:])
+	}
+	if ids := msg.MessageIDs(); len(ids) != 1 || msg.Id() != 1 {
+		t.Error("Part ids should be updated", ids)
+	}
+	if stored, err := storage.FindBotMessage(1, 1); err != nil || len(stored.MessageIDs()) != 1 {
+		t.Error("Edited message should be saved", err)
+	}
+
+	requests = requests[:0]
+	fail = func(c tgbotapi.Chattable) bool { return len(requests) == 3 }
+	if err := sender.Create("list", strings.Repeat(line, 100)); err == nil {
+		t.Fatal("Failed part should be reported")
+	}
+	partial, err := storage.FindBotMessage(1, int64(sentID))
+	if err != nil {
+		t.Fatal("Parts sent before the failure should be saved", err)
+	}
+	if ids := partial.MessageIDs(); len(ids) != 2 || ids[1] != int64(sentID) {
+		t.Error("Sent part ids should be recorded", ids)
+	}
+
+	requests = requests[:0]
+	fail = func(c tgbotapi.Chattable) bool {
+		_, ok := c.(tgbotapi.DeleteMessageConfig)
+		return ok
+	}
+	partial.storage = storage
+	if err := sender.Edit(partial, "list", "short"); err != nil {
+		t.Error("Failed deletion should not fail the edit", err)
+	}
+	if stored, err := storage.FindBotMessage(1, partial.Id()); err != nil || len(stored.MessageIDs()) != 1 {
+		t.Error("Edited message should be saved after failed deletion", err)
+	}
+}
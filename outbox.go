@@ -0,0 +1,254 @@
+package botmeans
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"time"
+)
+
+const (
+	outboxSend          = "send"
+	outboxSendProtected = "send_protected"
+	outboxEdit          = "edit"
+	outboxDelete        = "delete"
+)
+
+//maxOutboxAttempts limits the deliveries of the entry failed with transient errors
+const maxOutboxAttempts = 10
+
+//OutboxEntry is the outgoing message recorded with the session changes and kept until it is delivered
+type OutboxEntry struct {
+	ID     int64 `sql:"index;unique"`
+	ChatID int64 `sql:"index"`
+	//BotMessageID is the storage id of the bot message created or edited by the request
+	BotMessageID int64
+	Kind         string
+	Request      string `sql:"type:text"`
+	Attempts     int
+	LastError    string `sql:"type:text"`
+	CreatedAt    time.Time
+}
+
+//OutboxStorage keeps the outgoing messages until they are delivered
+type OutboxStorage interface {
+	//OutboxAfter returns up to limit entries with ids greater than given one, ordered by id
+	OutboxAfter(id int64, limit int) ([]*OutboxEntry, error)
+	SaveOutboxEntry(entry *OutboxEntry) error
+	DeleteOutboxEntry(entry *OutboxEntry) error
+}
+
+//UseOutbox enables unit-of-work mode for the storage (see BatchWrites) and records the messages created
+//or edited by an Action to the outbox. They are sent only after the session changes are committed
+//and dropped if the handler calls Error. Message ids are unknown until then, so BotMessage.Id returns 0 inside the handler.
+//The underlying storage should implement OutboxStorage for entries to survive crashes; Run delivers them at startup
+func UseOutbox(storage Storage) Storage {
+	if b, ok := storage.(*batchingStorage); ok {
+		storage = b.Storage
+	}
+	return &batchingStorage{Storage: storage, outbox: true}
+}
+
+//outboxStorage returns OutboxStorage behind the wrappers
+func outboxStorage(storage Storage) (OutboxStorage, bool) {
+	outbox, ok := underlyingStorage(storage).(OutboxStorage)
+	return outbox, ok
+}
+
+//newOutboxEntry serializes the request
+func newOutboxEntry(chatID int64, c tgbotapi.Chattable) (*OutboxEntry, error) {
+	entry := &OutboxEntry{ChatID: chatID, CreatedAt: time.Now()}
+	switch c.(type) {
+	case tgbotapi.MessageConfig:
+		entry.Kind = outboxSend
+	case protectedMessage:
+		entry.Kind = outboxSendProtected
+	case tgbotapi.EditMessageTextConfig:
+		entry.Kind = outboxEdit
+	case tgbotapi.DeleteMessageConfig:
+		entry.Kind = outboxDelete
+	default:
+		return nil, fmt.Errorf("Cannot record %T to the outbox", c)
+	}
+	d, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	entry.Request = string(d)
+	return entry, nil
+}
+
+//chattable restores the request. Edits of the messages created in the same action get the id of the delivered message
+func (entry *OutboxEntry) chattable(msg *BotMessage) (tgbotapi.Chattable, error) {
+	switch entry.Kind {
+	case outboxSend:
+		c := tgbotapi.MessageConfig{}
+		err := json.Unmarshal([]byte(entry.Request), &c)
+		return c, err
+	case outboxSendProtected:
+		c := protectedMessage{}
+		err := json.Unmarshal([]byte(entry.Request), &c)
+		return c, err
+	case outboxEdit:
+		c := tgbotapi.EditMessageTextConfig{}
+		if err := json.Unmarshal([]byte(entry.Request), &c); err != nil {
+			return nil, err
+		}
+		if c.MessageID == 0 && msg != nil {
+			c.MessageID = int(msg.TelegramMsgID)
+		}
+		if c.MessageID == 0 {
+			return nil, fmt.Errorf("Edited message is not delivered yet")
+		}
+		return c, nil
+	case outboxDelete:
+		c := tgbotapi.DeleteMessageConfig{}
+		err := json.Unmarshal([]byte(entry.Request), &c)
+		return c, err
+	}
+	return nil, fmt.Errorf("Unknown outbox entry kind %v", entry.Kind)
+}
+
+//outboxPending is the entry recorded by the unit of work
+type outboxPending struct {
+	entry *OutboxEntry
+	msg   *BotMessage
+	send  func(tgbotapi.Chattable) (tgbotapi.Message, error)
+}
+
+//enqueue records the request to be sent after the unit of work is flushed
+func (w *unitOfWork) enqueue(chatID int64, c tgbotapi.Chattable, msg BotMessageInterface, send func(tgbotapi.Chattable) (tgbotapi.Message, error)) error {
+	entry, err := newOutboxEntry(chatID, c)
+	if err != nil {
+		return err
+	}
+	m, _ := msg.(*BotMessage)
+	w.outbox = append(w.outbox, outboxPending{entry, m, send})
+	return nil
+}
+
+//saveOutbox stores the entries after the bot messages are saved, so their ids are known
+func (w *unitOfWork) saveOutbox(storage Storage) error {
+	if len(w.outbox) == 0 {
+		return nil
+	}
+	outbox, ok := outboxStorage(storage)
+	if !ok {
+		log.Printf("Storage %T does not support outbox", underlyingStorage(storage))
+		return nil
+	}
+	for _, p := range w.outbox {
+		if p.msg != nil {
+			p.entry.BotMessageID = p.msg.ID
+		}
+		if err := outbox.SaveOutboxEntry(p.entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//deliver sends the entries recorded by the flushed unit of work
+func (w *unitOfWork) deliver() {
+	outbox, _ := outboxStorage(w.Storage)
+	for _, p := range w.outbox {
+		deliverOutboxEntry(w.Storage, outbox, p.entry, p.msg, p.send)
+	}
+	w.outbox = nil
+}
+
+//deliverOutboxEntry sends the entry and stores the id of the created message. Delivered entries and entries
+//failed permanently are removed from the outbox, others are kept for the retry at startup
+func deliverOutboxEntry(storage Storage, outbox OutboxStorage, entry *OutboxEntry, msg *BotMessage, send func(tgbotapi.Chattable) (tgbotapi.Message, error)) bool {
+	if msg == nil && entry.BotMessageID != 0 {
+		msg = botMessageByID(storage, entry.BotMessageID)
+	}
+	c, err := entry.chattable(msg)
+	sent := tgbotapi.Message{}
+	if err == nil {
+		sent, err = send(c)
+	}
+	if err == nil {
+		if createsMessage(c) && msg != nil {
+			addMessageID(msg, int64(sent.MessageID))
+			if err := storage.SaveBotMessage(msg); err != nil {
+				log.Printf("Cannot save bot message %v: %v", msg.ID, err)
+			}
+		}
+		removeOutboxEntry(outbox, entry)
+		return true
+	}
+	entry.Attempts++
+	entry.LastError = err.Error()
+	_, isTelegramError := err.(tgbotapi.Error)
+	_, transient := retryDelay(err)
+	if err == ErrChatBlocked || (isTelegramError && !transient) || entry.Attempts >= maxOutboxAttempts {
+		log.Printf("Dropping message to chat %v after %v attempts: %v", entry.ChatID, entry.Attempts, err)
+		if entry.Kind != outboxEdit && entry.Kind != outboxDelete && msg != nil && msg.TelegramMsgID == 0 {
+			storage.DeleteBotMessage(msg)
+		}
+		removeOutboxEntry(outbox, entry)
+		return false
+	}
+	if outbox != nil && entry.ID != 0 {
+		if err := outbox.SaveOutboxEntry(entry); err != nil {
+			log.Printf("Cannot save outbox entry %v: %v", entry.ID, err)
+		}
+	}
+	return false
+}
+
+func removeOutboxEntry(outbox OutboxStorage, entry *OutboxEntry) {
+	if outbox != nil && entry.ID != 0 {
+		if err := outbox.DeleteOutboxEntry(entry); err != nil {
+			log.Printf("Cannot delete outbox entry %v: %v", entry.ID, err)
+		}
+	}
+}
+
+//botMessageByID loads the bot message by its storage id
+func botMessageByID(storage BotMessageStorage, id int64) *BotMessage {
+	if page, err := storage.BotMessagesAfter(id-1, 1); err == nil && len(page) == 1 && page[0].ID == id {
+		page[0].storage = storage
+		return page[0]
+	}
+	return nil
+}
+
+//deliverOutbox sends all entries left in the outbox, the oldest first. Returns the number of delivered entries
+func deliverOutbox(storage Storage, send func(chatID int64, c tgbotapi.Chattable) (tgbotapi.Message, error)) (int, error) {
+	outbox, ok := outboxStorage(storage)
+	if !ok {
+		return 0, nil
+	}
+	delivered := 0
+	var lastID int64
+	for {
+		page, err := outbox.OutboxAfter(lastID, storagePageSize)
+		if err != nil || len(page) == 0 {
+			return delivered, err
+		}
+		for _, entry := range page {
+			chatID := entry.ChatID
+			if deliverOutboxEntry(storage, outbox, entry, nil, func(c tgbotapi.Chattable) (tgbotapi.Message, error) { return send(chatID, c) }) {
+				delivered++
+			}
+			lastID = entry.ID
+		}
+	}
+}
+
+//sendTo sends the request to the chat through the scheduler
+func (ui *MeansBot) sendTo(chatID int64, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if ui.scheduler != nil {
+		return sendResult(c)(ui.scheduler.Send(chatID, c))
+	}
+	return sendResult(c)(botSend(ui.bot)(c))
+}
+
+//DeliverOutbox sends the messages left in the outbox, e.g. by a crash before their delivery.
+//Run calls it at startup
+func (ui *MeansBot) DeliverOutbox() (int, error) {
+	return deliverOutbox(ui.storage, ui.sendTo)
+}
@@ -0,0 +1,131 @@
+package botmeans
+
+import (
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botmeans_outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "edited.json"), []byte(`{"Template": {"": "Edited"}}`), 0600)
+
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	for name, storage := range storages {
+		outboxed := UseOutbox(storage)
+		stored := &Session{SessionBase: SessionBase{TelegramUserID: 9, TelegramChatID: 9}, UserData: "{}", storage: storage}
+		stored.Save()
+
+		requests := []tgbotapi.Chattable{}
+		var sendErr error
+		send := func(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+			if sendErr != nil {
+				return tgbotapi.Message{}, sendErr
+			}
+			requests = append(requests, c)
+			return tgbotapi.Message{MessageID: 100 + len(requests)}, nil
+		}
+		scheduler := NewSendScheduler(send, SendLimits{Global: 1000, PerChat: 1000}, nil)
+
+		fail := false
+		sentBefore := 0
+		handler := func(context ActionContextInterface) {
+			context.Session().SetLocale("en")
+			context.Output().SimpleText("hello")
+			if len(requests) != sentBefore {
+				t.Error(name, "Messages should not be sent before the session is saved")
+			}
+			if fail {
+				context.Error("fail")
+			}
+		}
+		execute := func() {
+			sentBefore = len(requests)
+			session, _ := SessionLoader(SessionBase{9, "", 9, false, false}, outboxed, 0, nil)
+			(&Action{
+				session:          session,
+				handlersProvider: func(string) (ActionHandler, bool) { return handler, true },
+				getters: actionExecuterFactoryConfig{
+					cmdGetter:       func() string { return "cmd" },
+					sourceMsgGetter: func() (r BotMessageInterface) { return },
+				},
+				senderFactory: func(s senderSession) SenderInterface {
+					return &Sender{session: s, scheduler: scheduler, templateDir: dir, msgFactory: func() BotMessageInterface {
+						return NewBotMessage(s.ChatId(), outboxed)
+					}}
+				},
+			}).Execute()
+		}
+		pending := func() []*OutboxEntry {
+			outbox, _ := outboxStorage(storage)
+			entries, _ := outbox.OutboxAfter(0, 10)
+			return entries
+		}
+
+		execute()
+		if len(requests) != 1 || len(pending()) != 0 {
+			t.Error(name, "Message should be delivered after the session is saved", len(requests), len(pending()))
+		}
+		if msg, err := storage.FindBotMessage(9, 101); err != nil || msg.ID == 0 {
+			t.Error(name, "Delivered message id should be stored", err)
+		}
+
+		fail = true
+		execute()
+		if len(requests) != 1 || len(pending()) != 0 {
+			t.Error(name, "Messages should be dropped on Error", len(requests), len(pending()))
+		}
+
+		fail = false
+		handler = func(context ActionContextInterface) {
+			out := context.Output()
+			out.SimpleText("created")
+			msgs, _ := storage.BotMessagesAfter(0, 10)
+			for _, m := range msgs {
+				if m.TelegramMsgID == 101 {
+					m.storage = outboxed
+					out.Edit(m, "edited", nil)
+				}
+			}
+		}
+		sendErr = fmt.Errorf("network is down")
+		execute()
+		if entries := pending(); len(entries) != 2 || entries[0].Attempts != 1 || entries[0].LastError != "network is down" {
+			t.Fatal(name, "Undelivered messages should be kept in the outbox", len(entries))
+		}
+
+		sendErr = nil
+		delivered, err := deliverOutbox(storage, func(chatID int64, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+			return send(c)
+		})
+		if err != nil || delivered != 2 || len(pending()) != 0 {
+			t.Error(name, "Outbox should be delivered at startup", delivered, err)
+		}
+		if edit, ok := requests[len(requests)-1].(tgbotapi.EditMessageTextConfig); !ok || edit.MessageID != 101 || edit.Text != "Edited" {
+			t.Error(name, "Wrong edit request", requests[len(requests)-1])
+		}
+		if msg, err := storage.FindBotMessage(9, 102); err != nil || msg.ID == 0 {
+			t.Error(name, "Message delivered at startup should get its id", err)
+		}
+
+		sendErr = tgbotapi.Error{Message: "Bad Request: chat not found"}
+		handler = func(context ActionContextInterface) {
+			context.Output().SimpleText("lost")
+		}
+		before, _ := storage.BotMessagesAfter(0, 10)
+		execute()
+		after, _ := storage.BotMessagesAfter(0, 10)
+		if len(pending()) != 0 || len(after) != len(before) {
+			t.Error(name, "Permanently failed messages should be dropped", len(pending()), len(before), len(after))
+		}
+	}
+}
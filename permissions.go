@@ -0,0 +1,332 @@
+package botmeans
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Permission names the operation a command requires
+type Permission string
+
+const (
+	//RoleOwner is the role of bot owners, who have all permissions in all chats
+	RoleOwner = builtinRolePrefix + "owner"
+	//RoleChatAdmin is the role of the chat administrators and the creator in group chats
+	RoleChatAdmin = builtinRolePrefix + "admin"
+)
+
+//builtinRolePrefix starts the names of the roles given by AccessControl, which can't be granted as custom roles
+const builtinRolePrefix = "botmeans."
+
+//DefaultAccessDeniedTemplate is sent when the user has no permissions for the command
+const DefaultAccessDeniedTemplate = "access_denied"
+
+//chatAdminsTTL sets how often the chat administrators are synced from Telegram API
+const chatAdminsTTL = time.Hour
+
+//chatAdminsRetry is the delay before the stale administrators are synced again after the attempt has failed
+const chatAdminsRetry = time.Minute
+
+//sessionRoles keeps the custom roles of the user in the chat
+type sessionRoles []string
+
+//chatAdmins keeps the administrators of the chat synced from Telegram
+type chatAdmins struct {
+	UserIDs  []int64
+	SyncedAt time.Time
+}
+
+//AccessDenied is the data of the access denied template
+type AccessDenied struct {
+	Command    string
+	Permission Permission
+}
+
+//Roles returns the custom roles of the user in the chat
+func (session *Session) Roles() []string {
+	var roles sessionRoles
+	session.GetData(&roles)
+	return roles
+}
+
+//HasRole checks if the user has the custom role in the chat
+func (session *Session) HasRole(role string) bool {
+	for _, r := range session.Roles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+//GrantRole gives the custom role to the user in the chat. Built-in roles like RoleChatAdmin can't be granted
+func (session *Session) GrantRole(role string) {
+	if strings.HasPrefix(role, builtinRolePrefix) {
+		log.Printf("Cannot grant built-in role %v", role)
+		return
+	}
+	if !session.HasRole(role) {
+		roles := append(session.Roles(), role)
+		sort.Strings(roles)
+		session.SetData(sessionRoles(roles))
+	}
+}
+
+//RevokeRole takes the custom role from the user in the chat
+func (session *Session) RevokeRole(role string) {
+	roles := sessionRoles{}
+	for _, r := range session.Roles() {
+		if r != role {
+			roles = append(roles, r)
+		}
+	}
+	session.SetData(roles)
+}
+
+//AccessControl assigns permissions to roles and rejects commands the user has no permissions for.
+//Besides custom roles granted to sessions, bot owners get RoleOwner and chat administrators get RoleChatAdmin
+type AccessControl struct {
+	mutex          sync.RWMutex
+	owners         map[int64]struct{}
+	roles          map[string]map[Permission]struct{}
+	commands       map[string][]Permission
+	deniedTemplate string
+	storage        Storage
+	fetchAdmins    func(chatID int64) ([]int64, error)
+	//syncAttempts keeps the time of the sync started by IsChatAdmin and not succeeded yet
+	syncAttempts map[int64]time.Time
+}
+
+//NewAccessControl creates the access control keeping chat administrators in the storage.
+//Administrators are synced from Telegram if api is not nil
+func NewAccessControl(storage Storage, api *tgbotapi.BotAPI) *AccessControl {
+	ret := &AccessControl{
+		owners:         make(map[int64]struct{}),
+		roles:          make(map[string]map[Permission]struct{}),
+		commands:       make(map[string][]Permission),
+		deniedTemplate: DefaultAccessDeniedTemplate,
+		storage:        storage,
+		syncAttempts:   make(map[int64]time.Time),
+	}
+	if api != nil {
+		ret.fetchAdmins = func(chatID int64) (ret []int64, err error) {
+			members, err := api.GetChatAdministrators(tgbotapi.ChatConfig{ChatID: chatID})
+			for _, m := range members {
+				if m.User != nil {
+					ret = append(ret, int64(m.User.ID))
+				}
+			}
+			return
+		}
+	}
+	return ret
+}
+
+//SetOwners sets the users who own the bot
+func (ac *AccessControl) SetOwners(userIDs ...int64) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.owners = make(map[int64]struct{})
+	for _, id := range userIDs {
+		ac.owners[id] = struct{}{}
+	}
+}
+
+//DefineRole adds permissions to the role. Use RoleChatAdmin to set the permissions of chat administrators
+func (ac *AccessControl) DefineRole(role string, permissions ...Permission) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if ac.roles[role] == nil {
+		ac.roles[role] = make(map[Permission]struct{})
+	}
+	for _, p := range permissions {
+		ac.roles[role][p] = struct{}{}
+	}
+}
+
+//Require declares the permissions needed to execute the command
+func (ac *AccessControl) Require(cmd string, permissions ...Permission) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.commands[cmd] = append(ac.commands[cmd], permissions...)
+}
+
+//SetDeniedTemplate sets the template sent when the command is rejected. Empty name disables the reply
+func (ac *AccessControl) SetDeniedTemplate(templateName string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.deniedTemplate = templateName
+}
+
+//IsOwner checks if the user owns the bot
+func (ac *AccessControl) IsOwner(userID int64) bool {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	_, ok := ac.owners[userID]
+	return ok
+}
+
+//IsChatAdmin checks if the user administers the group chat. The list of administrators is synced when stale.
+//Failed syncs are retried after chatAdminsRetry, the stale list is used meanwhile
+func (ac *AccessControl) IsChatAdmin(chatID int64, userID int64) bool {
+	if chatID > 0 {
+		return false
+	}
+	var admins chatAdmins
+	ChatLoader(chatID, ac.storage).GetData(&admins)
+	if ac.fetchAdmins != nil && time.Since(admins.SyncedAt) > chatAdminsTTL && ac.startSync(chatID) {
+		err := ac.SyncChatAdmins(chatID)
+		if err != nil {
+			log.Printf("Cannot sync administrators of chat %v: %v", chatID, err)
+		} else {
+			ac.mutex.Lock()
+			delete(ac.syncAttempts, chatID)
+			ac.mutex.Unlock()
+		}
+		ChatLoader(chatID, ac.storage).GetData(&admins)
+	}
+	for _, id := range admins.UserIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+//startSync records the sync attempt. Returns false if the chat has been tried within chatAdminsRetry
+func (ac *AccessControl) startSync(chatID int64) bool {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if time.Since(ac.syncAttempts[chatID]) < chatAdminsRetry {
+		return false
+	}
+	ac.syncAttempts[chatID] = time.Now()
+	return true
+}
+
+//SyncChatAdmins loads the administrators of the chat from Telegram
+func (ac *AccessControl) SyncChatAdmins(chatID int64) error {
+	if ac.fetchAdmins == nil {
+		return nil
+	}
+	ids, err := ac.fetchAdmins(chatID)
+	if err != nil {
+		return err
+	}
+	ac.setChatAdmins(chatID, ids)
+	return nil
+}
+
+//isAdminStatus checks if the chat member status grants administrator rights
+func isAdminStatus(status string) bool {
+	return status == "creator" || status == "administrator"
+}
+
+//observeMemberUpdate adds the promoted member to the cached administrators of the chat and removes the demoted one
+func (ac *AccessControl) observeMemberUpdate(upd chatMemberUpdate) {
+	if upd.NewChatMember.User == nil {
+		return
+	}
+	wasAdmin := isAdminStatus(upd.OldChatMember.Status)
+	isAdmin := isAdminStatus(upd.NewChatMember.Status)
+	if wasAdmin == isAdmin {
+		return
+	}
+	userID := int64(upd.NewChatMember.User.ID)
+	chat := ChatLoader(upd.Chat.ID, ac.storage)
+	var admins chatAdmins
+	chat.GetData(&admins)
+	if admins.SyncedAt.IsZero() {
+		//never synced, IsChatAdmin loads the whole list
+		return
+	}
+	ids := make([]int64, 0, len(admins.UserIDs)+1)
+	for _, id := range admins.UserIDs {
+		if id != userID {
+			ids = append(ids, id)
+		}
+	}
+	if isAdmin {
+		ids = append(ids, userID)
+	}
+	chat.SetData(chatAdmins{ids, admins.SyncedAt})
+}
+
+func (ac *AccessControl) setChatAdmins(chatID int64, userIDs []int64) {
+	ChatLoader(chatID, ac.storage).SetData(chatAdmins{userIDs, time.Now()})
+}
+
+//Roles returns all roles of the user in the session's chat, including RoleOwner and RoleChatAdmin
+func (ac *AccessControl) Roles(session ChatSession) []string {
+	roles := session.Roles()
+	if ac.IsOwner(session.UserId()) {
+		roles = append(roles, RoleOwner)
+	}
+	if !session.IsOneToOne() && ac.IsChatAdmin(session.ChatId(), session.UserId()) {
+		roles = append(roles, RoleChatAdmin)
+	}
+	return roles
+}
+
+//Can checks if the user has the permission in the session's chat. Bot owners have all permissions
+func (ac *AccessControl) Can(session ChatSession, permission Permission) bool {
+	roles := ac.Roles(session)
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	for _, role := range roles {
+		if role == RoleOwner {
+			return true
+		}
+		if _, ok := ac.roles[role][permission]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+//Guard wraps the handlers provider, so the commands are executed only if the user has their required permissions.
+//Otherwise the denied template is sent and the command is finished
+func (ac *AccessControl) Guard(provider ActionHandlersProvider) ActionHandlersProvider {
+	return func(cmd string) (ActionHandler, bool) {
+		handler, ok := provider(cmd)
+		ac.mutex.RLock()
+		required := ac.commands[cmd]
+		ac.mutex.RUnlock()
+		if !ok || len(required) == 0 {
+			return handler, ok
+		}
+		return func(context ActionContextInterface) {
+			session := context.Session()
+			for _, p := range required {
+				if session == nil || !ac.Can(session, p) {
+					context.Finish()
+					ac.deny(context, cmd, p)
+					return
+				}
+			}
+			handler(context)
+		}, true
+	}
+}
+
+//deny sends the denied template
+func (ac *AccessControl) deny(context ActionContextInterface, cmd string, permission Permission) {
+	ac.mutex.RLock()
+	template := ac.deniedTemplate
+	ac.mutex.RUnlock()
+	if template != "" {
+		context.Output().Create(template, AccessDenied{cmd, permission})
+	}
+}
+
+//AccessControl returns the access control applied to the commands by Run
+func (ui *MeansBot) AccessControl() *AccessControl {
+	if ui.access == nil {
+		ui.access = NewAccessControl(ui.storage, ui.bot)
+	}
+	return ui.access
+}
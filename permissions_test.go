@@ -0,0 +1,139 @@
+package botmeans
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestAccessControl(t *testing.T) {
+	storage := NewMemoryStorage()
+	ac := NewAccessControl(storage, nil)
+	ac.SetOwners(1)
+	ac.DefineRole(RoleChatAdmin, "ban", "pin")
+	ac.DefineRole("moderator", "pin")
+	ac.Require("ban", "ban")
+	ac.Require("pin", "pin")
+
+	synced := 0
+	ac.fetchAdmins = func(chatID int64) ([]int64, error) {
+		synced++
+		return []int64{2}, nil
+	}
+	newSession := func(userID int64) *Session {
+		s := &Session{SessionBase: SessionBase{TelegramUserID: userID, TelegramChatID: -100}, UserData: "{}", storage: storage}
+		s.Save()
+		return s
+	}
+	owner, admin, moderator, user := newSession(1), newSession(2), newSession(3), newSession(4)
+	moderator.GrantRole("moderator")
+	moderator.GrantRole("moderator")
+	if roles := moderator.Roles(); len(roles) != 1 || !moderator.HasRole("moderator") {
+		t.Error("Wrong roles", roles)
+	}
+
+	if !ac.Can(owner, "anything") || !ac.Can(admin, "ban") || ac.Can(moderator, "ban") || !ac.Can(moderator, "pin") || ac.Can(user, "pin") {
+		t.Error("Wrong permissions")
+	}
+	if roles := ac.Roles(admin); len(roles) != 1 || roles[0] != RoleChatAdmin {
+		t.Error("Chat admin should be synced", roles)
+	}
+	if synced != 1 {
+		t.Error("Admins should be synced once until stale", synced)
+	}
+	memberUpdate := func(userID int, oldStatus string, newStatus string) chatMemberUpdate {
+		return chatMemberUpdate{
+			Chat:          tgbotapi.Chat{ID: -100},
+			OldChatMember: tgbotapi.ChatMember{User: &tgbotapi.User{ID: userID}, Status: oldStatus},
+			NewChatMember: tgbotapi.ChatMember{User: &tgbotapi.User{ID: userID}, Status: newStatus},
+		}
+	}
+	ac.observeMemberUpdate(memberUpdate(2, "administrator", "member"))
+	ac.observeMemberUpdate(memberUpdate(4, "member", "administrator"))
+	if ac.Can(admin, "ban") || !ac.Can(user, "ban") {
+		t.Error("Demoted and promoted members should change the admins")
+	}
+	ac.observeMemberUpdate(memberUpdate(4, "administrator", "member"))
+	ac.observeMemberUpdate(memberUpdate(2, "member", "creator"))
+	if !ac.Can(admin, "ban") || ac.Can(user, "ban") || synced != 1 {
+		t.Error("Member updates should change the cached admins", synced)
+	}
+	private := &Session{SessionBase: SessionBase{TelegramUserID: 2, TelegramChatID: 2}, UserData: "{}", storage: storage}
+	if ac.Can(private, "ban") {
+		t.Error("Chat admin role should not be given in private chat")
+	}
+
+	user.GrantRole(RoleChatAdmin)
+	user.GrantRole("admin")
+	if user.HasRole(RoleChatAdmin) || ac.Can(user, "ban") {
+		t.Error("Built-in role should not be granted", user.Roles())
+	}
+	user.RevokeRole("admin")
+
+	moderator.RevokeRole("moderator")
+	if moderator.HasRole("moderator") || ac.Can(moderator, "pin") {
+		t.Error("Role should be revoked")
+	}
+
+	failing := NewAccessControl(storage, nil)
+	attempts := 0
+	failing.fetchAdmins = func(chatID int64) ([]int64, error) {
+		attempts++
+		return nil, fmt.Errorf("Bad Gateway")
+	}
+	failing.IsChatAdmin(-200, 2)
+	failing.IsChatAdmin(-200, 3)
+	if attempts != 1 {
+		t.Error("Failed sync should not be retried at once", attempts)
+	}
+	failing.syncAttempts[-200] = time.Now().Add(-chatAdminsRetry)
+	if failing.IsChatAdmin(-200, 2); attempts != 2 {
+		t.Error("Failed sync should be retried later", attempts)
+	}
+
+	executed := ""
+	provider := ac.Guard(func(cmd string) (ActionHandler, bool) {
+		return func(ActionContextInterface) { executed = cmd }, cmd != "unknown"
+	})
+	if _, ok := provider("unknown"); ok {
+		t.Error("Unknown command should not be provided")
+	}
+	sent := []BotMessageInterface{}
+	run := func(session *Session, cmd string) *Action {
+		executed = ""
+		sent = sent[:0]
+		a := &Action{
+			session:          session,
+			handlersProvider: provider,
+			getters: actionExecuterFactoryConfig{
+				cmdGetter:       func() string { return cmd },
+				sourceMsgGetter: func() (r BotMessageInterface) { return },
+			},
+			senderFactory: func(s senderSession) SenderInterface {
+				return &Sender{session: s, msgFactory: func() BotMessageInterface {
+					m := NewBotMessage(s.ChatId(), storage)
+					sent = append(sent, m)
+					return m
+				}}
+			},
+		}
+		a.Execute()
+		return a
+	}
+	if a := run(user, "ban"); executed != "" || a.LastCommand != "" || len(sent) != 1 {
+		t.Error("Command should be rejected", executed, a.LastCommand, len(sent))
+	} else {
+		var denied AccessDenied
+		if sent[0].GetData(&denied); denied.Command != "ban" || denied.Permission != "ban" {
+			t.Error("Wrong denied template data", denied)
+		}
+	}
+	if run(admin, "ban"); executed != "ban" {
+		t.Error("Admin should execute the command")
+	}
+	if run(user, "help"); executed != "help" {
+		t.Error("Command without permissions should be executed")
+	}
+}
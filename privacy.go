@@ -0,0 +1,368 @@
+package botmeans
+
+import (
+	"encoding/json"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"time"
+)
+
+//ErasureMode defines how ErasePersonalData treats the data of the user
+type ErasureMode int
+
+const (
+	//DeletePersonalData deletes all records of the user
+	DeletePersonalData ErasureMode = iota
+	//AnonymizePersonalData keeps the user's sessions in group chats without identifiers, names and data,
+	//so the chat statistics stay consistent. The profile and the private chat are deleted
+	AnonymizePersonalData
+)
+
+//PersonalDataHandler lets applications export and erase the data they keep about the user in their own tables
+type PersonalDataHandler interface {
+	ExportPersonalData(userID int64) (interface{}, error)
+	ErasePersonalData(userID int64, mode ErasureMode) error
+}
+
+//PersonalData contains everything stored about the user
+type PersonalData struct {
+	UserID      int64
+	Profile     *PersonalProfile       `json:",omitempty"`
+	Sessions    []PersonalSession      `json:",omitempty"`
+	PrivateChat json.RawMessage        `json:",omitempty"`
+	BotMessages []PersonalBotMessage   `json:",omitempty"`
+	Application map[string]interface{} `json:",omitempty"`
+}
+
+//PersonalProfile is the exported global profile of the user
+type PersonalProfile struct {
+	UserName       string
+	FirstName      string
+	LastName       string
+	PreviousLogins []string
+	LanguageCode   string
+	CreatedAt      time.Time
+	Data           json.RawMessage
+}
+
+//PersonalSession is the exported session of the user in some chat
+type PersonalSession struct {
+	ChatID         int64
+	ChatTitle      string
+	UserName       string
+	FirstName      string
+	LastName       string
+	PreviousLogins []string
+	CreatedAt      time.Time
+	Data           json.RawMessage
+	//DataChanges is the audit trail of the session data, see AuditSessionData
+	DataChanges []PersonalDataChange `json:",omitempty"`
+}
+
+//PersonalDataChange is the exported entry of the session data audit trail
+type PersonalDataChange struct {
+	Command   string
+	DataKey   string
+	Before    json.RawMessage `json:",omitempty"`
+	After     json.RawMessage `json:",omitempty"`
+	ChangedAt time.Time
+}
+
+//PersonalBotMessage is the exported message sent by the bot to the user's private chat
+type PersonalBotMessage struct {
+	MessageID int64
+	Timestamp time.Time
+	Data      json.RawMessage
+}
+
+//rawData returns stored UserData as JSON with encrypted values decrypted
+func rawData(userData string) json.RawMessage {
+	userData = decryptedData(userData)
+	var v interface{}
+	if json.Unmarshal([]byte(userData), &v) != nil {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(userData)
+}
+
+//rawValue returns the value stored under the data key as JSON, decrypted if encrypted. Returns nil for empty values
+func rawValue(key string, stored string) json.RawMessage {
+	if stored == "" {
+		return nil
+	}
+	if plain, _, err := decryptValue(key, json.RawMessage(stored)); err == nil {
+		return plain
+	}
+	return json.RawMessage(stored)
+}
+
+//personalDataChanges exports the audit trail of the session
+func personalDataChanges(storage Storage, sessionID int64) (ret []PersonalDataChange, err error) {
+	changes, err := DataChanges(storage, sessionID)
+	for _, c := range changes {
+		ret = append(ret, PersonalDataChange{c.Command, c.DataKey, rawValue(c.DataKey, c.Before), rawValue(c.DataKey, c.After), c.ChangedAt})
+	}
+	return
+}
+
+//personalSessions returns the sessions of the user, including mention placeholders with the user's usernames
+func personalSessions(storage Storage, userID int64) ([]*Session, error) {
+	sessions, err := storage.UserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	userNames := make(map[string]struct{})
+	if user, err := storage.FindUser(userID); err == nil {
+		for _, name := range append(user.PreviousLogins(), user.TelegramUserName) {
+			userNames[name] = struct{}{}
+		}
+	}
+	chats := make(map[int64]struct{})
+	for _, s := range sessions {
+		chats[s.TelegramChatID] = struct{}{}
+		userNames[s.TelegramUserName] = struct{}{}
+		for _, name := range s.PreviousLogins() {
+			userNames[name] = struct{}{}
+		}
+	}
+	delete(userNames, "")
+	for chatID := range chats {
+		chatSessions, err := storage.ChatSessions(chatID)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range chatSessions {
+			if _, ok := userNames[p.TelegramUserName]; ok && p.TelegramUserID == 0 {
+				sessions = append(sessions, p)
+			}
+		}
+	}
+	return sessions, nil
+}
+
+//privateBotMessages returns the messages sent to the user's private chat
+func privateBotMessages(storage Storage, userID int64) (ret []*BotMessage, err error) {
+	err = forEachBotMessage(storage, func(m *BotMessage) error {
+		if m.TelegramChatID == userID {
+			ret = append(ret, m)
+		}
+		return nil
+	})
+	return
+}
+
+//ExportPersonalData collects the data stored about the user in all chats.
+//Bot messages are exported for the private chat only, since group messages are not bound to users
+func ExportPersonalData(storage Storage, userID int64, handlers map[string]PersonalDataHandler) (*PersonalData, error) {
+	ret := &PersonalData{UserID: userID}
+	if user, err := storage.FindUser(userID); err == nil {
+		ret.Profile = &PersonalProfile{
+			UserName:       user.TelegramUserName,
+			FirstName:      user.FirstName,
+			LastName:       user.LastName,
+			PreviousLogins: user.PreviousLogins(),
+			LanguageCode:   user.LanguageCode,
+			CreatedAt:      user.CreatedAt,
+			Data:           rawData(user.UserData),
+		}
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	sessions, err := personalSessions(storage, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		changes, err := personalDataChanges(storage, s.ID)
+		if err != nil {
+			return nil, err
+		}
+		ret.Sessions = append(ret.Sessions, PersonalSession{
+			ChatID:         s.TelegramChatID,
+			ChatTitle:      s.ChatName,
+			UserName:       s.TelegramUserName,
+			FirstName:      s.FirstName,
+			LastName:       s.LastName,
+			PreviousLogins: s.PreviousLogins(),
+			CreatedAt:      s.CreatedAt,
+			Data:           rawData(s.UserData),
+			DataChanges:    changes,
+		})
+	}
+
+	if chat, err := storage.FindChat(userID); err == nil {
+		ret.PrivateChat = rawData(chat.UserData)
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	msgs, err := privateBotMessages(storage, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		ret.BotMessages = append(ret.BotMessages, PersonalBotMessage{m.TelegramMsgID, m.Timestamp, rawData(m.UserData)})
+	}
+
+	for name, h := range handlers {
+		data, err := h.ExportPersonalData(userID)
+		if err != nil {
+			return nil, err
+		}
+		if ret.Application == nil {
+			ret.Application = make(map[string]interface{})
+		}
+		ret.Application[name] = data
+	}
+	return ret, nil
+}
+
+//ErasePersonalData erases or anonymizes the data stored about the user, then calls the handlers
+func ErasePersonalData(storage Storage, userID int64, mode ErasureMode, handlers map[string]PersonalDataHandler) error {
+	err := inTransaction(storage, func(tx Storage) error {
+		sessions, err := personalSessions(tx, userID)
+		if err != nil {
+			return err
+		}
+		for _, s := range sessions {
+			if mode == AnonymizePersonalData && s.TelegramChatID != userID {
+				err = anonymizeSession(tx, s)
+			} else {
+				err = tx.DeleteSession(s)
+			}
+			if err != nil {
+				return err
+			}
+			//after anonymizing, which is audited too
+			if err := deleteDataChanges(tx, s.ID); err != nil {
+				return err
+			}
+		}
+		if err := tx.DeleteUser(&User{TelegramUserID: userID}); err != nil {
+			return err
+		}
+		if err := tx.DeleteChat(&Chat{TelegramChatID: userID}); err != nil {
+			return err
+		}
+		msgs, err := privateBotMessages(tx, userID)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := tx.DeleteBotMessage(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, h := range handlers {
+		if err := h.ErasePersonalData(userID, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//anonymizeSession removes identifiers, names and data from the stored session
+func anonymizeSession(storage Storage, session *Session) error {
+	for i := 0; i < sessionSaveRetries; i++ {
+		session.TelegramUserID = 0
+		session.TelegramUserName = ""
+		session.FirstName = ""
+		session.LastName = ""
+		session.UserNameHistory = ""
+		session.UserData = "{}"
+		err := storage.SaveSession(session)
+		if err != ErrConflict {
+			return err
+		}
+		if session, err = storage.SessionByID(session.ID); err != nil {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+//HandlePersonalData registers the handler exporting and erasing application data of users under given name
+func (ui *MeansBot) HandlePersonalData(name string, handler PersonalDataHandler) {
+	if ui.personalDataHandlers == nil {
+		ui.personalDataHandlers = make(map[string]PersonalDataHandler)
+	}
+	ui.personalDataHandlers[name] = handler
+}
+
+//ExportPersonalData returns all data stored about the user as JSON
+func (ui *MeansBot) ExportPersonalData(user UserIdentifier) ([]byte, error) {
+	data, err := ExportPersonalData(ui.storage, user.UserId(), ui.personalDataHandlers)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(data, "", "  ")
+}
+
+//ErasePersonalData erases or anonymizes all data stored about the user
+func (ui *MeansBot) ErasePersonalData(user UserIdentifier, mode ErasureMode) error {
+	return ErasePersonalData(ui.storage, user.UserId(), mode, ui.personalDataHandlers)
+}
+
+//sendNow sends the request within the limits of the scheduler, without storing anything
+func (ui *MeansBot) sendNow(chatID int64, c tgbotapi.Chattable) (err error) {
+	if ui.scheduler != nil {
+		_, err = ui.scheduler.Send(chatID, c)
+	} else if ui.bot != nil {
+		_, err = ui.bot.Send(c)
+	}
+	return
+}
+
+//PersonalDataExportHandler returns ActionHandler sending the data stored about the user as JSON file.
+//The data covers all chats, so it is sent to the private chat with the user even if the command is called in a group
+func (ui *MeansBot) PersonalDataExportHandler() ActionHandler {
+	return func(context ActionContextInterface) {
+		session := context.Session()
+		context.Finish()
+		d, err := ui.ExportPersonalData(session)
+		if err != nil {
+			context.Error(err)
+		}
+		doc := tgbotapi.NewDocumentUpload(session.UserId(), tgbotapi.FileBytes{Name: "personal_data.json", Bytes: d})
+		if err := ui.sendNow(session.UserId(), doc); err != nil {
+			log.Printf("Cannot send personal data to user %v: %v", session.UserId(), err)
+		}
+	}
+}
+
+//PersonalDataEraseHandler returns ActionHandler erasing the data stored about the user.
+//The template is sent after erasing, if given. The confirmation is not stored, so nothing about the user is kept
+func (ui *MeansBot) PersonalDataEraseHandler(mode ErasureMode, templateName string) ActionHandler {
+	return func(context ActionContextInterface) {
+		session := context.Session()
+		locale := session.Locale()
+		if err := ui.ErasePersonalData(session, mode); err != nil {
+			context.Error(err)
+		}
+		if s, ok := session.(*Session); ok {
+			s.erased = true
+		}
+		context.Finish()
+		if templateName == "" {
+			return
+		}
+		params, err := renderFromTemplate(ui.tlgConfig.TemplateDir, templateName, locale, struct{}{})
+		if err != nil {
+			log.Printf("Cannot render %v: %v", templateName, err)
+			return
+		}
+		for _, part := range splitMessageText(params.text, params.ParseMode) {
+			msg := tgbotapi.NewMessage(session.ChatId(), part)
+			msg.ParseMode = params.ParseMode
+			if err := ui.sendNow(session.ChatId(), msg); err != nil {
+				log.Printf("Cannot confirm erasure to chat %v: %v", session.ChatId(), err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package botmeans
+
+import (
+	"encoding/json"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testPersonalDataHandler struct {
+	erased map[int64]ErasureMode
+}
+
+func (h *testPersonalDataHandler) ExportPersonalData(userID int64) (interface{}, error) {
+	return map[string]int64{"orders": userID}, nil
+}
+
+func (h *testPersonalDataHandler) ErasePersonalData(userID int64, mode ErasureMode) error {
+	h.erased[userID] = mode
+	return nil
+}
+
+func TestPersonalData(t *testing.T) {
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	type Note struct{ Text string }
+
+	for name, storage := range storages {
+		user := &User{TelegramUserID: 7, TelegramUserName: "seven", UserData: "{}", storage: storage}
+		user.SetData(Note{"profile"})
+		private := &Session{SessionBase: SessionBase{TelegramUserID: 7, TelegramUserName: "seven", TelegramChatID: 7}, UserData: "{}", storage: storage}
+		private.SetData(Note{"private"})
+		group := &Session{SessionBase: SessionBase{TelegramUserID: 7, TelegramUserName: "seven", TelegramChatID: -1}, UserData: "{}", storage: storage}
+		group.SetData(Note{"group"})
+		mention := &Session{SessionBase: SessionBase{TelegramUserName: "seven", TelegramChatID: -1}, UserData: "{}", storage: storage}
+		mention.Save()
+		other := &Session{SessionBase: SessionBase{TelegramUserID: 8, TelegramChatID: -1}, UserData: "{}", storage: storage}
+		other.Save()
+		msg := NewBotMessage(7, storage)
+		msg.SetData(Note{"message"})
+		msg.Save()
+		groupMsg := NewBotMessage(-1, storage)
+		groupMsg.Save()
+
+		handlers := map[string]PersonalDataHandler{"shop": &testPersonalDataHandler{make(map[int64]ErasureMode)}}
+		data, err := ExportPersonalData(storage, 7, handlers)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if data.Profile == nil || len(data.Sessions) != 3 || len(data.BotMessages) != 1 || data.Application["shop"] == nil {
+			t.Errorf("%v: Wrong export %+v", name, data)
+		}
+		if _, err := json.Marshal(data); err != nil {
+			t.Error(name, "Export should be serializable", err)
+		}
+
+		if err := ErasePersonalData(storage, 7, AnonymizePersonalData, handlers); err != nil {
+			t.Fatal(name, err)
+		}
+		if _, err := storage.FindUser(7); err != ErrNotFound {
+			t.Error(name, "Profile should be deleted", err)
+		}
+		if l, _ := storage.UserSessions(7); len(l) != 0 {
+			t.Error(name, "Sessions should not be bound to the user", len(l))
+		}
+		if s, err := storage.SessionByID(group.ID); err != nil || s.UserData != "{}" || s.TelegramUserName != "" {
+			t.Error(name, "Group session should be anonymized", err)
+		}
+		if _, err := storage.SessionByID(private.ID); err != ErrNotFound {
+			t.Error(name, "Private session should be deleted", err)
+		}
+		if msgs, _ := storage.BotMessagesAfter(0, 10); len(msgs) != 1 || msgs[0].ID != groupMsg.(*BotMessage).ID {
+			t.Error(name, "Only group message should be kept", len(msgs))
+		}
+		if l, _ := storage.ChatSessions(-1); len(l) != 3 {
+			t.Error(name, "Other sessions should be kept", len(l))
+		}
+		if mode, ok := handlers["shop"].(*testPersonalDataHandler).erased[7]; !ok || mode != AnonymizePersonalData {
+			t.Error(name, "Handler should be called")
+		}
+	}
+}
+
+func TestPersonalDataHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botmeans_privacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "erased.json"), []byte(`{"Template": {"": "Erased"}}`), 0600)
+
+	storage := NewMemoryStorage()
+	sent := map[int64][]tgbotapi.Chattable{}
+	send := func(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+		switch r := c.(type) {
+		case tgbotapi.DocumentConfig:
+			sent[r.ChatID] = append(sent[r.ChatID], c)
+		case tgbotapi.MessageConfig:
+			sent[r.ChatID] = append(sent[r.ChatID], c)
+		}
+		return tgbotapi.Message{MessageID: 1}, nil
+	}
+	ui := &MeansBot{
+		storage:   storage,
+		tlgConfig: TelegramConfig{TemplateDir: dir},
+		scheduler: NewSendScheduler(send, SendLimits{Global: 1000, PerChat: 1000, PerGroup: 1000}, nil),
+	}
+	session := &Session{SessionBase: SessionBase{TelegramUserID: 7, TelegramChatID: -1}, UserData: "{}", storage: storage}
+	session.Save()
+	run := func(handler ActionHandler) {
+		a := &Action{
+			session:          session,
+			handlersProvider: func(string) (ActionHandler, bool) { return handler, true },
+			getters: actionExecuterFactoryConfig{
+				cmdGetter:       func() string { return "privacy" },
+				sourceMsgGetter: func() (r BotMessageInterface) { return },
+			},
+			senderFactory: func(s senderSession) SenderInterface {
+				return &Sender{session: s, templateDir: dir, msgFactory: func() BotMessageInterface { return NewBotMessage(s.ChatId(), storage) }}
+			},
+		}
+		a.Execute()
+	}
+
+	run(ui.PersonalDataExportHandler())
+	if len(sent[7]) != 1 || len(sent[-1]) != 0 {
+		t.Error("Export should be sent to the private chat only", sent)
+	}
+
+	run(ui.PersonalDataEraseHandler(DeletePersonalData, "erased"))
+	if len(sent[-1]) != 1 || sent[-1][0].(tgbotapi.MessageConfig).Text != "Erased" {
+		t.Error("Erasure should be confirmed", sent[-1])
+	}
+	if msgs, _ := storage.BotMessagesAfter(0, 10); len(msgs) != 0 {
+		t.Error("Confirmation should not be stored", len(msgs))
+	}
+	if l, _ := storage.ChatSessions(-1); len(l) != 0 {
+		t.Error("Session should not be stored again", len(l))
+	}
+}
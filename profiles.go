@@ -0,0 +1,282 @@
+package botmeans
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"sync"
+	"time"
+)
+
+//profileRefreshQueueSize limits the number of pending API lookups
+const profileRefreshQueueSize = 1000
+
+type userProfile struct {
+	firstName    string
+	lastName     string
+	languageCode string
+	updated      time.Time
+}
+
+type chatProfile struct {
+	title   string
+	updated time.Time
+}
+
+type profileRequest struct {
+	chatID int64
+	userID int64
+}
+
+//profileExpiry is the number of ttl periods after which the profile not seen again is evicted from the cache
+const profileExpiry = 2
+
+//ProfileCache keeps user names and chat titles seen in updates, so sessions are loaded without Telegram API calls.
+//Missing or stale profiles are requested from the API in background and saved to the stored sessions.
+//Profiles not updated for profileExpiry*ttl are evicted
+type ProfileCache struct {
+	mutex   sync.Mutex
+	users   map[int64]userProfile
+	chats   map[int64]chatProfile
+	pending map[profileRequest]struct{}
+	ttl     time.Duration
+	evicted time.Time
+	api     *tgbotapi.BotAPI
+	storage Storage
+	queue   chan profileRequest
+}
+
+//NewProfileCache creates the cache. Profiles older than ttl are refreshed.
+//Background refreshing is enabled if api is not nil
+func NewProfileCache(api *tgbotapi.BotAPI, storage Storage, ttl time.Duration) *ProfileCache {
+	ret := &ProfileCache{
+		users:   make(map[int64]userProfile),
+		chats:   make(map[int64]chatProfile),
+		pending: make(map[profileRequest]struct{}),
+		ttl:     ttl,
+		evicted: time.Now(),
+		api:     api,
+		storage: storage,
+		queue:   make(chan profileRequest, profileRefreshQueueSize),
+	}
+	if api != nil {
+		go ret.refresher()
+	}
+	return ret
+}
+
+//Observe remembers the users and chats contained in the update
+func (p *ProfileCache) Observe(tgUpdate tgbotapi.Update) {
+	for _, msg := range []*tgbotapi.Message{tgUpdate.Message, tgUpdate.EditedMessage, tgUpdate.ChannelPost, tgUpdate.EditedChannelPost} {
+		if msg == nil {
+			continue
+		}
+		p.observeMessage(msg)
+	}
+	if q := tgUpdate.CallbackQuery; q != nil {
+		p.observeUser(q.From)
+		if q.Message != nil {
+			p.observeChat(q.Message.Chat)
+		}
+	}
+	if q := tgUpdate.InlineQuery; q != nil {
+		p.observeUser(q.From)
+	}
+}
+
+func (p *ProfileCache) observeMessage(msg *tgbotapi.Message) {
+	p.observeUser(msg.From)
+	p.observeChat(msg.Chat)
+	p.observeUser(msg.LeftChatMember)
+	if msg.NewChatMembers != nil {
+		for i := range *msg.NewChatMembers {
+			p.observeUser(&(*msg.NewChatMembers)[i])
+		}
+	}
+	if msg.Entities != nil {
+		for _, ent := range *msg.Entities {
+			p.observeUser(ent.User)
+		}
+	}
+	if msg.ReplyToMessage != nil {
+		p.observeUser(msg.ReplyToMessage.From)
+	}
+}
+
+//observeMemberUpdate remembers the chat of my_chat_member or chat_member update
+func (p *ProfileCache) observeMemberUpdate(upd chatMemberUpdate) {
+	p.observeUser(&upd.From)
+	p.observeChat(&upd.Chat)
+}
+
+func (p *ProfileCache) observeUser(user *tgbotapi.User) {
+	if user == nil {
+		return
+	}
+	p.mutex.Lock()
+	languageCode := user.LanguageCode
+	if languageCode == "" {
+		//API lookups don't return the language
+		languageCode = p.users[int64(user.ID)].languageCode
+	}
+	p.users[int64(user.ID)] = userProfile{user.FirstName, user.LastName, languageCode, time.Now()}
+	p.evict()
+	p.mutex.Unlock()
+}
+
+//evict removes expired profiles, at most once per ttl. Should be called with the mutex locked
+func (p *ProfileCache) evict() {
+	now := time.Now()
+	if now.Sub(p.evicted) < p.ttl {
+		return
+	}
+	p.evicted = now
+	for id, profile := range p.users {
+		if now.Sub(profile.updated) > profileExpiry*p.ttl {
+			delete(p.users, id)
+		}
+	}
+	for id, profile := range p.chats {
+		if now.Sub(profile.updated) > profileExpiry*p.ttl {
+			delete(p.chats, id)
+		}
+	}
+}
+
+//languageCode returns the language of the user's Telegram client, if seen in updates
+func (p *ProfileCache) languageCode(userID int64) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.users[userID].languageCode
+}
+
+func (p *ProfileCache) observeChat(chat *tgbotapi.Chat) {
+	if chat == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.chats[chat.ID] = chatProfile{chat.Title, time.Now()}
+	p.evict()
+	p.mutex.Unlock()
+}
+
+//apply copies the known profile to the session and requests the refresh if the profile is missing or stale
+func (p *ProfileCache) apply(session *Session) {
+	p.mutex.Lock()
+	user, userKnown := p.users[session.TelegramUserID]
+	chat, chatKnown := p.chats[session.TelegramChatID]
+	p.mutex.Unlock()
+
+	if userKnown {
+		session.FirstName = user.firstName
+		session.LastName = user.lastName
+	}
+	if chatKnown {
+		session.ChatName = chat.title
+	}
+	if session.TelegramUserID != 0 && (!userKnown || time.Since(user.updated) > p.ttl) {
+		p.request(profileRequest{session.TelegramChatID, session.TelegramUserID})
+	}
+	if !chatKnown || time.Since(chat.updated) > p.ttl {
+		p.request(profileRequest{chatID: session.TelegramChatID})
+	}
+}
+
+//request schedules the API lookup unless it is already pending
+func (p *ProfileCache) request(r profileRequest) {
+	if p.api == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.pending[r]; ok {
+		return
+	}
+	select {
+	case p.queue <- r:
+		p.pending[r] = struct{}{}
+	default:
+	}
+}
+
+func (p *ProfileCache) refresher() {
+	for r := range p.queue {
+		if r.userID != 0 {
+			p.refreshUser(r.chatID, r.userID)
+		} else {
+			p.refreshChat(r.chatID)
+		}
+		p.mutex.Lock()
+		delete(p.pending, r)
+		p.mutex.Unlock()
+	}
+}
+
+func (p *ProfileCache) refreshUser(chatID int64, userID int64) {
+	member, err := p.api.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: chatID, UserID: int(userID)})
+	if err != nil || member.User == nil {
+		//remember the failure too, so the lookup is not repeated until ttl expires
+		p.mutex.Lock()
+		profile := p.users[userID]
+		profile.updated = time.Now()
+		p.users[userID] = profile
+		p.mutex.Unlock()
+		return
+	}
+	p.observeUser(member.User)
+	p.updateSession(chatID, userID, func(session *Session) bool {
+		if session.FirstName == member.User.FirstName && session.LastName == member.User.LastName {
+			return false
+		}
+		session.FirstName = member.User.FirstName
+		session.LastName = member.User.LastName
+		return true
+	})
+}
+
+func (p *ProfileCache) refreshChat(chatID int64) {
+	chat, err := p.api.GetChat(tgbotapi.ChatConfig{ChatID: chatID})
+	if err != nil {
+		p.mutex.Lock()
+		profile := p.chats[chatID]
+		profile.updated = time.Now()
+		p.chats[chatID] = profile
+		p.mutex.Unlock()
+		return
+	}
+	p.observeChat(&chat)
+	if p.storage == nil {
+		return
+	}
+	sessions, err := p.storage.ChatSessions(chatID)
+	if err != nil {
+		return
+	}
+	for _, s := range sessions {
+		p.updateSession(chatID, s.TelegramUserID, func(session *Session) bool {
+			if session.ChatName == chat.Title {
+				return false
+			}
+			session.ChatName = chat.Title
+			return true
+		})
+	}
+}
+
+//updateSession applies the change to the stored session, retrying on concurrent updates
+func (p *ProfileCache) updateSession(chatID int64, userID int64, change func(*Session) bool) {
+	if p.storage == nil || userID == 0 {
+		return
+	}
+	for i := 0; i < sessionSaveRetries; i++ {
+		session, err := p.storage.FindSession(chatID, userID, "")
+		if err != nil || !change(session) {
+			return
+		}
+		if err = p.storage.SaveSession(session); err != ErrConflict {
+			if err != nil {
+				log.Printf("Cannot update the profile of session %v: %v", session.ID, err)
+			}
+			return
+		}
+	}
+}
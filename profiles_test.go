@@ -0,0 +1,61 @@
+package botmeans
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"testing"
+	"time"
+)
+
+func TestProfileCache(t *testing.T) {
+	storage := NewMemoryStorage()
+	profiles := NewProfileCache(nil, storage, time.Hour)
+
+	profiles.Observe(tgbotapi.Update{Message: &tgbotapi.Message{
+		From: &tgbotapi.User{ID: 1, FirstName: "John", LastName: "Smith"},
+		Chat: &tgbotapi.Chat{ID: -10, Title: "Group"},
+		Entities: &[]tgbotapi.MessageEntity{
+			{Type: "text_mention", User: &tgbotapi.User{ID: 2, FirstName: "Jane"}},
+		},
+	}})
+
+	s, _ := SessionLoader(SessionBase{1, "john", -10, false, false}, storage, 0, profiles)
+	if s.UserName() != "John Smith" || s.ChatTitle() != "Group" {
+		t.Error("Profile should be taken from the update", s.UserName(), s.ChatTitle())
+	}
+	s, _ = SessionLoader(SessionBase{2, "", -10, false, false}, storage, 0, profiles)
+	if s.UserName() != "Jane" {
+		t.Error("Mentioned user profile should be known", s.UserName())
+	}
+	s, _ = SessionLoader(SessionBase{3, "bob", -10, false, false}, storage, 0, profiles)
+	if s.UserName() != "bob" || s.ChatTitle() != "Group" {
+		t.Error("Unknown user should keep the username", s.UserName())
+	}
+	if len(profiles.pending) != 0 {
+		t.Error("Nothing should be requested without API")
+	}
+}
+
+func TestProfileCacheEviction(t *testing.T) {
+	profiles := NewProfileCache(nil, nil, time.Hour)
+	profiles.Observe(tgbotapi.Update{Message: &tgbotapi.Message{
+		From: &tgbotapi.User{ID: 1, FirstName: "John"},
+		Chat: &tgbotapi.Chat{ID: -10, Title: "Group"},
+	}})
+	profiles.mutex.Lock()
+	expired := time.Now().Add(-3 * time.Hour)
+	profiles.users[1] = userProfile{"John", "", "", expired}
+	profiles.chats[-10] = chatProfile{"Group", expired}
+	profiles.evicted = expired
+	profiles.mutex.Unlock()
+
+	profiles.Observe(tgbotapi.Update{Message: &tgbotapi.Message{
+		From: &tgbotapi.User{ID: 2, FirstName: "Jane"},
+		Chat: &tgbotapi.Chat{ID: 2},
+	}})
+	if len(profiles.users) != 1 || len(profiles.chats) != 1 {
+		t.Error("Expired profiles should be evicted", profiles.users, profiles.chats)
+	}
+	if _, ok := profiles.users[2]; !ok {
+		t.Error("Fresh profile should be kept")
+	}
+}
@@ -0,0 +1,325 @@
+package botmeans
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+//DataQuery selects sessions or bot messages by the values stored with SetData.
+//Conditions are typed functions, e.g. func(s *Subscription) bool { return s.Active }.
+//The query works with any storage: records are filtered after loading, so restrict it by chat when possible
+type DataQuery struct {
+	chatID     int64
+	userID     int64
+	predicates []dataPredicate
+	less       *dataPredicate
+	descending bool
+	offset     int
+	limit      int
+	err        error
+}
+
+type dataPredicate struct {
+	t reflect.Type
+	f reflect.Value
+}
+
+//queryRecord is a session or a message with its decoded data
+type queryRecord struct {
+	id     int64
+	item   interface{}
+	values map[reflect.Type]reflect.Value
+}
+
+//NewDataQuery creates the query matching all records
+func NewDataQuery() *DataQuery {
+	return &DataQuery{}
+}
+
+//InChat restricts the query to the chat
+func (q *DataQuery) InChat(chatID int64) *DataQuery {
+	q.chatID = chatID
+	return q
+}
+
+//OfUser restricts the query to sessions of the user. Ignored for bot messages
+func (q *DataQuery) OfUser(userID int64) *DataQuery {
+	q.userID = userID
+	return q
+}
+
+//Has selects records having the value of sample's type in UserData
+func (q *DataQuery) Has(sample interface{}) *DataQuery {
+	if t := dataType(sample); t != nil {
+		q.predicates = append(q.predicates, dataPredicate{t: t})
+	} else {
+		q.err = fmt.Errorf("Cannot query nil type")
+	}
+	return q
+}
+
+//Where selects records having the value of the predicate's argument type, for which the predicate returns true.
+//The predicate should be func(*T) bool
+func (q *DataQuery) Where(predicate interface{}) *DataQuery {
+	if p, err := newDataPredicate(predicate, 1); err == nil {
+		q.predicates = append(q.predicates, p)
+	} else {
+		q.err = err
+	}
+	return q
+}
+
+//OrderBy sorts records by the function func(a, b *T) bool reporting whether a goes before b.
+//Records without the value of type T go last, or first if the order is reversed by Desc.
+//Records are ordered by id by default
+func (q *DataQuery) OrderBy(less interface{}) *DataQuery {
+	if p, err := newDataPredicate(less, 2); err == nil {
+		q.less = &p
+	} else {
+		q.err = err
+	}
+	return q
+}
+
+//Desc reverses the order
+func (q *DataQuery) Desc() *DataQuery {
+	q.descending = true
+	return q
+}
+
+//Offset skips first n records
+func (q *DataQuery) Offset(n int) *DataQuery {
+	q.offset = n
+	return q
+}
+
+//Limit returns at most n records. Zero means no limit
+func (q *DataQuery) Limit(n int) *DataQuery {
+	q.limit = n
+	return q
+}
+
+//newDataPredicate checks that f is func(*T, ...) bool with given number of arguments
+func newDataPredicate(f interface{}, args int) (dataPredicate, error) {
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Func {
+		return dataPredicate{}, fmt.Errorf("Predicate should be a function, got %T", f)
+	}
+	t := v.Type()
+	if t.NumIn() != args || t.NumOut() != 1 || t.Out(0).Kind() != reflect.Bool || t.In(0).Kind() != reflect.Ptr {
+		return dataPredicate{}, fmt.Errorf("Predicate should take %v pointer arguments and return bool, got %v", args, t)
+	}
+	for i := 1; i < args; i++ {
+		if t.In(i) != t.In(0) {
+			return dataPredicate{}, fmt.Errorf("Predicate arguments should have the same type, got %v", t)
+		}
+	}
+	return dataPredicate{t.In(0).Elem(), v}, nil
+}
+
+//value decodes the value of type t from the record's data
+func (r *queryRecord) value(userData string, t reflect.Type) (reflect.Value, bool) {
+	if v, ok := r.values[t]; ok {
+		return v, v.IsValid()
+	}
+	var ret reflect.Value
+	key, legacyKeys := dataTypeKeys(t)
+	container := dataContainer(userData)
+	present := false
+	for _, k := range append([]string{key}, readableLegacyKeys(key, legacyKeys)...) {
+		if _, present = container[k]; present {
+			break
+		}
+	}
+	if present {
+		ret = reflect.New(t)
+		deserialize(userData, ret.Interface())
+	}
+	r.values[t] = ret
+	return ret, present
+}
+
+func (q *DataQuery) match(r *queryRecord, userData string) bool {
+	for _, p := range q.predicates {
+		v, ok := r.value(userData, p.t)
+		if !ok {
+			return false
+		}
+		if p.f.IsValid() && !p.f.Call([]reflect.Value{v})[0].Bool() {
+			return false
+		}
+	}
+	if q.less != nil {
+		r.value(userData, q.less.t)
+	}
+	return true
+}
+
+type queryRecords struct {
+	records []*queryRecord
+	less    *dataPredicate
+}
+
+func (s queryRecords) Len() int      { return len(s.records) }
+func (s queryRecords) Swap(i, j int) { s.records[i], s.records[j] = s.records[j], s.records[i] }
+func (s queryRecords) Less(i, j int) bool {
+	a, b := s.records[i], s.records[j]
+	if s.less != nil {
+		va, vb := a.values[s.less.t], b.values[s.less.t]
+		switch {
+		case va.IsValid() && vb.IsValid():
+			if s.less.f.Call([]reflect.Value{va, vb})[0].Bool() {
+				return true
+			}
+			if s.less.f.Call([]reflect.Value{vb, va})[0].Bool() {
+				return false
+			}
+		case va.IsValid() != vb.IsValid():
+			return va.IsValid()
+		}
+	}
+	return a.id < b.id
+}
+
+//page sorts the records and applies offset and limit
+func (q *DataQuery) page(records []*queryRecord) []*queryRecord {
+	sort.Sort(queryRecords{records, q.less})
+	if q.descending {
+		for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+			records[i], records[j] = records[j], records[i]
+		}
+	}
+	if q.offset >= len(records) {
+		return nil
+	}
+	records = records[q.offset:]
+	if q.limit > 0 && q.limit < len(records) {
+		records = records[:q.limit]
+	}
+	return records
+}
+
+//matchSession checks the session against the query and returns its record
+func (q *DataQuery) matchSession(s *Session) (*queryRecord, bool) {
+	if (q.chatID != 0 && s.TelegramChatID != q.chatID) || (q.userID != 0 && s.TelegramUserID != q.userID) {
+		return nil, false
+	}
+	r := &queryRecord{id: s.ID, item: s, values: make(map[reflect.Type]reflect.Value)}
+	return r, q.match(r, s.UserData)
+}
+
+//eachSession calls f for the sessions with ids greater than afterID matching the query, in the order of ids.
+//Order, offset and limit of the query are not applied. All sessions are read page by page unless the query is restricted by chat or user
+func (q *DataQuery) eachSession(storage SessionStorage, afterID int64, f func(*Session, *queryRecord) error) error {
+	if q.err != nil {
+		return q.err
+	}
+	add := func(s *Session) error {
+		if r, ok := q.matchSession(s); ok && s.ID > afterID {
+			return f(s, r)
+		}
+		return nil
+	}
+	if q.chatID == 0 && q.userID == 0 {
+		return forEachSessionAfter(storage, afterID, add)
+	}
+	var sessions []*Session
+	var err error
+	if q.chatID != 0 {
+		sessions, err = storage.ChatSessions(q.chatID)
+	} else {
+		sessions, err = storage.UserSessions(q.userID)
+	}
+	if err != nil {
+		return err
+	}
+	sort.Sort(sessionsByID(sessions))
+	for _, s := range sessions {
+		if err := add(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//QuerySessions returns the sessions matching the query
+func QuerySessions(storage SessionStorage, q *DataQuery) ([]*Session, error) {
+	records := []*queryRecord{}
+	err := q.eachSession(storage, 0, func(s *Session, r *queryRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := []*Session{}
+	for _, r := range q.page(records) {
+		ret = append(ret, r.item.(*Session))
+	}
+	return ret, nil
+}
+
+//QueryBotMessages returns the bot messages matching the query
+func QueryBotMessages(storage BotMessageStorage, q *DataQuery) ([]*BotMessage, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	records := []*queryRecord{}
+	found := make(map[int64]struct{})
+	add := func(m *BotMessage) error {
+		if _, ok := found[m.ID]; ok || (q.chatID != 0 && m.TelegramChatID != q.chatID) {
+			return nil
+		}
+		found[m.ID] = struct{}{}
+		r := &queryRecord{id: m.ID, item: m, values: make(map[reflect.Type]reflect.Value)}
+		if q.match(r, m.UserData) {
+			records = append(records, r)
+		}
+		return nil
+	}
+	var err error
+	if q.chatID != 0 && len(q.predicates) > 0 {
+		//the storage can preselect messages having the data key
+		key, legacyKeys := dataTypeKeys(q.predicates[0].t)
+		for _, k := range append([]string{key}, readableLegacyKeys(key, legacyKeys)...) {
+			var msgs []*BotMessage
+			if msgs, err = storage.BotMessagesByDataKey(q.chatID, k); err != nil {
+				break
+			}
+			for _, m := range msgs {
+				add(m)
+			}
+		}
+	} else {
+		err = forEachBotMessage(storage, add)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := []*BotMessage{}
+	for _, r := range q.page(records) {
+		ret = append(ret, r.item.(*BotMessage))
+	}
+	return ret, nil
+}
+
+//FindSessions returns the sessions matching the query
+func (ui *MeansBot) FindSessions(q *DataQuery) (ret []ChatSession, err error) {
+	sessions, err := QuerySessions(ui.storage, q)
+	for _, s := range sessions {
+		s.storage = ui.storage
+		ret = append(ret, s)
+	}
+	return
+}
+
+//FindBotMessages returns the bot messages matching the query
+func (ui *MeansBot) FindBotMessages(q *DataQuery) (ret []BotMessageInterface, err error) {
+	msgs, err := QueryBotMessages(ui.storage, q)
+	for _, m := range msgs {
+		m.storage = ui.storage
+		ret = append(ret, m)
+	}
+	return
+}
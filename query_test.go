@@ -0,0 +1,67 @@
+package botmeans
+
+import (
+	"testing"
+)
+
+type Subscription struct {
+	Active bool
+	Level  int
+}
+
+type Poll struct {
+	Open  bool
+	Votes int
+}
+
+func TestDataQuery(t *testing.T) {
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	for name, storage := range storages {
+		for i := 1; i <= 5; i++ {
+			s := &Session{SessionBase: SessionBase{TelegramUserID: int64(i), TelegramChatID: 100}, UserData: "{}", storage: storage}
+			s.SetData(Subscription{Active: i%2 == 1, Level: 10 - i})
+			m := NewBotMessage(100, storage)
+			m.SetData(Poll{Open: i != 3, Votes: i})
+			m.Save()
+		}
+		other := &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramChatID: 200}, UserData: "{}", storage: storage}
+		other.SetData(Subscription{Active: true})
+		storage.SaveSession(&Session{SessionBase: SessionBase{TelegramUserID: 6, TelegramChatID: 100}, UserData: "{}"})
+
+		active := func(s *Subscription) bool { return s.Active }
+		sessions, err := QuerySessions(storage, NewDataQuery().InChat(100).Where(active))
+		if err != nil || len(sessions) != 3 {
+			t.Error(name, "Should be 3 active subscriptions in chat", len(sessions), err)
+		}
+		if sessions, _ := QuerySessions(storage, NewDataQuery().Where(active)); len(sessions) != 4 {
+			t.Error(name, "Should be 4 active subscriptions", len(sessions))
+		}
+		if sessions, _ := QuerySessions(storage, NewDataQuery().OfUser(1).Has(Subscription{})); len(sessions) != 2 {
+			t.Error(name, "Should be 2 sessions of user", len(sessions))
+		}
+
+		byLevel := func(a, b *Subscription) bool { return a.Level < b.Level }
+		sessions, _ = QuerySessions(storage, NewDataQuery().InChat(100).Has(Subscription{}).OrderBy(byLevel).Offset(1).Limit(2))
+		if len(sessions) != 2 || sessions[0].TelegramUserID != 4 || sessions[1].TelegramUserID != 3 {
+			t.Error(name, "Wrong page", sessions)
+		}
+		if sessions, _ := QuerySessions(storage, NewDataQuery().InChat(100).Desc().Limit(1)); len(sessions) != 1 || sessions[0].TelegramUserID != 6 {
+			t.Error(name, "Should be the last session", sessions)
+		}
+
+		open := func(p *Poll) bool { return p.Open }
+		msgs, err := QueryBotMessages(storage, NewDataQuery().InChat(100).Where(open).Where(func(p *Poll) bool { return p.Votes > 1 }))
+		if err != nil || len(msgs) != 3 {
+			t.Error(name, "Should be 3 open polls with votes", len(msgs), err)
+		}
+		if msgs, _ := QueryBotMessages(storage, NewDataQuery().Where(open).Offset(10)); len(msgs) != 0 {
+			t.Error(name, "Should be empty page", len(msgs))
+		}
+
+		if _, err := QuerySessions(storage, NewDataQuery().Where(func(p Poll) bool { return true })); err == nil {
+			t.Error(name, "Predicate with non-pointer argument should be rejected")
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package botmeans
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//RetentionTarget defines the kind of records a RetentionRule prunes
+type RetentionTarget int
+
+const (
+	//RetainBotMessages makes the rule prune bot messages
+	RetainBotMessages RetentionTarget = iota
+	//RetainSessions makes the rule prune sessions
+	RetainSessions
+)
+
+//RetentionRule selects the records to prune. A record is pruned if it matches all conditions set in the rule
+type RetentionRule struct {
+	Name   string
+	Target RetentionTarget
+	//DataType selects the records having the value of sample's type in UserData
+	DataType interface{}
+	//WithoutData selects the records having no values in UserData, e.g. messages sent by SimpleText
+	WithoutData bool
+	//MaxAge selects the records not updated (sessions) or sent (bot messages) for longer than MaxAge
+	MaxAge time.Duration
+	//LeftUsers selects the sessions of users who have left the chat and sessions in chats the bot has been removed from
+	LeftUsers bool
+}
+
+//RetentionStats describes the records pruned by the rule
+type RetentionStats struct {
+	Rule        string
+	Sessions    int
+	BotMessages int
+	Archived    int
+	Errors      int
+}
+
+//Archiver keeps pruned records before they are deleted
+type Archiver interface {
+	ArchiveSession(rule string, session *Session) error
+	ArchiveBotMessage(rule string, msg *BotMessage) error
+}
+
+//RetentionPolicy prunes stale sessions and bot messages according to the rules.
+//The first matching rule prunes the record
+type RetentionPolicy struct {
+	Rules []RetentionRule
+	//Archiver, if set, receives the records before deletion. Records failed to archive are not deleted
+	Archiver Archiver
+	//OnPrune, if set, is called with the stats of each pruning run
+	OnPrune func([]RetentionStats)
+
+	mutex  sync.Mutex
+	totals map[string]RetentionStats
+}
+
+func (rule *RetentionRule) validate() error {
+	if rule.DataType == nil && !rule.WithoutData && rule.MaxAge == 0 && !rule.LeftUsers {
+		return fmt.Errorf("Retention rule %q has no conditions", rule.Name)
+	}
+	if rule.LeftUsers && rule.Target != RetainSessions {
+		return fmt.Errorf("Retention rule %q: LeftUsers is supported for sessions only", rule.Name)
+	}
+	return nil
+}
+
+//matchData checks DataType and WithoutData conditions
+func (rule *RetentionRule) matchData(userData string) bool {
+	container := dataContainer(userData)
+	if rule.WithoutData {
+		for key := range container {
+			if key != dataVersionsKey {
+				return false
+			}
+		}
+	}
+	if rule.DataType != nil {
+		found := false
+		key, legacyKeys := dataTypeKeys(dataType(rule.DataType))
+		for _, k := range append([]string{key}, readableLegacyKeys(key, legacyKeys)...) {
+			if _, found = container[k]; found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *RetentionRule) matchSession(session *Session, now time.Time, inactiveChats map[int64]struct{}) bool {
+	if rule.Target != RetainSessions || !rule.matchData(session.UserData) {
+		return false
+	}
+	if rule.MaxAge != 0 {
+		updated := session.UpdatedAt
+		if session.CreatedAt.After(updated) {
+			updated = session.CreatedAt
+		}
+		if now.Sub(updated) < rule.MaxAge {
+			return false
+		}
+	}
+	if rule.LeftUsers {
+		if _, inactive := inactiveChats[session.TelegramChatID]; !inactive && !session.LeftChat {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *RetentionRule) matchBotMessage(msg *BotMessage, now time.Time) bool {
+	if rule.Target != RetainBotMessages || !rule.matchData(msg.UserData) {
+		return false
+	}
+	return rule.MaxAge == 0 || now.Sub(msg.Timestamp) >= rule.MaxAge
+}
+
+//Prune deletes the records matching the rules and returns the stats per rule
+func (p *RetentionPolicy) Prune(storage Storage) ([]RetentionStats, error) {
+	for i := range p.Rules {
+		if err := p.Rules[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	stats := make([]RetentionStats, len(p.Rules))
+	for i, rule := range p.Rules {
+		stats[i].Rule = rule.Name
+	}
+	inactiveChats := inactiveChatIDs(storage)
+
+	err := forEachSession(storage, func(s *Session) error {
+		for i := range p.Rules {
+			if p.Rules[i].matchSession(s, now, inactiveChats) {
+				p.prune(&stats[i], func() error { return p.Archiver.ArchiveSession(p.Rules[i].Name, s) },
+					func() error { return storage.DeleteSession(s) }, &stats[i].Sessions)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	err = forEachBotMessage(storage, func(m *BotMessage) error {
+		for i := range p.Rules {
+			if p.Rules[i].matchBotMessage(m, now) {
+				p.prune(&stats[i], func() error { return p.Archiver.ArchiveBotMessage(p.Rules[i].Name, m) },
+					func() error { return storage.DeleteBotMessage(m) }, &stats[i].BotMessages)
+				break
+			}
+		}
+		return nil
+	})
+
+	p.mutex.Lock()
+	if p.totals == nil {
+		p.totals = make(map[string]RetentionStats)
+	}
+	for _, s := range stats {
+		t := p.totals[s.Rule]
+		t.Rule = s.Rule
+		t.Sessions += s.Sessions
+		t.BotMessages += s.BotMessages
+		t.Archived += s.Archived
+		t.Errors += s.Errors
+		p.totals[s.Rule] = t
+	}
+	p.mutex.Unlock()
+	if p.OnPrune != nil {
+		p.OnPrune(stats)
+	}
+	return stats, err
+}
+
+//prune archives and deletes one record, updating the stats
+func (p *RetentionPolicy) prune(stats *RetentionStats, archive func() error, del func() error, counter *int) {
+	if p.Archiver != nil {
+		if err := archive(); err != nil {
+			stats.Errors++
+			return
+		}
+		stats.Archived++
+	}
+	if err := del(); err != nil {
+		stats.Errors++
+		return
+	}
+	*counter++
+}
+
+//Totals returns the stats accumulated by all pruning runs, in the order of rules
+func (p *RetentionPolicy) Totals() (ret []RetentionStats) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, rule := range p.Rules {
+		if t, ok := p.totals[rule.Name]; ok {
+			ret = append(ret, t)
+		} else {
+			ret = append(ret, RetentionStats{Rule: rule.Name})
+		}
+	}
+	return
+}
+
+//Run prunes the storage periodically in background. Returns stop chan
+func (p *RetentionPolicy) Run(storage Storage, interval time.Duration) chan interface{} {
+	stopChan := make(chan interface{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := p.Prune(storage); err != nil {
+				log.Println("Retention:", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+	return stopChan
+}
+
+//RunRetention starts pruning the bot's storage by the policy. Returns stop chan
+func (ui *MeansBot) RunRetention(policy *RetentionPolicy, interval time.Duration) chan interface{} {
+	return policy.Run(ui.storage, interval)
+}
+
+//archivedRecord is the line of FileArchiver output
+type archivedRecord struct {
+	Rule       string
+	ArchivedAt time.Time
+	Session    *Session    `json:",omitempty"`
+	BotMessage *BotMessage `json:",omitempty"`
+}
+
+//FileArchiver appends pruned records to the file as JSON lines
+type FileArchiver struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+//NewFileArchiver opens the file for appending
+func NewFileArchiver(path string) (*FileArchiver, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileArchiver{file: f}, nil
+}
+
+func (a *FileArchiver) write(record archivedRecord) error {
+	d, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, err = a.file.Write(append(d, '\n'))
+	return err
+}
+
+//ArchiveSession implements Archiver
+func (a *FileArchiver) ArchiveSession(rule string, session *Session) error {
+	return a.write(archivedRecord{Rule: rule, ArchivedAt: time.Now(), Session: session})
+}
+
+//ArchiveBotMessage implements Archiver
+func (a *FileArchiver) ArchiveBotMessage(rule string, msg *BotMessage) error {
+	return a.write(archivedRecord{Rule: rule, ArchivedAt: time.Now(), BotMessage: msg})
+}
+
+//Close closes the file
+func (a *FileArchiver) Close() error {
+	return a.file.Close()
+}
+
+const (
+	archivedSessionsTable    = "archived_sessions"
+	archivedBotMessagesTable = "archived_bot_messages"
+)
+
+//GormArchiver copies pruned records to archived_sessions and archived_bot_messages tables
+type GormArchiver struct {
+	db *gorm.DB
+}
+
+//NewGormArchiver creates the archive tables if needed
+func NewGormArchiver(db *gorm.DB) (*GormArchiver, error) {
+	for table, model := range map[string]interface{}{archivedSessionsTable: &Session{}, archivedBotMessagesTable: &BotMessage{}} {
+		if err := db.Table(table).AutoMigrate(model).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &GormArchiver{db}, nil
+}
+
+func (a *GormArchiver) archive(table string, record interface{}) error {
+	v := reflect.New(reflect.TypeOf(record).Elem())
+	v.Elem().Set(reflect.ValueOf(record).Elem())
+	return a.db.Table(table).Create(v.Interface()).Error
+}
+
+//ArchiveSession implements Archiver
+func (a *GormArchiver) ArchiveSession(rule string, session *Session) error {
+	return a.archive(archivedSessionsTable, session)
+}
+
+//ArchiveBotMessage implements Archiver
+func (a *GormArchiver) ArchiveBotMessage(rule string, msg *BotMessage) error {
+	return a.archive(archivedBotMessagesTable, msg)
+}
@@ -0,0 +1,105 @@
+package botmeans
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type Draft struct {
+	Text string
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "botmeans_retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, storage := range storages {
+		fresh := &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramChatID: 100}, UserData: "{}", storage: storage}
+		fresh.SetData(Draft{"fresh"})
+		left := &Session{SessionBase: SessionBase{TelegramUserID: 2, TelegramChatID: 100}, UserData: "{}", storage: storage}
+		left.LeftChat = true
+		left.Save()
+		removed := &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramChatID: 200}, UserData: "{}", storage: storage}
+		removed.Save()
+		storage.SaveChat(&Chat{TelegramChatID: 200, Inactive: true, UserData: "{}"})
+
+		draft := NewBotMessage(100, storage)
+		draft.SetData(Draft{"draft"})
+		draft.Save()
+		plain := NewBotMessage(100, storage)
+		plain.Save()
+		old := NewBotMessage(100, storage).(*BotMessage)
+		old.SetData(Poll{})
+		old.Timestamp = time.Now().Add(-48 * time.Hour)
+		old.Save()
+
+		archiver, err := NewFileArchiver(filepath.Join(dir, name+".jsonl"))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		var reported []RetentionStats
+		policy := &RetentionPolicy{
+			Rules: []RetentionRule{
+				{Name: "left", Target: RetainSessions, LeftUsers: true},
+				{Name: "drafts", DataType: Draft{}},
+				{Name: "plain", WithoutData: true},
+				{Name: "old", MaxAge: 24 * time.Hour},
+				{Name: "stale sessions", Target: RetainSessions, MaxAge: time.Hour},
+			},
+			Archiver: archiver,
+			OnPrune:  func(s []RetentionStats) { reported = s },
+		}
+		stats, err := policy.Prune(storage)
+		archiver.Close()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(reported) != len(policy.Rules) {
+			t.Error(name, "OnPrune should be called")
+		}
+		expected := []RetentionStats{{"left", 2, 0, 2, 0}, {"drafts", 0, 1, 1, 0}, {"plain", 0, 1, 1, 0}, {"old", 0, 1, 1, 0}, {"stale sessions", 0, 0, 0, 0}}
+		for i := range expected {
+			if stats[i] != expected[i] {
+				t.Error(name, "Wrong stats", stats[i], expected[i])
+			}
+		}
+		if _, err := storage.SessionByID(fresh.ID); err != nil {
+			t.Error(name, "Fresh session should be kept", err)
+		}
+		if _, err := storage.SessionByID(left.ID); err != ErrNotFound {
+			t.Error(name, "Session of left user should be pruned", err)
+		}
+		if msgs, _ := storage.BotMessagesAfter(0, 10); len(msgs) != 0 {
+			t.Error(name, "Messages should be pruned", len(msgs))
+		}
+
+		f, _ := os.Open(filepath.Join(dir, name+".jsonl"))
+		lines := 0
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			lines++
+		}
+		f.Close()
+		if lines != 5 {
+			t.Error(name, "Pruned records should be archived", lines)
+		}
+
+		policy.Archiver = nil
+		policy.Prune(storage)
+		if totals := policy.Totals(); totals[0].Sessions != 2 || totals[1].BotMessages != 1 {
+			t.Error(name, "Wrong totals", totals)
+		}
+		if _, err := (&RetentionPolicy{Rules: []RetentionRule{{Name: "empty"}}}).Prune(storage); err == nil {
+			t.Error(name, "Rule without conditions should be rejected")
+		}
+	}
+}
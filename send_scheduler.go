@@ -0,0 +1,315 @@
+package botmeans
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrChatBlocked is returned when the message is not sent because the user has blocked the bot or the bot has been removed
+var ErrChatBlocked = fmt.Errorf("Chat is blocked")
+
+//BlockedChatPolicy defines what the scheduler does when Telegram answers 403 for the chat
+type BlockedChatPolicy int
+
+const (
+	//ReportBlockedChats returns the error and keeps sending to the chat
+	ReportBlockedChats BlockedChatPolicy = iota
+	//SkipBlockedChats fails further sends to the chat with ErrChatBlocked without calling the API,
+	//until the chat is unblocked by the incoming message
+	SkipBlockedChats
+	//DeactivateBlockedChats skips the chat and marks it inactive in the storage, as if the bot has been removed
+	DeactivateBlockedChats
+)
+
+//SendLimits configures SendScheduler. Zero fields take the default values
+type SendLimits struct {
+	//Global is the number of messages per second for all chats, 30 by default
+	Global float64
+	//PerChat is the number of messages per second for one private chat, 1 by default
+	PerChat float64
+	//PerGroup is the number of messages per second for one group chat, 20 per minute by default.
+	//A minute worth of messages may be sent at once
+	PerGroup float64
+	//MaxRetries limits the attempts after 429 and 5xx answers, 5 by default
+	MaxRetries int
+	//Backoff is the delay before the first retry after 5xx answer, doubled on each retry. 1 second by default
+	Backoff time.Duration
+	//OnBlocked defines the behaviour on 403 answers
+	OnBlocked BlockedChatPolicy
+}
+
+//DefaultSendLimits follow the limits of Telegram Bot API
+var DefaultSendLimits = SendLimits{
+	Global:     30,
+	PerChat:    1,
+	PerGroup:   20.0 / 60,
+	MaxRetries: 5,
+	Backoff:    time.Second,
+}
+
+func (l SendLimits) withDefaults() SendLimits {
+	if l.Global <= 0 {
+		l.Global = DefaultSendLimits.Global
+	}
+	if l.PerChat <= 0 {
+		l.PerChat = DefaultSendLimits.PerChat
+	}
+	if l.PerGroup <= 0 {
+		l.PerGroup = DefaultSendLimits.PerGroup
+	}
+	if l.MaxRetries <= 0 {
+		l.MaxRetries = DefaultSendLimits.MaxRetries
+	}
+	if l.Backoff <= 0 {
+		l.Backoff = DefaultSendLimits.Backoff
+	}
+	return l
+}
+
+//tokenBucket allows rate messages per second with bursts up to burst messages.
+//Tokens go negative for reserved sends, so the waiting time is known in advance
+type tokenBucket struct {
+	rate      float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+	notBefore time.Time
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+//delay returns the time to wait before the token is available
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+	b.refill(now)
+	d := time.Duration(0)
+	if b.tokens < 1 {
+		d = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait := b.notBefore.Sub(now); wait > d {
+		d = wait
+	}
+	return d
+}
+
+//take consumes the token
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+//idle checks if the bucket is full and can be dropped
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst && !b.notBefore.After(now)
+}
+
+//chatBucketsLimit triggers dropping idle per-chat buckets
+const chatBucketsLimit = 10000
+
+//SendScheduler throttles the messages to Telegram limits with per-chat and global token buckets
+//and retries the sends answered with 429 or 5xx
+type SendScheduler struct {
+	mutex   sync.Mutex
+	send    func(tgbotapi.Chattable) (tgbotapi.Message, error)
+	limits  SendLimits
+	global  *tokenBucket
+	chats   map[int64]*tokenBucket
+	blocked map[int64]struct{}
+	storage ChatStorage
+	now     func() time.Time
+	sleep   func(time.Duration)
+}
+
+//NewSendScheduler creates the scheduler sending by the function, usually BotAPI.Send.
+//The storage is used to deactivate blocked chats and may be nil
+func NewSendScheduler(send func(tgbotapi.Chattable) (tgbotapi.Message, error), limits SendLimits, storage ChatStorage) *SendScheduler {
+	ret := &SendScheduler{
+		send:    send,
+		chats:   make(map[int64]*tokenBucket),
+		blocked: make(map[int64]struct{}),
+		storage: storage,
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}
+	ret.SetLimits(limits)
+	return ret
+}
+
+//SetLimits changes the limits. Buckets are reset
+func (s *SendScheduler) SetLimits(limits SendLimits) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.limits = limits.withDefaults()
+	s.global = newTokenBucket(s.limits.Global, s.limits.Global, s.now())
+	s.chats = make(map[int64]*tokenBucket)
+}
+
+//Unblock lets the scheduler send to the chat again
+func (s *SendScheduler) Unblock(chatID int64) {
+	s.mutex.Lock()
+	delete(s.blocked, chatID)
+	s.mutex.Unlock()
+}
+
+func (s *SendScheduler) chatBucket(chatID int64, now time.Time) *tokenBucket {
+	b, ok := s.chats[chatID]
+	if !ok {
+		if len(s.chats) >= chatBucketsLimit {
+			for id, other := range s.chats {
+				if other.idle(now) {
+					delete(s.chats, id)
+				}
+			}
+		}
+		rate, burst := s.limits.PerChat, s.limits.PerChat
+		if chatID < 0 {
+			//Telegram limits groups per minute
+			rate, burst = s.limits.PerGroup, s.limits.PerGroup*60
+		}
+		b = newTokenBucket(rate, burst, now)
+		s.chats[chatID] = b
+	}
+	return b
+}
+
+//wait blocks until both the chat and the global buckets have tokens, then takes them
+func (s *SendScheduler) wait(chatID int64) error {
+	for {
+		s.mutex.Lock()
+		if _, blocked := s.blocked[chatID]; blocked {
+			s.mutex.Unlock()
+			return ErrChatBlocked
+		}
+		now := s.now()
+		chat := s.chatBucket(chatID, now)
+		d := chat.delay(now)
+		if g := s.global.delay(now); g > d {
+			d = g
+		}
+		if d <= 0 {
+			chat.take()
+			s.global.take()
+			s.mutex.Unlock()
+			return nil
+		}
+		s.mutex.Unlock()
+		s.sleep(d)
+	}
+}
+
+//pause delays all sends to the chat
+func (s *SendScheduler) pause(chatID int64, d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	if b := s.chatBucket(chatID, now); now.Add(d).After(b.notBefore) {
+		b.notBefore = now.Add(d)
+	}
+}
+
+//Send sends the message to the chat within the limits. Blocks until the message is sent or retries are exhausted
+func (s *SendScheduler) Send(chatID int64, c tgbotapi.Chattable) (msg tgbotapi.Message, err error) {
+	s.mutex.Lock()
+	limits := s.limits
+	s.mutex.Unlock()
+	backoff := limits.Backoff
+	for attempt := 0; ; attempt++ {
+		if err = s.wait(chatID); err != nil {
+			return
+		}
+		msg, err = s.send(c)
+		if err == nil {
+			return
+		}
+		retryAfter, retry := retryDelay(err)
+		if isBlockedError(err) {
+			s.blocked403(chatID)
+			return
+		}
+		if !retry || attempt >= limits.MaxRetries {
+			return
+		}
+		if retryAfter > 0 {
+			s.pause(chatID, retryAfter)
+		} else {
+			s.pause(chatID, backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (s *SendScheduler) blocked403(chatID int64) {
+	s.mutex.Lock()
+	policy := s.limits.OnBlocked
+	if policy != ReportBlockedChats {
+		s.blocked[chatID] = struct{}{}
+	}
+	s.mutex.Unlock()
+	if policy == DeactivateBlockedChats && s.storage != nil {
+		chat := ChatLoader(chatID, s.storage)
+		if !chat.IsNew() && chat.IsActive() {
+			chat.Inactive = true
+			chat.BotStatus = "kicked"
+			if err := chat.Save(); err != nil {
+				log.Printf("Cannot deactivate chat %v: %v", chatID, err)
+			}
+		}
+	}
+}
+
+//retryDelay returns the delay requested by 429 answer and true if the send should be retried.
+//Network errors and undecodable answers, like the HTML pages of 5xx errors, are retried as well
+func retryDelay(err error) (time.Duration, bool) {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError, net.Error:
+		return 0, true
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, true
+	}
+	tgErr, ok := err.(tgbotapi.Error)
+	if !ok {
+		return 0, false
+	}
+	if tgErr.RetryAfter > 0 {
+		return time.Duration(tgErr.RetryAfter) * time.Second, true
+	}
+	for _, prefix := range []string{"Too Many Requests", "Internal Server Error", "Bad Gateway", "Service Unavailable", "Gateway Timeout"} {
+		if strings.HasPrefix(tgErr.Message, prefix) {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+//isBlockedError checks if Telegram has answered 403
+func isBlockedError(err error) bool {
+	tgErr, ok := err.(tgbotapi.Error)
+	return ok && strings.HasPrefix(tgErr.Message, "Forbidden")
+}
+
+//SendScheduler returns the scheduler used to send the messages of the bot
+func (ui *MeansBot) SendScheduler() *SendScheduler {
+	return ui.scheduler
+}
@@ -0,0 +1,176 @@
+package botmeans
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+func (c *fakeClock) sleep(d time.Duration) {
+	c.t = c.t.Add(d)
+	c.slept += d
+}
+
+func newTestScheduler(send func(tgbotapi.Chattable) (tgbotapi.Message, error), limits SendLimits, storage ChatStorage) (*SendScheduler, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	s := NewSendScheduler(send, limits, storage)
+	s.now = clock.now
+	s.sleep = clock.sleep
+	s.SetLimits(limits)
+	return s, clock
+}
+
+func TestSendSchedulerLimits(t *testing.T) {
+	sent := 0
+	send := func(tgbotapi.Chattable) (tgbotapi.Message, error) {
+		sent++
+		return tgbotapi.Message{MessageID: sent}, nil
+	}
+	s, clock := newTestScheduler(send, DefaultSendLimits, nil)
+
+	for i := 0; i < 20; i++ {
+		s.Send(-100, tgbotapi.NewMessage(-100, "hi"))
+	}
+	if clock.slept != 0 {
+		t.Error("Group chat should allow bursts of 20 messages", clock.slept)
+	}
+	for i := 0; i < 20; i++ {
+		s.Send(-100, tgbotapi.NewMessage(-100, "hi"))
+	}
+	if clock.slept < 59*time.Second || clock.slept > 61*time.Second {
+		t.Error("Group chat should be limited to 20 messages per minute", clock.slept)
+	}
+
+	clock.slept = 0
+	for i := int64(1); i <= 60; i++ {
+		s.Send(i, tgbotapi.NewMessage(i, "hi"))
+	}
+	if clock.slept < time.Second || clock.slept > 2*time.Second {
+		t.Error("Global limit should be 30 messages per second", clock.slept)
+	}
+	if sent != 100 {
+		t.Error("Wrong sent count", sent)
+	}
+}
+
+func TestSendSchedulerRetries(t *testing.T) {
+	answers := []error{
+		tgbotapi.Error{Message: "Too Many Requests: retry after 7", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 7}},
+		tgbotapi.Error{Message: "Bad Gateway"},
+		tgbotapi.Error{Message: "Bad Gateway"},
+		nil,
+	}
+	calls := 0
+	send := func(tgbotapi.Chattable) (tgbotapi.Message, error) {
+		err := answers[calls]
+		calls++
+		return tgbotapi.Message{}, err
+	}
+	s, clock := newTestScheduler(send, SendLimits{PerChat: 100, Backoff: time.Second}, nil)
+	if _, err := s.Send(1, tgbotapi.NewMessage(1, "hi")); err != nil || calls != 4 {
+		t.Error("Should retry 429 and 5xx", err, calls)
+	}
+	if clock.slept < 10*time.Second {
+		t.Error("Should honour retry_after and back off", clock.slept)
+	}
+
+	calls = 0
+	answers = []error{tgbotapi.Error{Message: "Bad Request: chat not found"}}
+	if _, err := s.Send(1, tgbotapi.NewMessage(1, "hi")); err == nil || calls != 1 {
+		t.Error("Should not retry other errors", err, calls)
+	}
+
+	calls = 0
+	answers = []error{tgbotapi.Error{Message: "Internal Server Error"}, tgbotapi.Error{Message: "Internal Server Error"}, tgbotapi.Error{Message: "Internal Server Error"}}
+	s.SetLimits(SendLimits{MaxRetries: 2})
+	if _, err := s.Send(1, tgbotapi.NewMessage(1, "hi")); err == nil || calls != 3 {
+		t.Error("Should give up after max retries", err, calls)
+	}
+}
+
+//redirectTransport sends the requests to the host instead of Telegram
+type redirectTransport string
+
+func (host redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.URL.Scheme = "http"
+	r.URL.Host = string(host)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestSendSchedulerHTMLErrors(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html><head><title>502 Bad Gateway</title></head><body>nginx</body></html>"))
+			return
+		}
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 5, "date": 0, "chat": {"id": 1, "type": "private"}}}`))
+	}))
+	bot := &tgbotapi.BotAPI{Token: "token", Client: &http.Client{Transport: redirectTransport(srv.Listener.Addr().String())}}
+
+	s, _ := newTestScheduler(botSend(bot), SendLimits{PerChat: 100}, nil)
+	if msg, err := s.Send(1, tgbotapi.NewMessage(1, "hi")); err != nil || msg.MessageID != 5 || calls != 3 {
+		t.Error("HTML answers of 5xx should be retried", err, msg.MessageID, calls)
+	}
+
+	srv.Close()
+	if _, err := bot.Send(tgbotapi.NewMessage(1, "hi")); err == nil {
+		t.Error("Send should fail")
+	} else if _, retry := retryDelay(err); !retry {
+		t.Error("Network errors should be retried", err)
+	}
+}
+
+func TestSendSchedulerBlocked(t *testing.T) {
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	for name, storage := range storages {
+		forbidden := tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"}
+		calls := 0
+		send := func(tgbotapi.Chattable) (tgbotapi.Message, error) {
+			calls++
+			return tgbotapi.Message{}, forbidden
+		}
+		chat := ChatLoader(5, storage)
+		chat.Save()
+
+		s, _ := newTestScheduler(send, SendLimits{}, storage)
+		s.Send(5, tgbotapi.NewMessage(5, "hi"))
+		if _, err := s.Send(5, tgbotapi.NewMessage(5, "hi")); err != forbidden || calls != 2 {
+			t.Error(name, "Should report blocked chats by default", err, calls)
+		}
+
+		calls = 0
+		s.SetLimits(SendLimits{OnBlocked: SkipBlockedChats})
+		s.Send(5, tgbotapi.NewMessage(5, "hi"))
+		if _, err := s.Send(5, tgbotapi.NewMessage(5, "hi")); err != ErrChatBlocked || calls != 1 {
+			t.Error(name, "Should skip blocked chats", err, calls)
+		}
+		if !ChatLoader(5, storage).IsActive() {
+			t.Error(name, "Chat should stay active")
+		}
+		s.Unblock(5)
+
+		calls = 0
+		s.SetLimits(SendLimits{OnBlocked: DeactivateBlockedChats})
+		s.Send(5, tgbotapi.NewMessage(5, "hi"))
+		if _, err := s.Send(5, tgbotapi.NewMessage(5, "hi")); err != ErrChatBlocked || calls != 1 {
+			t.Error(name, "Should skip deactivated chats", err, calls)
+		}
+		if c := ChatLoader(5, storage); c.IsActive() || c.BotStatus != "kicked" {
+			t.Error(name, "Chat should be deactivated", c.Inactive, c.BotStatus)
+		}
+	}
+}
@@ -1,17 +1,18 @@
 package botmeans
 
 import (
+	"encoding/json"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
-	// "log"
+	"log"
 )
 
 //OutMsgFactoryInterface allows users to create or edit messages inside ActionHandlers
 type OutMsgFactoryInterface interface {
-	Create(templateName string, Data interface{}) error
-	CreateWithCustomReplyKeyboard(templateName string, Data interface{}, kdb [][]MessageButton) error
-	Edit(msg BotMessageInterface, templateName string, Data interface{}) error
+	Create(templateName string, Data interface{}, opts ...MessageOption) error
+	CreateWithCustomReplyKeyboard(templateName string, Data interface{}, kdb [][]MessageButton, opts ...MessageOption) error
+	Edit(msg BotMessageInterface, templateName string, Data interface{}, opts ...MessageOption) error
 	Notify(BotMessageInterface, string, bool)
-	SimpleText(text string) error
+	SimpleText(text string, opts ...MessageOption) error
 }
 
 //SenderInterface is the abstraction for the Sender
@@ -41,11 +42,86 @@ type Sender struct {
 	msgFactory  func() BotMessageInterface
 	session     senderSession
 	bot         *tgbotapi.BotAPI
+	scheduler   *SendScheduler
+	outbox      *unitOfWork
 	templateDir string
+	//sourceMsgID is the id of the message the command came from, used by ReplyToSource
+	sourceMsgID int64
 }
 
-//Create creates new telegram message from template
-func (f *Sender) Create(templateName string, Data interface{}) error {
+//send delivers the message through the scheduler, if set
+func (f *Sender) send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if f.scheduler != nil {
+		return sendResult(c)(f.scheduler.Send(f.session.ChatId(), c))
+	}
+	return sendResult(c)(botSend(f.bot)(c))
+}
+
+//sendResult ignores the failure to decode the result of deleteMessage, which is true instead of the message
+func sendResult(c tgbotapi.Chattable) func(tgbotapi.Message, error) (tgbotapi.Message, error) {
+	return func(msg tgbotapi.Message, err error) (tgbotapi.Message, error) {
+		if _, ok := c.(tgbotapi.DeleteMessageConfig); ok {
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				return msg, nil
+			}
+		}
+		return msg, err
+	}
+}
+
+//request sends the request now, or records it to the outbox. The ids of sent messages are added to botMsg
+func (f *Sender) request(c tgbotapi.Chattable, botMsg BotMessageInterface) error {
+	if f.outbox != nil {
+		return f.outbox.enqueue(f.session.ChatId(), c, botMsg, f.send)
+	}
+	if f.bot == nil {
+		return nil
+	}
+	sentMsg, err := f.send(c)
+	if err != nil {
+		return err
+	}
+	if createsMessage(c) {
+		addMessageID(botMsg, int64(sentMsg.MessageID))
+	}
+	return nil
+}
+
+//sendParts sends the parts of the text split to fit the message length limit. The markup is attached to the last part,
+//the first part replies to the message set by options. If a part fails, botMsg is saved with the parts sent before,
+//so they can be edited or deleted later
+func (f *Sender) sendParts(botMsg BotMessageInterface, parts []string, parseMode string, markup interface{}, options MessageOptions) error {
+	replyTo := options.ReplyTo
+	if replyTo == 0 && options.ReplyToSource {
+		replyTo = f.sourceMsgID
+	}
+	for i, part := range parts {
+		toSent := tgbotapi.NewMessage(f.session.ChatId(), part)
+		toSent.ParseMode = parseMode
+		toSent.DisableNotification = options.Silent
+		toSent.DisableWebPagePreview = options.NoPreview
+		if i == 0 {
+			toSent.ReplyToMessageID = int(replyTo)
+		}
+		if i == len(parts)-1 && markup != nil {
+			toSent.ReplyMarkup = markup
+		}
+		var c tgbotapi.Chattable = toSent
+		if options.Protected {
+			c = protectedMessage{toSent}
+		}
+		if err := f.request(c, botMsg); err != nil {
+			if botMsg.Id() != 0 {
+				botMsg.Save()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+//Create creates new telegram message from template. Options override the ones set in the template
+func (f *Sender) Create(templateName string, Data interface{}, opts ...MessageOption) error {
 	botMsg := f.msgFactory()
 	botMsg.SetData(Data)
 
@@ -53,24 +129,19 @@ func (f *Sender) Create(templateName string, Data interface{}) error {
 	if err != nil {
 		return err
 	}
-	toSent := tgbotapi.NewMessage(f.session.ChatId(), params.text)
-	toSent.ParseMode = params.ParseMode
+	var markup interface{}
 	if params.replyKbdMarkup != nil {
-		toSent.ReplyMarkup = *params.replyKbdMarkup
+		markup = *params.replyKbdMarkup
 	}
 	if params.replyKbdHide != nil {
-		toSent.ReplyMarkup = params.replyKbdHide
+		markup = params.replyKbdHide
 	}
 
 	if params.inlineKbdMarkup != nil {
-		toSent.ReplyMarkup = *params.inlineKbdMarkup
+		markup = *params.inlineKbdMarkup
 	}
-	if f.bot != nil {
-		if sentMsg, err := f.bot.Send(toSent); err == nil {
-			botMsg.SetID(int64(sentMsg.MessageID))
-		} else {
-			return err
-		}
+	if err := f.sendParts(botMsg, splitMessageText(params.text, params.ParseMode), params.ParseMode, markup, params.options.apply(opts)); err != nil {
+		return err
 	}
 
 	botMsg.Save()
@@ -78,7 +149,7 @@ func (f *Sender) Create(templateName string, Data interface{}) error {
 }
 
 //Create creates new telegram message from template using custom reply keyboard
-func (f *Sender) CreateWithCustomReplyKeyboard(templateName string, Data interface{}, kbd [][]MessageButton) error {
+func (f *Sender) CreateWithCustomReplyKeyboard(templateName string, Data interface{}, kbd [][]MessageButton, opts ...MessageOption) error {
 	botMsg := f.msgFactory()
 	botMsg.SetData(Data)
 
@@ -87,25 +158,19 @@ func (f *Sender) CreateWithCustomReplyKeyboard(templateName string, Data interfa
 		return err
 	}
 
-	toSent := tgbotapi.NewMessage(f.session.ChatId(), params.text)
-	toSent.ParseMode = params.ParseMode
-
+	var markup interface{}
 	if params.replyKbdMarkup != nil {
 		params.replyKbdMarkup.Keyboard = append(params.replyKbdMarkup.Keyboard, createReplyKeyboard(kbd).Keyboard...)
-		toSent.ReplyMarkup = *params.replyKbdMarkup
+		markup = *params.replyKbdMarkup
 	} else {
-		toSent.ReplyMarkup = createReplyKeyboard(kbd)
+		markup = createReplyKeyboard(kbd)
 	}
 
 	if params.inlineKbdMarkup != nil {
-		toSent.ReplyMarkup = *params.inlineKbdMarkup
+		markup = *params.inlineKbdMarkup
 	}
-	if f.bot != nil {
-		if sentMsg, err := f.bot.Send(toSent); err == nil {
-			botMsg.SetID(int64(sentMsg.MessageID))
-		} else {
-			return nil
-		}
+	if err := f.sendParts(botMsg, splitMessageText(params.text, params.ParseMode), params.ParseMode, markup, params.options.apply(opts)); err != nil {
+		return nil
 	}
 
 	botMsg.Save()
@@ -113,15 +178,10 @@ func (f *Sender) CreateWithCustomReplyKeyboard(templateName string, Data interfa
 }
 
 //SimpleText creates new telegram message with given text
-func (f *Sender) SimpleText(text string) error {
+func (f *Sender) SimpleText(text string, opts ...MessageOption) error {
 	botMsg := f.msgFactory()
-	toSent := tgbotapi.NewMessage(f.session.ChatId(), text)
-	if f.bot != nil {
-		if sentMsg, err := f.bot.Send(toSent); err == nil {
-			botMsg.SetID(int64(sentMsg.MessageID))
-		} else {
-			return err
-		}
+	if err := f.sendParts(botMsg, splitMessageText(text, ""), "", nil, MessageOptions{}.apply(opts)); err != nil {
+		return err
 	}
 	botMsg.Save()
 	return nil
@@ -136,22 +196,49 @@ func (f *Sender) Notify(msg BotMessageInterface, callbackNotification string, sh
 	})
 }
 
-//Edit allows to edit existing messages
-func (f *Sender) Edit(msg BotMessageInterface, templateName string, Data interface{}) error {
+//Edit allows to edit existing messages. If the text is split into more parts than before, new messages are sent
+//for the extra parts; the messages of parts no longer needed are deleted. Of the options only NoPreview changes edited parts.
+//Failures to delete are logged only, the messages are forgotten anyway
+func (f *Sender) Edit(msg BotMessageInterface, templateName string, Data interface{}, opts ...MessageOption) error {
 	msg.SetData(Data)
 	params, err := renderFromTemplate(f.templateDir, templateName, f.session.Locale(), Data)
 	if err != nil {
 		return err
 	}
-	editConfig := tgbotapi.NewEditMessageText(f.session.ChatId(), int(msg.Id()), params.text)
-
-	if params.inlineKbdMarkup != nil {
-		editConfig.ReplyMarkup = params.inlineKbdMarkup
+	options := params.options.apply(opts)
+	options.ReplyTo, options.ReplyToSource = 0, false
+	parts := splitMessageText(params.text, params.ParseMode)
+	ids := messageIDs(msg)
+	kept := len(parts)
+	if kept > len(ids) {
+		kept = len(ids)
 	}
-	editConfig.ParseMode = params.ParseMode
+	for i, id := range ids {
+		if i >= kept {
+			if err := f.request(tgbotapi.DeleteMessageConfig{ChatID: f.session.ChatId(), MessageID: int(id)}, msg); err != nil {
+				log.Printf("Cannot delete message %v of chat %v: %v", id, f.session.ChatId(), err)
+			}
+			continue
+		}
+		editConfig := tgbotapi.NewEditMessageText(f.session.ChatId(), int(id), parts[i])
+
+		if params.inlineKbdMarkup != nil && i == len(parts)-1 {
+			editConfig.ReplyMarkup = params.inlineKbdMarkup
+		}
+		editConfig.ParseMode = params.ParseMode
+		editConfig.DisableWebPagePreview = options.NoPreview
 
-	if f.bot != nil {
-		if _, err := f.bot.Send(editConfig); err != nil {
+		if err := f.request(editConfig, msg); err != nil {
+			return err
+		}
+	}
+	setMessageIDs(msg, ids[:kept])
+	if kept < len(parts) {
+		var markup interface{}
+		if params.inlineKbdMarkup != nil {
+			markup = *params.inlineKbdMarkup
+		}
+		if err := f.sendParts(msg, parts[kept:], params.ParseMode, markup, options); err != nil {
 			return err
 		}
 	}
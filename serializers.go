@@ -2,9 +2,292 @@ package botmeans
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"reflect"
+	"sort"
+	"sync"
 )
 
+//DataKeyCollision describes different types which share the same legacy (type name only) data key
+type DataKeyCollision struct {
+	LegacyKey string
+	Keys      []string
+}
+
+//DataUpgrade converts stored JSON of some schema version to the next version
+type DataUpgrade func(old json.RawMessage) (json.RawMessage, error)
+
+//dataVersionsKey keeps schema versions of the stored values inside UserData
+const dataVersionsKey = "botmeans.Versions"
+
+type dataTypeInfo struct {
+	key        string
+	legacyKeys []string
+	upgrades   []DataUpgrade
+}
+
+//version returns the current schema version of the type
+func (info *dataTypeInfo) version() int {
+	return len(info.upgrades) + 1
+}
+
+var dataTypes = struct {
+	sync.RWMutex
+	byType map[reflect.Type]*dataTypeInfo
+	byKey  map[string]reflect.Type
+	//derived caches the keys of the types not registered, derivedByKey finds the type by such key
+	derived           map[reflect.Type]string
+	derivedByKey      map[string]reflect.Type
+	byLegacyKey       map[string]map[string]struct{}
+	collisionsHandler func(DataKeyCollision)
+}{
+	byType:       make(map[reflect.Type]*dataTypeInfo),
+	byKey:        make(map[string]reflect.Type),
+	derived:      make(map[reflect.Type]string),
+	derivedByKey: make(map[string]reflect.Type),
+	byLegacyKey:  make(map[string]map[string]struct{}),
+}
+
+func init() {
+	RegisterDataType(Action{}, "botmeans.Action", "Action")
+	RegisterDataType(localeData(""), "botmeans.Locale", "Locale")
+	RegisterDataType(sessionRoles{}, "botmeans.Roles")
+	RegisterDataType(chatAdmins{}, "botmeans.ChatAdmins")
+	RegisterDataType(messageParts{}, "botmeans.MessageParts")
+}
+
+//localeData keeps the locale inside UserData
+type localeData string
+
+//RegisterDataType sets the explicit key used to store values of sample's type in UserData.
+//Values stored under legacyKeys are read if there is no value under the key yet.
+//Types not registered are stored under the package path and the type name, so types declared inside functions
+//with the same name in one package share the data. Such types are logged when seen, register them with distinct keys
+func RegisterDataType(sample interface{}, key string, legacyKeys ...string) error {
+	t := dataType(sample)
+	if t == nil {
+		return fmt.Errorf("Cannot register nil type")
+	}
+	dataTypes.Lock()
+	defer dataTypes.Unlock()
+	if other, ok := dataTypes.byKey[key]; ok && other != t {
+		return fmt.Errorf("Data key %v is already used by %v", key, other)
+	}
+	var upgrades []DataUpgrade
+	if old, ok := dataTypes.byType[t]; ok {
+		delete(dataTypes.byKey, old.key)
+		upgrades = old.upgrades
+	}
+	if len(legacyKeys) == 0 {
+		legacyKeys = []string{t.Name()}
+	}
+	dataTypes.byType[t] = &dataTypeInfo{key, legacyKeys, upgrades}
+	dataTypes.byKey[key] = t
+	for _, legacy := range legacyKeys {
+		if dataTypes.byLegacyKey[legacy] == nil {
+			dataTypes.byLegacyKey[legacy] = make(map[string]struct{})
+		}
+		dataTypes.byLegacyKey[legacy][key] = struct{}{}
+	}
+	return nil
+}
+
+//RegisterDataSchema declares the schema version of sample's type. The version is len(upgrades)+1,
+//upgrades[i] converts stored values of version i+1 to version i+2.
+//Values stored without version are treated as version 1.
+//GetData upgrades old values transparently and saves the upgraded version
+func RegisterDataSchema(sample interface{}, upgrades ...DataUpgrade) error {
+	t := dataType(sample)
+	if t == nil {
+		return fmt.Errorf("Cannot register nil type")
+	}
+	key, legacyKeys := dataTypeKeys(t)
+	dataTypes.RLock()
+	_, registered := dataTypes.byType[t]
+	dataTypes.RUnlock()
+	if !registered {
+		if err := RegisterDataType(sample, key, legacyKeys...); err != nil {
+			return err
+		}
+	}
+	dataTypes.Lock()
+	dataTypes.byType[t].upgrades = upgrades
+	dataTypes.Unlock()
+	return nil
+}
+
+func dataTypeVersioning(t reflect.Type) (version int, upgrades []DataUpgrade) {
+	dataTypes.RLock()
+	defer dataTypes.RUnlock()
+	if info, ok := dataTypes.byType[t]; ok {
+		return info.version(), info.upgrades
+	}
+	return 1, nil
+}
+
+func dataVersions(container map[string]*json.RawMessage) map[string]int {
+	versions := make(map[string]int)
+	if v, ok := container[dataVersionsKey]; ok {
+		json.Unmarshal(*v, &versions)
+	}
+	return versions
+}
+
+func setDataVersion(container map[string]*json.RawMessage, key string, version int) {
+	versions := dataVersions(container)
+	if version <= 1 {
+		delete(versions, key)
+	} else {
+		versions[key] = version
+	}
+	if len(versions) == 0 {
+		delete(container, dataVersionsKey)
+		return
+	}
+	d, _ := json.Marshal(versions)
+	rm := json.RawMessage(d)
+	container[dataVersionsKey] = &rm
+}
+
+//upgradeData applies upgrades to the raw value of given version
+func upgradeData(raw json.RawMessage, version int, upgrades []DataUpgrade) (json.RawMessage, error) {
+	if version < 1 {
+		version = 1
+	}
+	for v := version; v <= len(upgrades); v++ {
+		var err error
+		if raw, err = upgrades[v-1](raw); err != nil {
+			return nil, fmt.Errorf("Upgrade from version %v failed: %v", v, err)
+		}
+	}
+	return raw, nil
+}
+
+//DetectDataKeyCollisions enables reporting of different types sharing the same legacy data key.
+//The handler is called each time a new type joins the collision. Pass nil to disable
+func DetectDataKeyCollisions(handler func(DataKeyCollision)) {
+	dataTypes.Lock()
+	dataTypes.collisionsHandler = handler
+	dataTypes.Unlock()
+}
+
+//DataKeyCollisions returns all legacy data key collisions among the types seen so far
+func DataKeyCollisions() (ret []DataKeyCollision) {
+	dataTypes.RLock()
+	defer dataTypes.RUnlock()
+	legacyKeys := []string{}
+	for legacy := range dataTypes.byLegacyKey {
+		legacyKeys = append(legacyKeys, legacy)
+	}
+	sort.Strings(legacyKeys)
+	for _, legacy := range legacyKeys {
+		if c := legacyCollision(legacy); len(c.Keys) > 1 {
+			ret = append(ret, c)
+		}
+	}
+	return
+}
+
+func legacyCollision(legacy string) DataKeyCollision {
+	c := DataKeyCollision{LegacyKey: legacy}
+	for k := range dataTypes.byLegacyKey[legacy] {
+		c.Keys = append(c.Keys, k)
+	}
+	sort.Strings(c.Keys)
+	return c
+}
+
+func dataType(value interface{}) reflect.Type {
+	t := reflect.TypeOf(value)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+//dataTypeKeys returns the key and legacy keys for the type.
+//Fully-qualified key is package path and type name, or the type literal for unnamed types
+func dataTypeKeys(t reflect.Type) (key string, legacyKeys []string) {
+	dataTypes.RLock()
+	info, ok := dataTypes.byType[t]
+	derived, seen := dataTypes.derived[t]
+	dataTypes.RUnlock()
+	if ok {
+		return info.key, info.legacyKeys
+	}
+	legacyKeys = []string{t.Name()}
+	if seen {
+		return derived, legacyKeys
+	}
+
+	key = t.String()
+	if t.Name() != "" && t.PkgPath() != "" {
+		key = t.PkgPath() + "." + t.Name()
+	}
+
+	dataTypes.Lock()
+	if _, seen := dataTypes.derived[t]; seen {
+		dataTypes.Unlock()
+		return
+	}
+	dataTypes.derived[t] = key
+	var shared reflect.Type
+	if other, ok := dataTypes.derivedByKey[key]; ok && other != t {
+		shared = other
+	} else if other, ok := dataTypes.byKey[key]; ok && other != t {
+		shared = other
+	} else {
+		dataTypes.derivedByKey[key] = t
+	}
+	var collision *DataKeyCollision
+	known := dataTypes.byLegacyKey[t.Name()]
+	if known == nil {
+		known = make(map[string]struct{})
+		dataTypes.byLegacyKey[t.Name()] = known
+	}
+	if _, ok := known[key]; !ok {
+		known[key] = struct{}{}
+		if c := legacyCollision(t.Name()); len(c.Keys) > 1 {
+			collision = &c
+		}
+	}
+	handler := dataTypes.collisionsHandler
+	dataTypes.Unlock()
+
+	if shared != nil {
+		log.Printf("Data key %v is shared by different types %v and %v, register them with distinct keys", key, shared, t)
+	}
+	if collision != nil && handler != nil {
+		handler(*collision)
+	}
+	return
+}
+
+//dataKeyFor returns the key used to store the value in UserData
+func dataKeyFor(value interface{}) string {
+	key, _ := dataTypeKeys(dataType(value))
+	return key
+}
+
+//readableLegacyKeys returns legacy keys not claimed by registered types other than the given key
+func readableLegacyKeys(key string, legacyKeys []string) (ret []string) {
+	dataTypes.RLock()
+	defer dataTypes.RUnlock()
+	for _, legacy := range legacyKeys {
+		claimed := false
+		for other := range dataTypes.byLegacyKey[legacy] {
+			if _, registered := dataTypes.byKey[other]; registered && other != key {
+				claimed = true
+			}
+		}
+		if !claimed {
+			ret = append(ret, legacy)
+		}
+	}
+	return
+}
+
 func serialize(current string, value interface{}) string {
 	if current == "" {
 		current = "{}"
@@ -13,33 +296,99 @@ func serialize(current string, value interface{}) string {
 		return current
 	}
 
-	container := make(map[string]*json.RawMessage)
-	json.Unmarshal([]byte(current), &container)
+	container := dataContainer(current)
 	d, _ := json.Marshal(value)
-	rm := json.RawMessage(d)
 
-	t := ""
-	if reflect.TypeOf(value).Kind() != reflect.Ptr {
-		t = reflect.TypeOf(value).Name()
-	} else {
-		t = reflect.Indirect(reflect.ValueOf(value)).Type().Name()
+	t := dataType(value)
+	key, legacyKeys := dataTypeKeys(t)
+	version, _ := dataTypeVersioning(t)
+	rm, err := encryptValue(key, d)
+	if err != nil {
+		log.Printf("Cannot encrypt %v: %v", key, err)
+		return current
 	}
-
-	container[t] = &rm
+	container[key] = &rm
+	setDataVersion(container, key, version)
+	dropLegacyCopies(container, key, legacyKeys)
 
 	d, _ = json.Marshal(container)
 	current = string(d)
 	return current
 }
 
-func deserialize(current string, value interface{}) {
+//deserialize extracts the value from current. If the stored value has been upgraded to the current schema version
+//or re-encrypted with the current key, returns the updated data and true
+func deserialize(current string, value interface{}) (string, bool) {
 	if value == nil || reflect.TypeOf(value).Kind() != reflect.Ptr {
-		return
+		return current, false
 	}
-	t := reflect.Indirect(reflect.ValueOf(value)).Type().Name()
+	t := dataType(value)
+	key, legacyKeys := dataTypeKeys(t)
+	container := dataContainer(current)
+	storedKey := key
+	v, ok := container[key]
+	for _, legacy := range readableLegacyKeys(key, legacyKeys) {
+		if ok {
+			break
+		}
+		v, ok = container[legacy]
+		storedKey = legacy
+	}
+	if !ok || v == nil {
+		return current, false
+	}
+
+	raw, keyID, err := decryptValue(storedKey, *v)
+	if err != nil {
+		log.Printf("Cannot decrypt %v: %v", key, err)
+		return current, false
+	}
+	version, upgrades := dataTypeVersioning(t)
+	storedVersion, versioned := dataVersions(container)[key]
+	if !versioned {
+		storedVersion = 1
+	}
+	upgraded := storedVersion < version
+	if upgraded {
+		if raw, err = upgradeData(raw, storedVersion, upgrades); err != nil {
+			log.Printf("Cannot upgrade %v: %v", key, err)
+			return current, false
+		}
+	}
+	json.Unmarshal(raw, value)
+	if !upgraded && !needsReencryption(key, keyID) {
+		return current, false
+	}
+	stored, err := encryptValue(key, raw)
+	if err != nil {
+		log.Printf("Cannot encrypt %v: %v", key, err)
+		return current, false
+	}
+	container[key] = &stored
+	setDataVersion(container, key, version)
+	dropLegacyCopies(container, key, legacyKeys)
+	d, _ := json.Marshal(container)
+	return string(d), true
+}
+
+//dropLegacyCopies deletes the values under legacy keys once the value is stored under the key,
+//so no stale or unencrypted copy is kept. Legacy keys shared with other types are kept
+func dropLegacyCopies(container map[string]*json.RawMessage, key string, legacyKeys []string) {
+	for _, legacy := range readableLegacyKeys(key, legacyKeys) {
+		if legacy == key {
+			continue
+		}
+		dataTypes.RLock()
+		shared := len(dataTypes.byLegacyKey[legacy]) > 1
+		dataTypes.RUnlock()
+		if !shared {
+			delete(container, legacy)
+		}
+	}
+}
+
+func dataContainer(current string) map[string]*json.RawMessage {
 	container := make(map[string]*json.RawMessage)
 	json.Unmarshal([]byte(current), &container)
-	if v, ok := container[t]; ok {
-		json.Unmarshal(*v, value)
-	}
+	return container
 }
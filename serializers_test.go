@@ -1,7 +1,15 @@
 package botmeans
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSerializers(t *testing.T) {
@@ -39,3 +47,222 @@ func TestSerializers(t *testing.T) {
 	}
 
 }
+
+type Duration int64
+
+//saveDataTypes returns the function restoring the data type registry, so the test can be repeated
+func saveDataTypes() func() {
+	dataTypes.Lock()
+	defer dataTypes.Unlock()
+	byType := make(map[reflect.Type]dataTypeInfo)
+	for t, info := range dataTypes.byType {
+		byType[t] = *info
+	}
+	byKey := make(map[string]reflect.Type)
+	for k, t := range dataTypes.byKey {
+		byKey[k] = t
+	}
+	derived := make(map[reflect.Type]string)
+	for t, k := range dataTypes.derived {
+		derived[t] = k
+	}
+	derivedByKey := make(map[string]reflect.Type)
+	for k, t := range dataTypes.derivedByKey {
+		derivedByKey[k] = t
+	}
+	byLegacyKey := make(map[string]map[string]struct{})
+	for legacy, keys := range dataTypes.byLegacyKey {
+		byLegacyKey[legacy] = make(map[string]struct{})
+		for k := range keys {
+			byLegacyKey[legacy][k] = struct{}{}
+		}
+	}
+	return func() {
+		dataTypes.Lock()
+		defer dataTypes.Unlock()
+		dataTypes.byType = make(map[reflect.Type]*dataTypeInfo)
+		for t, info := range byType {
+			info := info
+			dataTypes.byType[t] = &info
+		}
+		dataTypes.byKey, dataTypes.byLegacyKey = byKey, byLegacyKey
+		dataTypes.derived, dataTypes.derivedByKey = derived, derivedByKey
+	}
+}
+
+func TestSerializersKeys(t *testing.T) {
+	defer saveDataTypes()()
+	collisions := []DataKeyCollision{}
+	DetectDataKeyCollisions(func(c DataKeyCollision) { collisions = append(collisions, c) })
+	defer DetectDataKeyCollisions(nil)
+
+	current := serialize("", time.Duration(5))
+	current = serialize(current, Duration(7))
+	current = serialize(current, struct{ A int }{1})
+	current = serialize(current, struct{ B string }{"b"})
+
+	d1 := time.Duration(0)
+	deserialize(current, &d1)
+	d2 := Duration(0)
+	deserialize(current, &d2)
+	if d1 != 5 || d2 != 7 {
+		t.Error("Types with the same name should not overwrite each other", d1, d2)
+	}
+	a := struct{ A int }{}
+	deserialize(current, &a)
+	b := struct{ B string }{}
+	deserialize(current, &b)
+	if a.A != 1 || b.B != "b" {
+		t.Error("Anonymous types should not overwrite each other", a, b)
+	}
+	reported := map[string]int{}
+	for _, c := range collisions {
+		reported[c.LegacyKey] = len(c.Keys)
+	}
+	if reported["Duration"] != 2 || reported[""] < 2 {
+		t.Errorf("Wrong collisions %+v", collisions)
+	}
+
+	type Locale string
+	session := &Session{UserData: "{}"}
+	session.SetLocale("ru")
+	session.SetData(Locale("en"))
+	if session.Locale() != "ru" {
+		t.Error("User type named Locale should not affect session locale")
+	}
+
+	type FF struct {
+		Ffuu int
+	}
+	legacy := FF{}
+	deserialize(`{"FF":{"ffuu": 1234}}`, &legacy)
+	if legacy.Ffuu != 1234 {
+		t.Error("Legacy key should be readable")
+	}
+
+	if err := RegisterDataType(Duration(0), "test.Duration"); err != nil {
+		t.Error(err)
+	}
+	if err := RegisterDataType(time.Duration(0), "test.Duration"); err == nil {
+		t.Error("Key should not be registered twice")
+	}
+	if dataKeyFor(Duration(0)) != "test.Duration" {
+		t.Error("Registered key should be used")
+	}
+}
+
+func TestMigrateDataKeys(t *testing.T) {
+	type Settings struct {
+		Silent bool
+	}
+	storage := NewMemoryStorage()
+	s := &Session{UserData: `{"Settings":{"Silent":true},"Locale":"ru","Action":{"LastCommand":"cmd1"}}`}
+	storage.SaveSession(s)
+	m := &BotMessage{UserData: `{"Settings":{"Silent":true}}`}
+	storage.SaveBotMessage(m)
+
+	report, err := MigrateDataKeys(storage, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sessions != 1 || report.BotMessages != 1 || len(report.Collisions) != 0 {
+		t.Errorf("Wrong report %+v", report)
+	}
+	loaded, _ := storage.SessionByID(s.ID)
+	container := dataContainer(loaded.UserData)
+	if _, ok := container["Settings"]; ok {
+		t.Error("Legacy key should be removed", loaded.UserData)
+	}
+	settings := Settings{}
+	loaded.GetData(&settings)
+	if !settings.Silent || loaded.Locale() != "ru" {
+		t.Error("Data should be migrated", loaded.UserData)
+	}
+	action := Action{}
+	loaded.GetData(&action)
+	if action.LastCommand != "cmd1" {
+		t.Error("Action should be migrated", loaded.UserData)
+	}
+
+	if report, _ = MigrateDataKeys(storage, Settings{}); report.Sessions != 0 || report.BotMessages != 0 {
+		t.Errorf("Nothing should be migrated twice %+v", report)
+	}
+}
+
+type Profile struct {
+	FirstName string
+	Age       int
+}
+
+func TestDataSchema(t *testing.T) {
+	err := RegisterDataSchema(Profile{},
+		func(old json.RawMessage) (json.RawMessage, error) {
+			v1 := struct{ Name string }{}
+			if err := json.Unmarshal(old, &v1); err != nil {
+				return nil, err
+			}
+			return json.Marshal(struct{ FirstName string }{v1.Name})
+		},
+		func(old json.RawMessage) (json.RawMessage, error) {
+			v2 := map[string]interface{}{}
+			json.Unmarshal(old, &v2)
+			v2["Age"] = 18
+			return json.Marshal(v2)
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := NewMemoryStorage()
+	session := &Session{UserData: `{"Profile":{"Name":"John"}}`, storage: storage}
+	session.Save()
+
+	p := Profile{}
+	session.GetData(&p)
+	if p.FirstName != "John" || p.Age != 18 {
+		t.Errorf("Should be upgraded %+v", p)
+	}
+	stored, _ := storage.SessionByID(session.ID)
+	if dataVersions(dataContainer(stored.UserData))[dataKeyFor(p)] != 3 {
+		t.Error("Upgraded version should be saved", stored.UserData)
+	}
+	p = Profile{}
+	if _, changed := deserialize(stored.UserData, &p); changed || p.FirstName != "John" {
+		t.Error("Should not be upgraded twice", p)
+	}
+
+	msg := &BotMessage{UserData: fmt.Sprintf(`{"Profile":{"FirstName":"Jane"},"botmeans.Versions":{%q:2}}`, dataKeyFor(Profile{})), storage: storage}
+	msg.GetData(&p)
+	if p.FirstName != "Jane" || p.Age != 18 {
+		t.Errorf("Should be upgraded from version 2 %+v", p)
+	}
+
+	current := serialize("", Profile{"Ann", 20})
+	if dataVersions(dataContainer(current))[dataKeyFor(p)] != 3 {
+		t.Error("Current version should be stored", current)
+	}
+}
+
+func TestSerializersSharedKeys(t *testing.T) {
+	defer saveDataTypes()()
+	logged := &bytes.Buffer{}
+	log.SetOutput(logged)
+	defer log.SetOutput(os.Stderr)
+
+	first := func() interface{} {
+		type Local struct{ A int }
+		return Local{1}
+	}()
+	second := func() interface{} {
+		type Local struct{ B int }
+		return Local{2}
+	}()
+	if dataKeyFor(first) != dataKeyFor(second) {
+		t.Fatal("Function-local types with the same name should get the same key")
+	}
+	dataKeyFor(first)
+	if n := strings.Count(logged.String(), "is shared by different types"); n != 1 {
+		t.Error("Shared key should be logged once", logged.String())
+	}
+}
@@ -1,9 +1,9 @@
 package botmeans
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/go-telegram-bot-api/telegram-bot-api"
-	"github.com/jinzhu/gorm"
+	"log"
 	"strings"
 	"time"
 )
@@ -20,14 +20,67 @@ type SessionBase struct {
 //Session represents the user in chat.
 type Session struct {
 	SessionBase
-	ID        int64  `sql:"index;unique"`
-	UserData  string `sql:"type:jsonb"`
-	db        *gorm.DB
-	FirstName string
-	LastName  string
-	ChatName  string
-	CreatedAt time.Time
-	isNew     bool
+	ID              int64  `sql:"index;unique"`
+	UserData        string `sql:"type:jsonb"`
+	Version         int64  `sql:"not null;default:0"`
+	UserNameHistory string `sql:"not null;default:''"`
+	storage         Storage
+	FirstName       string
+	LastName        string
+	ChatName        string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time `sql:"not null;default:'1970-01-01 00:00:00'"`
+	LeftChat        bool      `sql:"not null;default:false"`
+	isNew           bool
+	erased          bool
+	command         string
+	chat            *Chat
+	user            *User
+	//loaded is the profile as stored when the session was loaded or saved, nil if unknown
+	loaded *sessionProfile
+}
+
+//sessionProfile is the part of the session written outside of its handlers:
+//by SessionLoader from the update and by ProfileCache in background
+type sessionProfile struct {
+	TelegramUserName string
+	UserNameHistory  string
+	FirstName        string
+	LastName         string
+	ChatName         string
+	LeftChat         bool
+}
+
+func (session *Session) profile() sessionProfile {
+	return sessionProfile{session.TelegramUserName, session.UserNameHistory, session.FirstName, session.LastName, session.ChatName, session.LeftChat}
+}
+
+//refresh takes UserData and Version from the stored session, as well as the profile fields
+//the session has not changed since it was loaded, so concurrent profile updates are kept
+func (session *Session) refresh(stored *Session) {
+	session.UserData = stored.UserData
+	session.Version = stored.Version
+	current, theirs := session.profile(), stored.profile()
+	loaded := current
+	if session.loaded != nil {
+		loaded = *session.loaded
+	}
+	if current.TelegramUserName == loaded.TelegramUserName {
+		session.TelegramUserName = theirs.TelegramUserName
+	}
+	if current.UserNameHistory == loaded.UserNameHistory {
+		session.UserNameHistory = theirs.UserNameHistory
+	}
+	if current.FirstName == loaded.FirstName && current.LastName == loaded.LastName {
+		session.FirstName, session.LastName = theirs.FirstName, theirs.LastName
+	}
+	if current.ChatName == loaded.ChatName {
+		session.ChatName = theirs.ChatName
+	}
+	if current.LeftChat == loaded.LeftChat {
+		session.LeftChat = theirs.LeftChat
+	}
+	session.loaded = &theirs
 }
 
 //IsNew should return true if the session has not been saved yet
@@ -59,21 +112,57 @@ func (session *Session) UserId() int64 {
 	return session.TelegramUserID
 }
 
-//SetData sets internal UserData field to JSON representation of given value
+//Chat returns the chat-wide state of the session's chat
+func (session *Session) Chat() ChatInterface {
+	if session.chat == nil {
+		if session.storage != nil {
+			session.chat = ChatLoader(session.TelegramChatID, session.storage)
+		} else {
+			session.chat = &Chat{TelegramChatID: session.TelegramChatID, UserData: "{}", isNew: true}
+		}
+	}
+	return session.chat
+}
+
+//User returns the global profile of the session's user
+func (session *Session) User() UserInterface {
+	if session.user == nil {
+		if session.storage != nil {
+			session.user = userStorageLoader(session.TelegramUserID, session.storage)
+		} else {
+			session.user = &User{TelegramUserID: session.TelegramUserID, TelegramUserName: session.TelegramUserName, UserData: "{}", isNew: true}
+		}
+	}
+	return session.user
+}
+
+//sessionSaveRetries limits the attempts of SetData to merge its value with concurrent updates
+const sessionSaveRetries = 5
+
+//SetData sets internal UserData field to JSON representation of given value.
+//The value is merged into the stored session, the save is retried if the session has been changed concurrently
 func (session *Session) SetData(value interface{}) {
-	if session.db != nil {
-		s := Session{}
-		if session.db.Where("id=?", session.ID).First(&s).Error == nil {
-			session.UserData = s.UserData
+	var err error
+	for i := 0; i < sessionSaveRetries; i++ {
+		if session.storage != nil && session.ID != 0 {
+			if s, err := session.storage.SessionByID(session.ID); err == nil {
+				session.refresh(s)
+			}
+		}
+		session.UserData = serialize(session.UserData, value)
+		if err = session.Save(); err != ErrConflict {
+			return
 		}
 	}
-	session.UserData = serialize(session.UserData, value)
-	session.Save()
+	log.Printf("Cannot save the data of session %v: %v", session.ID, err)
 }
 
 //GetData extracts internal UserData field to given value
 func (session *Session) GetData(value interface{}) {
-	deserialize(session.UserData, value)
+	if upgraded, changed := deserialize(session.UserData, value); changed {
+		session.UserData = upgraded
+		session.Save()
+	}
 }
 
 //UserName returns name of the user of this session
@@ -85,6 +174,12 @@ func (session *Session) UserName() string {
 	return s
 }
 
+//PreviousLogins returns the usernames the user had before, the latest last
+func (session *Session) PreviousLogins() (ret []string) {
+	json.Unmarshal([]byte(session.UserNameHistory), &ret)
+	return
+}
+
 //ChatName returns name of the chat of this session
 func (session *Session) ChatTitle() string {
 	return session.ChatName
@@ -94,32 +189,35 @@ func (session *Session) Id() int64 {
 	return session.ID
 }
 
-//Save saves the session to sql table
+//Save saves the session to the storage.
+//Returns ErrConflict if the session has been saved by someone else since it was loaded.
+//Sessions of users whose personal data has been erased are not saved
 func (session *Session) Save() error {
-	if session.db != nil {
-		if err := session.db.Save(session).Error; err == nil {
+	if session.erased {
+		return nil
+	}
+	if session.storage != nil {
+		if err := session.storage.SaveSession(session); err == nil {
 			session.isNew = false
+			p := session.profile()
+			session.loaded = &p
 			return nil
 		} else {
 			return err
 		}
 	}
-	return fmt.Errorf("db not set")
+	return fmt.Errorf("storage not set")
 }
 
 //Locale returns the locale for this user
 func (session *Session) Locale() string {
-	type Locale string
-
-	var lo Locale
+	var lo localeData
 	session.GetData(&lo)
 	return string(lo)
 }
 
 func (session *Session) SetLocale(locale string) {
-	type Locale string
-	var lo Locale = Locale(locale)
-	session.SetData(lo)
+	session.SetData(localeData(locale))
 }
 
 //String represents the session as string
@@ -139,13 +237,9 @@ func (session *Session) String() string {
 	)
 }
 
-//SessionInitDB creates sql table for Session
-func SessionInitDB(db *gorm.DB) {
-	db.AutoMigrate(&Session{})
-}
-
-//SessionLoader creates the session and loads the data if the session exists
-func SessionLoader(base SessionBase, db *gorm.DB, BotID int64, api *tgbotapi.BotAPI) (SessionInterface, error) {
+//SessionLoader creates the session and loads the data if the session exists.
+//User and chat names are taken from profiles, if given
+func SessionLoader(base SessionBase, storage Storage, BotID int64, profiles *ProfileCache) (SessionInterface, error) {
 	TelegramUserID := base.TelegramUserID
 	TelegramUserName := base.TelegramUserName
 	TelegramChatID := base.TelegramChatID
@@ -156,28 +250,26 @@ func SessionLoader(base SessionBase, db *gorm.DB, BotID int64, api *tgbotapi.Bot
 	if TelegramUserID == BotID {
 		return nil, fmt.Errorf("Cannot create the session for myself")
 	}
-	session := &Session{}
-	session.db = db
-	found := !db.Where("((telegram_user_id=? and telegram_user_id!=0) or (telegram_user_name=? and telegram_user_name!='')) and telegram_chat_id=?", TelegramUserID, TelegramUserName, TelegramChatID).
-		First(session).RecordNotFound()
-	err := fmt.Errorf("Unknown")
-	if api != nil && (!found || session.FirstName == "" && session.LastName == "") {
-		if chatMember, err := api.GetChatMember(tgbotapi.ChatConfigWithUser{TelegramChatID, "", int(TelegramUserID)}); err == nil {
-			session.FirstName = chatMember.User.FirstName
-			session.LastName = chatMember.User.LastName
+	session, err := storage.FindSession(TelegramChatID, TelegramUserID, TelegramUserName)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	found := err == nil
+	if found && TelegramUserID != 0 {
+		if session, found, err = reconcileSession(storage, session, TelegramChatID, TelegramUserID, TelegramUserName); err != nil {
+			return nil, err
 		}
 	}
-	if !found {
+	session.storage = storage
+	if found {
+		p := session.profile()
+		session.loaded = &p
+	} else {
 		session.isNew = true
 		session.TelegramChatID = TelegramChatID
 		session.TelegramUserID = TelegramUserID
 		session.TelegramUserName = TelegramUserName
 		session.CreatedAt = time.Now()
-		if api != nil {
-			if chat, err := api.GetChat(tgbotapi.ChatConfig{ChatID: session.TelegramChatID}); err == nil {
-				session.ChatName = chat.Title
-			}
-		}
 		session.UserData = "{}"
 		err = nil
 
@@ -185,8 +277,17 @@ func SessionLoader(base SessionBase, db *gorm.DB, BotID int64, api *tgbotapi.Bot
 	err = nil
 	session.hasLeft = base.hasLeft
 	session.hasCome = base.hasCome
+	if base.hasLeft || base.hasCome {
+		session.LeftChat = base.hasLeft
+	}
 	session.TelegramUserID = base.TelegramUserID
+	if found && session.TelegramUserName != base.TelegramUserName {
+		session.UserNameHistory = appendUserNameHistory(session.UserNameHistory, session.TelegramUserName)
+	}
 	session.TelegramUserName = base.TelegramUserName
+	if profiles != nil {
+		profiles.apply(session)
+	}
 
 	return session, err
 }
@@ -208,4 +309,8 @@ type SessionInterface interface {
 	SetLocale(string)
 	ChatTitle() string
 	IsOneToOne() bool
+	Roles() []string
+	HasRole(string) bool
+	GrantRole(string)
+	RevokeRole(string)
 }
@@ -0,0 +1,251 @@
+package botmeans
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//SessionCache keeps sessions loaded from the storage.
+//Implement it to share the cache between several bot instances
+type SessionCache interface {
+	Get(key string) (Session, bool)
+	Set(key string, session Session)
+	Delete(key string)
+}
+
+//LRUSessionCache is in-process SessionCache which evicts least recently used and expired sessions
+type LRUSessionCache struct {
+	mutex sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	order *list.List
+}
+
+type lruSessionEntry struct {
+	key     string
+	session Session
+	expires time.Time
+}
+
+//NewLRUSessionCache creates the cache keeping up to size entries for ttl
+func NewLRUSessionCache(size int, ttl time.Duration) *LRUSessionCache {
+	return &LRUSessionCache{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+//Get implements SessionCache
+func (c *LRUSessionCache) Get(key string) (Session, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return Session{}, false
+	}
+	entry := e.Value.(*lruSessionEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.items, key)
+		return Session{}, false
+	}
+	c.order.MoveToFront(e)
+	return entry.session, true
+}
+
+//Set implements SessionCache
+func (c *LRUSessionCache) Set(key string, session Session) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.order.Remove(e)
+	}
+	c.items[key] = c.order.PushFront(&lruSessionEntry{key, session, time.Now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*lruSessionEntry).key)
+	}
+}
+
+//Delete implements SessionCache
+func (c *LRUSessionCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.order.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+//Len returns the number of cached entries
+func (c *LRUSessionCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+//cachingStorage serves sessions from the cache
+type cachingStorage struct {
+	Storage
+	cache SessionCache
+}
+
+//CacheSessions puts the cache in front of session lookups of the storage.
+//Cached sessions are invalidated when saved
+func CacheSessions(storage Storage, cache SessionCache) Storage {
+	return &cachingStorage{storage, cache}
+}
+
+func sessionCacheIDKey(id int64) string {
+	return fmt.Sprintf("id:%v", id)
+}
+
+func sessionCacheUserKey(chatID int64, userID int64) string {
+	return fmt.Sprintf("user:%v:%v", chatID, userID)
+}
+
+func sessionCacheNameKey(chatID int64, userName string) string {
+	return fmt.Sprintf("name:%v:%v", chatID, userName)
+}
+
+func sessionCacheKeys(session *Session) (ret []string) {
+	ret = append(ret, sessionCacheIDKey(session.ID))
+	if session.TelegramUserID != 0 {
+		ret = append(ret, sessionCacheUserKey(session.TelegramChatID, session.TelegramUserID))
+	}
+	if session.TelegramUserName != "" {
+		ret = append(ret, sessionCacheNameKey(session.TelegramChatID, session.TelegramUserName))
+	}
+	return
+}
+
+func (s *cachingStorage) get(key string) (*Session, bool) {
+	if v, ok := s.cache.Get(key); ok {
+		return &v, true
+	}
+	return nil, false
+}
+
+func (s *cachingStorage) put(session *Session) {
+	v := *session
+	v.storage = nil
+	v.isNew = false
+	v.chat = nil
+	v.user = nil
+	v.loaded = nil
+	for _, key := range sessionCacheKeys(session) {
+		s.cache.Set(key, v)
+	}
+}
+
+//invalidate removes the session from the cache under its current and cached keys
+func (s *cachingStorage) invalidate(session *Session) {
+	keys := sessionCacheKeys(session)
+	if cached, ok := s.get(sessionCacheIDKey(session.ID)); ok {
+		keys = append(keys, sessionCacheKeys(cached)...)
+	}
+	for _, key := range keys {
+		s.cache.Delete(key)
+	}
+}
+
+//FindSession implements SessionStorage
+func (s *cachingStorage) FindSession(chatID int64, userID int64, userName string) (*Session, error) {
+	if userID != 0 {
+		if v, ok := s.get(sessionCacheUserKey(chatID, userID)); ok {
+			return v, nil
+		}
+	} else if userName != "" {
+		if v, ok := s.get(sessionCacheNameKey(chatID, userName)); ok {
+			return v, nil
+		}
+	}
+	ret, err := s.Storage.FindSession(chatID, userID, userName)
+	if err == nil {
+		s.put(ret)
+	}
+	return ret, err
+}
+
+//SessionByID implements SessionStorage
+func (s *cachingStorage) SessionByID(id int64) (*Session, error) {
+	if v, ok := s.get(sessionCacheIDKey(id)); ok {
+		return v, nil
+	}
+	ret, err := s.Storage.SessionByID(id)
+	if err == nil {
+		s.put(ret)
+	}
+	return ret, err
+}
+
+//SaveSession implements SessionStorage. The cached session is replaced by the saved one
+func (s *cachingStorage) SaveSession(session *Session) error {
+	s.invalidate(session)
+	err := s.Storage.SaveSession(session)
+	if err == nil {
+		s.put(session)
+	}
+	return err
+}
+
+//DeleteSession implements SessionStorage
+func (s *cachingStorage) DeleteSession(session *Session) error {
+	s.invalidate(session)
+	return s.Storage.DeleteSession(session)
+}
+
+//Transaction implements TransactionalStorage. The cache is not used inside the transaction,
+//sessions saved in it are cached after the commit
+func (s *cachingStorage) Transaction(f func(tx Storage) error) error {
+	transactional, ok := s.Storage.(TransactionalStorage)
+	if !ok {
+		return f(s)
+	}
+	changes := []sessionChange{}
+	err := transactional.Transaction(func(tx Storage) error {
+		return f(&sessionChangesRecorder{tx, &changes})
+	})
+	for _, c := range changes {
+		s.invalidate(c.session)
+		if err == nil && !c.deleted {
+			s.put(c.session)
+		}
+	}
+	return err
+}
+
+type sessionChange struct {
+	session *Session
+	deleted bool
+}
+
+//sessionChangesRecorder remembers the sessions saved or deleted in the transaction
+type sessionChangesRecorder struct {
+	Storage
+	changes *[]sessionChange
+}
+
+func (r *sessionChangesRecorder) SaveSession(session *Session) error {
+	*r.changes = append(*r.changes, sessionChange{session, false})
+	return r.Storage.SaveSession(session)
+}
+
+func (r *sessionChangesRecorder) DeleteSession(session *Session) error {
+	*r.changes = append(*r.changes, sessionChange{session, true})
+	return r.Storage.DeleteSession(session)
+}
+
+func (s *cachingStorage) unwrap() Storage {
+	return s.Storage
+}
+
+func (r *sessionChangesRecorder) unwrap() Storage {
+	return r.Storage
+}
@@ -0,0 +1,73 @@
+package botmeans
+
+import (
+	"testing"
+	"time"
+)
+
+type countingStorage struct {
+	Storage
+	finds int
+}
+
+func (s *countingStorage) FindSession(chatID int64, userID int64, userName string) (*Session, error) {
+	s.finds++
+	return s.Storage.FindSession(chatID, userID, userName)
+}
+
+func TestLRUSessionCache(t *testing.T) {
+	cache := NewLRUSessionCache(2, time.Hour)
+	cache.Set("a", Session{ID: 1})
+	cache.Set("b", Session{ID: 2})
+	cache.Get("a")
+	cache.Set("c", Session{ID: 3})
+	if _, ok := cache.Get("b"); ok {
+		t.Error("Least recently used entry should be evicted")
+	}
+	if s, ok := cache.Get("a"); !ok || s.ID != 1 {
+		t.Error("Recently used entry should be kept")
+	}
+	if cache.Len() != 2 {
+		t.Error("Wrong size", cache.Len())
+	}
+
+	cache = NewLRUSessionCache(2, time.Millisecond)
+	cache.Set("a", Session{ID: 1})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.Get("a"); ok {
+		t.Error("Expired entry should not be returned")
+	}
+}
+
+func TestCacheSessions(t *testing.T) {
+	counting := &countingStorage{Storage: NewMemoryStorage()}
+	storage := CacheSessions(counting, NewLRUSessionCache(100, time.Hour))
+
+	session, _ := SessionLoader(SessionBase{1, "one", 10, false, false}, storage, 0, nil)
+	session.SetData(localeData("ru"))
+	counting.finds = 0
+
+	locale := "ru"
+	for i := 0; i < 3; i++ {
+		s, _ := SessionLoader(SessionBase{1, "one", 10, false, false}, storage, 0, nil)
+		if s.IsNew() || s.Locale() != locale {
+			t.Error("Saved session should be loaded from the cache", s.Locale())
+		}
+		locale = "en"
+		s.SetLocale(locale)
+	}
+	if counting.finds != 0 {
+		t.Error("Storage should not be queried", counting.finds)
+	}
+
+	s, _ := storage.FindSession(10, 0, "one")
+	s.storage = storage
+	s.TelegramUserName = "two"
+	s.Save()
+	if _, err := storage.FindSession(10, 0, "one"); err != ErrNotFound {
+		t.Error("Old username should be invalidated", err)
+	}
+	if s, err := storage.FindSession(10, 0, "two"); err != nil || s.Locale() != "en" {
+		t.Error("Session should be found by new username", err)
+	}
+}
@@ -0,0 +1,114 @@
+package botmeans
+
+import (
+	"encoding/json"
+)
+
+//reconcileSession checks the session found for the user against placeholder sessions.
+//Placeholders are created for users mentioned by username only, so they have no user id.
+//If both the user's session and the placeholder exist, the placeholder is merged into the user's session and deleted.
+//Returns found=false if the user has no session in the chat
+func reconcileSession(storage Storage, found *Session, chatID int64, userID int64, userName string) (*Session, bool, error) {
+	var real, placeholder *Session
+	switch found.TelegramUserID {
+	case userID:
+		if userName == "" || found.TelegramUserName == userName {
+			return found, true, nil
+		}
+		//the username has changed, the user could be mentioned by the new one
+		p, err := storage.FindSession(chatID, 0, userName)
+		if err == ErrNotFound || err == nil && p.TelegramUserID != 0 {
+			return found, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		real, placeholder = found, p
+	case 0:
+		r, err := storage.FindSession(chatID, userID, "")
+		if err == ErrNotFound {
+			//the placeholder becomes the user's session, without the roles granted to the mention
+			if data, ok := withoutRoles(found.UserData); ok {
+				found.UserData = data
+				if err := storage.SaveSession(found); err != nil {
+					return nil, false, err
+				}
+			}
+			return found, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		real, placeholder = r, found
+	default:
+		//the username belonged to another user before
+		r, err := storage.FindSession(chatID, userID, "")
+		if err == ErrNotFound {
+			return &Session{}, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return reconcileSession(storage, r, chatID, userID, userName)
+	}
+
+	err := inTransaction(storage, func(tx Storage) error {
+		for i := 0; i < sessionSaveRetries; i++ {
+			real.UserData = mergeMissingData(real.UserData, placeholder.UserData)
+			if err := tx.SaveSession(real); err != ErrConflict {
+				if err != nil {
+					return err
+				}
+				return tx.DeleteSession(placeholder)
+			}
+			stored, err := tx.SessionByID(real.ID)
+			if err != nil {
+				return err
+			}
+			real = stored
+		}
+		return ErrConflict
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return real, true, nil
+}
+
+//withoutRoles removes the roles from the session data. Returns false if there were none
+func withoutRoles(data string) (string, bool) {
+	container := dataContainer(data)
+	key := dataKeyFor(sessionRoles{})
+	if _, ok := container[key]; !ok {
+		return data, false
+	}
+	delete(container, key)
+	setDataVersion(container, key, 0)
+	d, _ := json.Marshal(container)
+	return string(d), true
+}
+
+//mergeMissingData copies the values absent in target from source. Roles are not copied: whoever takes the username
+//the placeholder was created for claims it, so the roles granted to the mention must not pass to them
+func mergeMissingData(target string, source string) string {
+	targetContainer := dataContainer(target)
+	sourceContainer := dataContainer(source)
+	sourceVersions := dataVersions(sourceContainer)
+	rolesKey := dataKeyFor(sessionRoles{})
+	changed := false
+	for key, v := range sourceContainer {
+		if key == dataVersionsKey || key == rolesKey {
+			continue
+		}
+		if _, ok := targetContainer[key]; !ok {
+			targetContainer[key] = v
+			setDataVersion(targetContainer, key, sourceVersions[key])
+			changed = true
+		}
+	}
+	if !changed {
+		return target
+	}
+	d, _ := json.Marshal(targetContainer)
+	return string(d)
+}
@@ -1,62 +1,133 @@
 package botmeans
 
 import (
-	"fmt"
-	"github.com/jinzhu/gorm"
-	_ "github.com/lib/pq"
-	"os"
 	"testing"
 	"time"
 )
 
 func TestSession(t *testing.T) {
-	DB, DBErr := gorm.Open("postgres", fmt.Sprintf("user=%v dbname=%v sslmode=disable password=%v",
-		string(os.Getenv("MEANS_DB_USERNAME")),
-		string(os.Getenv("MEANS_DBNAME")),
-		""))
-	if DBErr != nil {
-		t.Fatal(DBErr)
-	}
-	DB.AutoMigrate(&Session{})
-
-	s := Session{
-		SessionBase: SessionBase{
-			TelegramUserID:   123,
-			TelegramUserName: "john",
-			TelegramChatID:   123,
-		},
-		UserData:  `{"FF":{"ffuu": 1234}}`,
-		CreatedAt: time.Now(),
-		db:        DB,
-	}
+	storages, cleanup := testStorages(t)
+	defer cleanup()
 
-	if err := s.Save(); err != nil {
-		t.Errorf("Saving error %v", err)
-	}
+	for name, storage := range storages {
+		s := Session{
+			SessionBase: SessionBase{
+				TelegramUserID:   123,
+				TelegramUserName: "john",
+				TelegramChatID:   123,
+			},
+			UserData:  `{"FF":{"ffuu": 1234}}`,
+			CreatedAt: time.Now(),
+			storage:   storage,
+		}
 
-	loaded, _ := SessionLoader(SessionBase{123, "john", 123, false, false}, DB, 0, nil)
-	if loaded.IsNew() != false {
-		t.Error("Should be false")
-	}
-	if loaded.HasLeft() == true {
-		t.Error("should be false")
-	}
-	if loaded.ChatId() != 123 {
-		t.Error("should be 123")
-	}
+		if err := s.Save(); err != nil {
+			t.Errorf("%v: Saving error %v", name, err)
+		}
 
-	type FF struct {
-		Ffuu int
-	}
-	tdt := FF{}
-	loaded.GetData(&tdt)
-	if tdt.Ffuu != 1234 {
-		t.Error("Should be 1234")
+		loaded, _ := SessionLoader(SessionBase{123, "john", 123, false, false}, storage, 0, nil)
+		if loaded.IsNew() != false {
+			t.Error(name, "Should be false")
+		}
+		if loaded.HasLeft() == true {
+			t.Error(name, "should be false")
+		}
+		if loaded.ChatId() != 123 {
+			t.Error(name, "should be 123")
+		}
+
+		type FF struct {
+			Ffuu int
+		}
+		tdt := FF{}
+		loaded.GetData(&tdt)
+		if tdt.Ffuu != 1234 {
+			t.Error(name, "Should be 1234")
+		}
+
+		loaded, _ = SessionLoader(SessionBase{124, "john2", 123, false, false}, storage, 0, nil)
+		if loaded.IsNew() != true {
+			t.Error(name, "Should be true")
+		}
+		type A struct{ V int }
+		type B struct{ V int }
+		first, _ := SessionLoader(SessionBase{123, "john", 123, false, false}, storage, 0, nil)
+		second, _ := SessionLoader(SessionBase{123, "john", 123, false, false}, storage, 0, nil)
+		first.SetData(A{1})
+		second.SetData(B{2})
+		if err := first.Save(); err != ErrConflict {
+			t.Error(name, "Stale save should fail", err)
+		}
+		a, b := A{}, B{}
+		merged, _ := SessionLoader(SessionBase{123, "john", 123, false, false}, storage, 0, nil)
+		merged.GetData(&a)
+		merged.GetData(&b)
+		if a.V != 1 || b.V != 2 {
+			t.Error(name, "Concurrent updates should be merged", a, b)
+		}
+
+		left, _ := SessionLoader(SessionBase{123, "john", 123, false, true}, storage, 0, nil)
+		refreshed, _ := storage.SessionByID(left.Id())
+		refreshed.FirstName = "John"
+		refreshed.ChatName = "Chat"
+		if err := storage.SaveSession(refreshed); err != nil {
+			t.Error(name, err)
+		}
+		left.SetData(A{3})
+		if stored, _ := storage.SessionByID(left.Id()); stored.FirstName != "John" || stored.ChatName != "Chat" || !stored.LeftChat {
+			t.Errorf("%v: Concurrent profile changes should be kept along with own ones %+v", name, stored)
+		}
 	}
+}
+
+func TestSessionPlaceholders(t *testing.T) {
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	type Note struct{ Text string }
+	type Score struct{ N int }
+
+	for name, storage := range storages {
+		mentioned, _ := SessionLoader(SessionBase{0, "bob", 50, false, false}, storage, 999, nil)
+		mentioned.SetData(Note{"mentioned"})
+		mentioned.(*Session).GrantRole("moderator")
+		real, _ := SessionLoader(SessionBase{5, "alice", 50, false, false}, storage, 999, nil)
+		real.SetData(Score{10})
+
+		renamed, err := SessionLoader(SessionBase{5, "bob", 50, false, false}, storage, 999, nil)
+		if err != nil || renamed.Id() != real.Id() {
+			t.Error(name, "Should be the user's session", err)
+			continue
+		}
+		note, score := Note{}, Score{}
+		renamed.GetData(&note)
+		renamed.GetData(&score)
+		if note.Text != "mentioned" || score.N != 10 {
+			t.Error(name, "Placeholder data should be merged", note, score)
+		}
+		if renamed.(*Session).HasRole("moderator") {
+			t.Error(name, "Placeholder roles should not be merged")
+		}
+		if l := renamed.(*Session).PreviousLogins(); len(l) != 1 || l[0] != "alice" {
+			t.Error(name, "Previous username should be kept", l)
+		}
+		if l, _ := storage.ChatSessions(50); len(l) != 1 {
+			t.Error(name, "Placeholder should be deleted", len(l))
+		}
 
-	loaded, _ = SessionLoader(SessionBase{124, "john2", 123, false, false}, DB, 0, nil)
-	if loaded.IsNew() != true {
-		t.Error("Should be true")
+		adopted, _ := SessionLoader(SessionBase{0, "carol", 50, false, false}, storage, 999, nil)
+		adopted.SetData(Note{"carol"})
+		adopted.(*Session).GrantRole("moderator")
+		carol, _ := SessionLoader(SessionBase{6, "carol", 50, false, false}, storage, 999, nil)
+		if carol.IsNew() || carol.Id() != adopted.Id() || carol.UserId() != 6 {
+			t.Error(name, "Placeholder should become the user's session")
+		}
+		note = Note{}
+		if carol.GetData(&note); note.Text != "carol" || carol.(*Session).HasRole("moderator") {
+			t.Error(name, "Adopted placeholder should keep the data but not the roles", note)
+		}
+		if stored, _ := storage.SessionByID(carol.Id()); stored == nil || stored.HasRole("moderator") {
+			t.Error(name, "Placeholder roles should be removed from storage")
+		}
 	}
-	DB.DropTable(&Session{})
 }
@@ -0,0 +1,254 @@
+package botmeans
+
+import (
+	"fmt"
+)
+
+//SettingScope defines whom the setting value applies to
+type SettingScope string
+
+const (
+	//UserSetting applies the value to the user's session
+	UserSetting SettingScope = "user"
+	//ChatSetting applies the value to the whole chat
+	ChatSetting SettingScope = "chat"
+)
+
+//ChatSettingsPermission is required to change the settings of group chats. Chat administrators have it
+const ChatSettingsPermission Permission = "botmeans.chat_settings"
+
+//localeNameTemplate keeps the names of the locales, translated to each locale
+const localeNameTemplate = "locale_name"
+
+//defaultLocaleOption is the value of the locale option resetting the locale to the default one.
+//Empty string can't be the value, because empty args are dropped from the button.
+//The empty locale is stored, so it is not replaced by the one detected from the language of the user
+const defaultLocaleOption = "default"
+
+//SettingOption is the value the user can choose
+type SettingOption struct {
+	Value string
+	Title string
+}
+
+//Setting is the option shown in the settings menu
+type Setting struct {
+	Name string
+	//Title is the text of the menu button by locale, the empty locale is the default
+	Title map[string]string
+	//ChatTitle is the text of the menu button changing the setting for the whole group chat.
+	//The chat scope is not offered if ChatTitle is empty
+	ChatTitle map[string]string
+	Options   func(context ActionContextInterface) []SettingOption
+	//Get returns the current value, which is marked in the picker. Optional
+	Get func(context ActionContextInterface, scope SettingScope) string
+	Set func(context ActionContextInterface, scope SettingScope, value string) error
+}
+
+//SettingsView is the data of the settings menu and option picker templates
+type SettingsView struct {
+	Command string
+	//Setting is empty in the menu
+	Setting string
+	Scope   SettingScope
+	Value   string
+	buttons [][]MessageButton
+}
+
+//Keyboard implements KeyboardProvider
+func (v SettingsView) Keyboard() [][]MessageButton {
+	return v.buttons
+}
+
+//SettingsMenu is the command letting users choose the locale and app-defined settings with inline keyboards.
+//In group chats the users having ChatSettingsPermission can change the settings for the whole chat
+type SettingsMenu struct {
+	Command string
+	//MenuTemplate renders the list of settings
+	MenuTemplate string
+	//OptionsTemplate renders the option picker
+	OptionsTemplate string
+	settings        []Setting
+	access          *AccessControl
+}
+
+//NewSettingsMenu creates the menu for the command. Chat administrators are given ChatSettingsPermission
+func NewSettingsMenu(command string, access *AccessControl) *SettingsMenu {
+	if access != nil {
+		access.DefineRole(RoleChatAdmin, ChatSettingsPermission)
+	}
+	return &SettingsMenu{
+		Command:         command,
+		MenuTemplate:    "settings",
+		OptionsTemplate: "settings_options",
+		access:          access,
+	}
+}
+
+//Add adds the setting to the menu
+func (m *SettingsMenu) Add(setting Setting) *SettingsMenu {
+	m.settings = append(m.settings, setting)
+	return m
+}
+
+func (m *SettingsMenu) find(name string) (Setting, bool) {
+	for _, s := range m.settings {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Setting{}, false
+}
+
+func (m *SettingsMenu) button(text string, args ...interface{}) MessageButton {
+	a := fmt.Sprint(args[0])
+	for _, v := range args[1:] {
+		a += fmt.Sprint(" ", v)
+	}
+	return MessageButton{Text: text, Command: "/" + m.Command, Args: a}
+}
+
+//canChangeChat checks if the user may change the settings of the session's chat
+func (m *SettingsMenu) canChangeChat(session ChatSession) bool {
+	if session.IsOneToOne() {
+		return false
+	}
+	return m.access == nil || m.access.Can(session, ChatSettingsPermission)
+}
+
+func (m *SettingsMenu) menu(context ActionContextInterface) SettingsView {
+	session := context.Session()
+	view := SettingsView{Command: m.Command}
+	title := func(s Setting, titles map[string]string) string {
+		if t := titles[resolveTemplateLocale(titles, session.Locale())]; t != "" {
+			return t
+		}
+		return s.Name
+	}
+	for _, s := range m.settings {
+		view.buttons = append(view.buttons, []MessageButton{m.button(title(s, s.Title), s.Name, UserSetting)})
+		if len(s.ChatTitle) > 0 && m.canChangeChat(session) {
+			view.buttons = append(view.buttons, []MessageButton{m.button(title(s, s.ChatTitle), s.Name, ChatSetting)})
+		}
+	}
+	return view
+}
+
+func (m *SettingsMenu) picker(context ActionContextInterface, setting Setting, scope SettingScope) SettingsView {
+	view := SettingsView{Command: m.Command, Setting: setting.Name, Scope: scope}
+	if setting.Get != nil {
+		view.Value = setting.Get(context, scope)
+	}
+	for _, o := range setting.Options(context) {
+		text := o.Title
+		if o.Value == view.Value {
+			text = "✓ " + text
+		}
+		view.buttons = append(view.buttons, []MessageButton{m.button(text, setting.Name, scope, o.Value)})
+	}
+	return view
+}
+
+//show edits the settings message the command has been called from, or sends the new one
+func (m *SettingsMenu) show(context ActionContextInterface, templateName string, view SettingsView) {
+	if src := context.SourceMessage(); src != nil && src.Id() != 0 {
+		var current SettingsView
+		if src.GetData(&current); current.Command == m.Command {
+			context.Output().Edit(src, templateName, view)
+			return
+		}
+	}
+	context.Output().Create(templateName, view)
+}
+
+//Handler returns ActionHandler of the command. The command takes optional args: setting name, scope and value
+func (m *SettingsMenu) Handler() ActionHandler {
+	return func(context ActionContextInterface) {
+		args := context.Args()
+		context.Finish()
+		name, _ := args.At(1).String()
+		setting, ok := m.find(name)
+		if !ok {
+			m.show(context, m.MenuTemplate, m.menu(context))
+			return
+		}
+		scope := UserSetting
+		if s, _ := args.At(2).String(); SettingScope(s) == ChatSetting {
+			scope = ChatSetting
+			if !m.canChangeChat(context.Session()) {
+				if m.access != nil {
+					m.access.deny(context, m.Command, ChatSettingsPermission)
+				}
+				return
+			}
+		}
+		value, ok := args.At(3).String()
+		if !ok {
+			m.show(context, m.OptionsTemplate, m.picker(context, setting, scope))
+			return
+		}
+		valid := false
+		for _, o := range setting.Options(context) {
+			valid = valid || o.Value == value
+		}
+		if !valid {
+			return
+		}
+		if err := setting.Set(context, scope, value); err != nil {
+			context.Error(err)
+		}
+		m.show(context, m.MenuTemplate, m.menu(context))
+	}
+}
+
+//LocaleSetting is the setting choosing among the locales found in the templates and the default one.
+//Option titles are taken from locale_name template translated to each locale, if present.
+//The templates are read once, when the setting is created
+func LocaleSetting(templateDir string) Setting {
+	names, _ := readMsgTemplate(templateDir + "/" + localeNameTemplate + ".json")
+	title := func(locale string, fallback string) string {
+		if names.Template[locale] != "" {
+			return names.Template[locale]
+		}
+		return fallback
+	}
+	options := []SettingOption{{defaultLocaleOption, title("", "Default")}}
+	for _, locale := range TemplateLocales(templateDir) {
+		options = append(options, SettingOption{locale, title(locale, locale)})
+	}
+	return Setting{
+		Name:      "locale",
+		Title:     map[string]string{"": "Language"},
+		ChatTitle: map[string]string{"": "Chat language"},
+		Options: func(context ActionContextInterface) []SettingOption {
+			return options
+		},
+		Get: func(context ActionContextInterface, scope SettingScope) string {
+			locale := context.Session().Locale()
+			if scope == ChatSetting {
+				locale = context.Chat().Locale()
+			}
+			if locale == "" {
+				return defaultLocaleOption
+			}
+			return locale
+		},
+		Set: func(context ActionContextInterface, scope SettingScope, value string) error {
+			if value == defaultLocaleOption {
+				value = ""
+			}
+			if scope == ChatSetting {
+				context.Chat().SetLocale(value)
+			} else {
+				context.Session().SetLocale(value)
+			}
+			return nil
+		},
+	}
+}
+
+//SettingsMenu creates the settings menu with the locale picker for the command.
+//Register its Handler in the handlers provider
+func (ui *MeansBot) SettingsMenu(command string) *SettingsMenu {
+	return NewSettingsMenu(command, ui.AccessControl()).Add(LocaleSetting(ui.tlgConfig.TemplateDir))
+}
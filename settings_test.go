@@ -0,0 +1,135 @@
+package botmeans
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSettingsMenu(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botmeans_settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"settings":         `{"Template": {"": "Settings", "ru": "Настройки"}}`,
+		"settings_options": `{"Template": {"": "Choose", "ru": "Выберите"}}`,
+		"locale_name":      `{"Template": {"en": "English", "ru": "Русский"}}`,
+		"access_denied":    `{"Template": {"": "Denied"}}`,
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name+".json"), []byte(content), 0600)
+	}
+
+	storage := NewMemoryStorage()
+	access := NewAccessControl(storage, nil)
+	access.setChatAdmins(-100, []int64{1})
+	theme := "light"
+	menu := NewSettingsMenu("settings", access).Add(LocaleSetting(dir)).Add(Setting{
+		Name:  "theme",
+		Title: map[string]string{"": "Theme"},
+		Options: func(ActionContextInterface) []SettingOption {
+			return []SettingOption{{"light", "Light"}, {"dark", "Dark"}}
+		},
+		Get: func(ActionContextInterface, SettingScope) string { return theme },
+		Set: func(context ActionContextInterface, scope SettingScope, value string) error {
+			theme = value
+			return nil
+		},
+	})
+
+	sent := []BotMessageInterface{}
+	run := func(session *Session, cmdArgs ...string) *Action {
+		sent = sent[:0]
+		a := []arg{{"/settings"}}
+		for _, s := range cmdArgs {
+			a = append(a, arg{s})
+		}
+		action := &Action{
+			session:          session,
+			handlersProvider: func(string) (ActionHandler, bool) { return menu.Handler(), true },
+			getters: actionExecuterFactoryConfig{
+				cmdGetter:       func() string { return "settings" },
+				argsGetter:      func() Args { return args{a, ""} },
+				sourceMsgGetter: func() (r BotMessageInterface) { return },
+			},
+			senderFactory: func(s senderSession) SenderInterface {
+				return &Sender{session: s, templateDir: dir, msgFactory: func() BotMessageInterface {
+					m := NewBotMessage(s.ChatId(), storage)
+					sent = append(sent, m)
+					return m
+				}}
+			},
+		}
+		action.Execute()
+		return action
+	}
+	newSession := func(userID int64) *Session {
+		s := &Session{SessionBase: SessionBase{TelegramUserID: userID, TelegramChatID: -100}, UserData: "{}", storage: storage}
+		s.Save()
+		return s
+	}
+	admin, user := newSession(1), newSession(2)
+
+	if a := run(admin); len(sent) != 1 || a.LastCommand != "" {
+		t.Fatal("Menu should be sent", len(sent))
+	}
+	if view := menu.menu(&Action{session: admin}); len(view.Keyboard()) != 3 || view.Keyboard()[1][0].Args != "locale chat" {
+		t.Error("Admin should be offered chat locale", view.Keyboard())
+	}
+	if view := menu.menu(&Action{session: user}); len(view.Keyboard()) != 2 || view.Keyboard()[1][0].Args != "theme user" {
+		t.Error("User should not be offered chat locale", view.Keyboard())
+	}
+
+	view := menu.picker(&Action{session: user}, menu.settings[0], UserSetting)
+	if len(view.Keyboard()) != 3 || view.Keyboard()[2][0].Text != "Русский" || view.Keyboard()[2][0].Args != "locale user ru" {
+		t.Error("Wrong locale options", view.Keyboard())
+	}
+	if view.Keyboard()[0][0].Text != "✓ Default" || view.Keyboard()[0][0].Args != "locale user default" {
+		t.Error("Default locale should be offered and marked", view.Keyboard())
+	}
+	ioutil.WriteFile(filepath.Join(dir, "extra.json"), []byte(`{"Template": {"de": "Hallo"}}`), 0600)
+	if view := menu.picker(&Action{session: user}, menu.settings[0], UserSetting); len(view.Keyboard()) != 3 {
+		t.Error("Locale options should be read once", view.Keyboard())
+	}
+	if view := menu.picker(&Action{session: user}, menu.settings[1], UserSetting); view.Keyboard()[0][0].Text != "✓ Light" {
+		t.Error("Current value should be marked", view.Keyboard())
+	}
+
+	run(user, "locale", "user", "ru")
+	if user.Locale() != "ru" || len(sent) != 1 {
+		t.Error("User locale should be set", user.Locale(), len(sent))
+	}
+	run(user, "locale", "chat", "en")
+	if l := ChatLoader(-100, storage).Locale(); l != "" || len(sent) != 1 {
+		t.Error("User should not change chat locale", l)
+	} else {
+		var denied AccessDenied
+		if sent[0].GetData(&denied); denied.Permission != ChatSettingsPermission {
+			t.Error("Access denied should be sent", denied)
+		}
+	}
+	run(admin, "locale", "chat", "en")
+	if l := ChatLoader(-100, storage).Locale(); l != "en" {
+		t.Error("Admin should change chat locale", l)
+	}
+	run(user, "locale", "user", "xx")
+	if user.Locale() != "ru" {
+		t.Error("Unknown value should be ignored", user.Locale())
+	}
+	run(user, "locale", "user", "default")
+	if user.Locale() != "" {
+		t.Error("Default locale should be set", user.Locale())
+	}
+	next, _ := storage.SessionByID(user.ID)
+	next.storage = storage
+	detectLocale(next, "ru", []string{"ru"})
+	if stored, _ := storage.SessionByID(user.ID); next.Locale() != "" || stored.Locale() != "" {
+		t.Error("Chosen default locale should not be replaced by the detected one", next.Locale(), stored.Locale())
+	}
+	run(user, "theme", "user", "dark")
+	if theme != "dark" {
+		t.Error("App setting should be applied", theme)
+	}
+}
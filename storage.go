@@ -0,0 +1,181 @@
+package botmeans
+
+import (
+	"fmt"
+)
+
+//ErrNotFound is returned by storages when the requested record does not exist
+var ErrNotFound = fmt.Errorf("Record not found")
+
+//ErrConflict is returned by SaveSession when the stored session has been changed since it was loaded
+var ErrConflict = fmt.Errorf("Record has been modified concurrently")
+
+//SessionStorage persists sessions
+type SessionStorage interface {
+	//FindSession looks for the session of the user in the chat by user id or, if id is unknown, by username
+	FindSession(chatID int64, userID int64, userName string) (*Session, error)
+	SessionByID(id int64) (*Session, error)
+	ChatSessions(chatID int64) ([]*Session, error)
+	UserSessions(userID int64) ([]*Session, error)
+	//SessionsAfter returns up to limit sessions with ids greater than given one, ordered by id
+	SessionsAfter(id int64, limit int) ([]*Session, error)
+	//SaveSession stores the session if its Version matches the stored one and increments the Version.
+	//Returns ErrConflict otherwise
+	SaveSession(session *Session) error
+	DeleteSession(session *Session) error
+}
+
+//BotMessageStorage persists bot messages
+type BotMessageStorage interface {
+	FindBotMessage(chatID int64, msgID int64) (*BotMessage, error)
+	//BotMessagesByDataKey returns messages of the chat having the value of given data key in UserData
+	BotMessagesByDataKey(chatID int64, key string) ([]*BotMessage, error)
+	//BotMessagesAfter returns up to limit messages with ids greater than given one, ordered by id
+	BotMessagesAfter(id int64, limit int) ([]*BotMessage, error)
+	SaveBotMessage(msg *BotMessage) error
+	DeleteBotMessage(msg *BotMessage) error
+}
+
+//ChatStorage persists chat-wide data
+type ChatStorage interface {
+	FindChat(chatID int64) (*Chat, error)
+	Chats(active bool) ([]*Chat, error)
+	//ChatsAfter returns up to limit chats with ids greater than given one, ordered by id
+	ChatsAfter(id int64, limit int) ([]*Chat, error)
+	SaveChat(chat *Chat) error
+	DeleteChat(chat *Chat) error
+}
+
+//UserStorage persists global user profiles
+type UserStorage interface {
+	FindUser(userID int64) (*User, error)
+	//UsersAfter returns up to limit users with ids greater than given one, ordered by id
+	UsersAfter(id int64, limit int) ([]*User, error)
+	SaveUser(user *User) error
+	//SaveUserProfile stores only the profile fields of the user (see User.copyProfile), keeping UserData.
+	//The user is created if not stored yet
+	SaveUserProfile(user *User) error
+	DeleteUser(user *User) error
+}
+
+//Storage combines all storages used by MeansBot
+type Storage interface {
+	SessionStorage
+	BotMessageStorage
+	ChatStorage
+	UserStorage
+	//Init prepares the storage, e.g. creates tables
+	Init() error
+}
+
+//TransactionalStorage can apply several writes atomically
+type TransactionalStorage interface {
+	Storage
+	//Transaction calls f with the storage bound to a single transaction.
+	//The transaction is committed if f returns nil and rolled back otherwise
+	Transaction(f func(tx Storage) error) error
+}
+
+//inTransaction runs f in the transaction if the storage supports transactions
+func inTransaction(storage Storage, f func(tx Storage) error) error {
+	if transactional, ok := storage.(TransactionalStorage); ok {
+		return transactional.Transaction(f)
+	}
+	return f(storage)
+}
+
+//storageWrapper is implemented by storages adding behaviour to another storage
+type storageWrapper interface {
+	unwrap() Storage
+}
+
+//underlyingStorage returns the storage behind all wrappers
+func underlyingStorage(storage Storage) Storage {
+	for {
+		w, ok := storage.(storageWrapper)
+		if !ok {
+			return storage
+		}
+		storage = w.unwrap()
+	}
+}
+
+//hasDataKey checks if the UserData JSON contains given key
+func hasDataKey(userData string, key string) bool {
+	_, ok := dataContainer(userData)[key]
+	return ok
+}
+
+const storagePageSize = 100
+
+//forEachSession calls f for every stored session
+func forEachSession(storage SessionStorage, f func(*Session) error) error {
+	return forEachSessionAfter(storage, 0, f)
+}
+
+//forEachSessionAfter calls f for the stored sessions with ids greater than given one, in the order of ids
+func forEachSessionAfter(storage SessionStorage, lastID int64, f func(*Session) error) error {
+	for {
+		page, err := storage.SessionsAfter(lastID, storagePageSize)
+		if err != nil || len(page) == 0 {
+			return err
+		}
+		for _, s := range page {
+			if err := f(s); err != nil {
+				return err
+			}
+			lastID = s.ID
+		}
+	}
+}
+
+//forEachBotMessage calls f for every stored bot message
+func forEachBotMessage(storage BotMessageStorage, f func(*BotMessage) error) error {
+	var lastID int64
+	for {
+		page, err := storage.BotMessagesAfter(lastID, storagePageSize)
+		if err != nil || len(page) == 0 {
+			return err
+		}
+		for _, m := range page {
+			if err := f(m); err != nil {
+				return err
+			}
+			lastID = m.ID
+		}
+	}
+}
+
+//forEachChat calls f for every stored chat
+func forEachChat(storage ChatStorage, f func(*Chat) error) error {
+	var lastID int64
+	for {
+		page, err := storage.ChatsAfter(lastID, storagePageSize)
+		if err != nil || len(page) == 0 {
+			return err
+		}
+		for _, c := range page {
+			if err := f(c); err != nil {
+				return err
+			}
+			lastID = c.ID
+		}
+	}
+}
+
+//forEachUser calls f for every stored user
+func forEachUser(storage UserStorage, f func(*User) error) error {
+	var lastID int64
+	for {
+		page, err := storage.UsersAfter(lastID, storagePageSize)
+		if err != nil || len(page) == 0 {
+			return err
+		}
+		for _, u := range page {
+			if err := f(u); err != nil {
+				return err
+			}
+			lastID = u.ID
+		}
+	}
+}
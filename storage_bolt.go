@@ -0,0 +1,708 @@
+package botmeans
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"time"
+)
+
+var (
+	boltSessions           = []byte("sessions")
+	boltSessionsByChat     = []byte("sessions_by_chat")
+	boltSessionsByUser     = []byte("sessions_by_user")
+	boltSessionsByUserName = []byte("sessions_by_username")
+	boltBotMessages        = []byte("bot_messages")
+	boltBotMessagesByMsg   = []byte("bot_messages_by_msg")
+	boltChats              = []byte("chats")
+	boltChatsByID          = []byte("chats_by_id")
+	boltUsers              = []byte("users")
+	boltUsersByID          = []byte("users_by_id")
+	boltDataChanges        = []byte("data_changes")
+	boltSessionChanges     = []byte("data_changes_by_session")
+	boltOutbox             = []byte("outbox")
+	boltBroadcasts         = []byte("broadcasts")
+)
+
+//BoltStorage implements Storage in the embedded key-value file, so no database server is needed.
+//Records are stored as JSON, secondary indexes are kept in separate buckets
+type BoltStorage struct {
+	db *bolt.DB
+	tx *bolt.Tx
+}
+
+//NewBoltStorage opens or creates the storage file
+func NewBoltStorage(path string, mode os.FileMode) (*BoltStorage, error) {
+	db, err := bolt.Open(path, mode, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+//Close releases the storage file
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStorage) update(f func(tx *bolt.Tx) error) error {
+	if s.tx != nil {
+		return f(s.tx)
+	}
+	return s.db.Update(f)
+}
+
+func (s *BoltStorage) view(f func(tx *bolt.Tx) error) error {
+	if s.tx != nil {
+		return f(s.tx)
+	}
+	return s.db.View(f)
+}
+
+//Transaction implements TransactionalStorage
+func (s *BoltStorage) Transaction(f func(tx Storage) error) error {
+	if s.tx != nil {
+		return f(s)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return f(&BoltStorage{db: s.db, tx: tx})
+	})
+}
+
+//Init implements Storage
+func (s *BoltStorage) Init() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			boltSessions, boltSessionsByChat, boltSessionsByUser, boltSessionsByUserName,
+			boltBotMessages, boltBotMessagesByMsg, boltChats, boltChatsByID, boltUsers, boltUsersByID,
+			boltDataChanges, boltSessionChanges, boltOutbox, boltBroadcasts,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if err := boltReindex(tx, boltChats, boltChatsByID); err != nil {
+			return err
+		}
+		return boltReindex(tx, boltUsers, boltUsersByID)
+	})
+}
+
+//boltReindex fills the empty id index of the bucket keyed by telegram ids, e.g. for files created before the index
+func boltReindex(tx *bolt.Tx, bucket []byte, index []byte) error {
+	idx := tx.Bucket(index)
+	if k, _ := idx.Cursor().First(); k != nil {
+		return nil
+	}
+	return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+		record := struct{ ID int64 }{}
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		return idx.Put(boltKey(record.ID), k)
+	})
+}
+
+//boltAfter calls f for up to limit records with ids greater than given one, in the order of the id index
+func boltAfter(tx *bolt.Tx, bucket []byte, index []byte, id int64, limit int, f func(v []byte) error) error {
+	b := tx.Bucket(bucket)
+	c := tx.Bucket(index).Cursor()
+	n := 0
+	for k, key := c.Seek(boltKey(id + 1)); k != nil && n < limit; k, key = c.Next() {
+		if v := b.Get(key); v != nil {
+			if err := f(v); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	return nil
+}
+
+//boltPutIndexed stores the record keyed by telegram id and updates its id index
+func boltPutIndexed(tx *bolt.Tx, bucket []byte, index []byte, key []byte, id int64, value interface{}) error {
+	old := struct{ ID int64 }{}
+	if err := boltGet(tx.Bucket(bucket), key, &old); err == nil && old.ID != id {
+		if err := tx.Bucket(index).Delete(boltKey(old.ID)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(index).Put(boltKey(id), key); err != nil {
+		return err
+	}
+	return boltPut(tx.Bucket(bucket), key, value)
+}
+
+//boltDeleteIndexed deletes the record keyed by telegram id with its id index
+func boltDeleteIndexed(tx *bolt.Tx, bucket []byte, index []byte, key []byte) error {
+	old := struct{ ID int64 }{}
+	if boltGet(tx.Bucket(bucket), key, &old) != nil {
+		return nil
+	}
+	if err := tx.Bucket(index).Delete(boltKey(old.ID)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Delete(key)
+}
+
+func boltKey(parts ...interface{}) []byte {
+	b := &bytes.Buffer{}
+	for _, p := range parts {
+		switch v := p.(type) {
+		case int64:
+			binary.Write(b, binary.BigEndian, uint64(v))
+		case string:
+			b.WriteString(v)
+			b.WriteByte(0)
+		}
+	}
+	return b.Bytes()
+}
+
+func boltKeyID(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[len(key)-8:]))
+}
+
+//boltPrefixIDs returns the ids stored at the end of the index keys with given prefix
+func boltPrefixIDs(b *bolt.Bucket, prefix []byte) (ret []int64) {
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		ret = append(ret, boltKeyID(k))
+	}
+	return sortedIDs(ret)
+}
+
+func boltGet(b *bolt.Bucket, key []byte, value interface{}) error {
+	v := b.Get(key)
+	if v == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(v, value)
+}
+
+func boltPut(b *bolt.Bucket, key []byte, value interface{}) error {
+	d, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, d)
+}
+
+func sessionIndexKeys(session *Session) [][]byte {
+	return [][]byte{
+		boltKey(session.TelegramChatID, session.ID),
+		boltKey(session.TelegramUserID, session.ID),
+		boltKey(session.TelegramChatID, session.TelegramUserName, session.ID),
+	}
+}
+
+var sessionIndexBuckets = [][]byte{boltSessionsByChat, boltSessionsByUser, boltSessionsByUserName}
+
+func (s *BoltStorage) loadSessions(tx *bolt.Tx, ids []int64) (ret []*Session, err error) {
+	b := tx.Bucket(boltSessions)
+	for _, id := range ids {
+		session := &Session{}
+		if err = boltGet(b, boltKey(id), session); err != nil {
+			return
+		}
+		ret = append(ret, session)
+	}
+	return
+}
+
+//FindSession implements SessionStorage
+func (s *BoltStorage) FindSession(chatID int64, userID int64, userName string) (ret *Session, err error) {
+	ret = &Session{}
+	err = s.view(func(tx *bolt.Tx) error {
+		ids := []int64{}
+		if userID != 0 {
+			for _, id := range boltPrefixIDs(tx.Bucket(boltSessionsByUser), boltKey(userID)) {
+				session := &Session{}
+				if boltGet(tx.Bucket(boltSessions), boltKey(id), session) == nil && session.TelegramChatID == chatID {
+					ids = append(ids, id)
+				}
+			}
+		}
+		if userName != "" {
+			ids = append(ids, boltPrefixIDs(tx.Bucket(boltSessionsByUserName), boltKey(chatID, userName))...)
+		}
+		if len(ids) == 0 {
+			return ErrNotFound
+		}
+		return boltGet(tx.Bucket(boltSessions), boltKey(sortedIDs(ids)[0]), ret)
+	})
+	return
+}
+
+//SessionByID implements SessionStorage
+func (s *BoltStorage) SessionByID(id int64) (ret *Session, err error) {
+	ret = &Session{}
+	err = s.view(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltSessions), boltKey(id), ret)
+	})
+	return
+}
+
+//ChatSessions implements SessionStorage
+func (s *BoltStorage) ChatSessions(chatID int64) (ret []*Session, err error) {
+	err = s.view(func(tx *bolt.Tx) (err error) {
+		ret, err = s.loadSessions(tx, boltPrefixIDs(tx.Bucket(boltSessionsByChat), boltKey(chatID)))
+		return
+	})
+	return
+}
+
+//UserSessions implements SessionStorage
+func (s *BoltStorage) UserSessions(userID int64) (ret []*Session, err error) {
+	err = s.view(func(tx *bolt.Tx) (err error) {
+		ret, err = s.loadSessions(tx, boltPrefixIDs(tx.Bucket(boltSessionsByUser), boltKey(userID)))
+		return
+	})
+	return
+}
+
+//SessionsAfter implements SessionStorage
+func (s *BoltStorage) SessionsAfter(id int64, limit int) (ret []*Session, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSessions).Cursor()
+		for k, v := c.Seek(boltKey(id + 1)); k != nil && len(ret) < limit; k, v = c.Next() {
+			session := &Session{}
+			if err := json.Unmarshal(v, session); err != nil {
+				return err
+			}
+			ret = append(ret, session)
+		}
+		return nil
+	})
+	return
+}
+
+//SaveSession implements SessionStorage
+func (s *BoltStorage) SaveSession(session *Session) error {
+	err := s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSessions)
+		if session.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			session.ID = int64(id)
+		} else {
+			old := &Session{}
+			if boltGet(b, boltKey(session.ID), old) == nil {
+				if old.Version != session.Version {
+					return ErrConflict
+				}
+				for i, key := range sessionIndexKeys(old) {
+					if err := tx.Bucket(sessionIndexBuckets[i]).Delete(key); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		for i, key := range sessionIndexKeys(session) {
+			if err := tx.Bucket(sessionIndexBuckets[i]).Put(key, []byte{}); err != nil {
+				return err
+			}
+		}
+		session.UpdatedAt = time.Now()
+		stored := *session
+		stored.Version++
+		return boltPut(b, boltKey(session.ID), &stored)
+	})
+	if err == nil {
+		session.Version++
+	}
+	return err
+}
+
+//DeleteSession implements SessionStorage
+func (s *BoltStorage) DeleteSession(session *Session) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSessions)
+		old := &Session{}
+		if boltGet(b, boltKey(session.ID), old) != nil {
+			return nil
+		}
+		for i, key := range sessionIndexKeys(old) {
+			if err := tx.Bucket(sessionIndexBuckets[i]).Delete(key); err != nil {
+				return err
+			}
+		}
+		return b.Delete(boltKey(session.ID))
+	})
+}
+
+//FindBotMessage implements BotMessageStorage
+func (s *BoltStorage) FindBotMessage(chatID int64, msgID int64) (ret *BotMessage, err error) {
+	ret = &BotMessage{}
+	err = s.view(func(tx *bolt.Tx) error {
+		ids := boltPrefixIDs(tx.Bucket(boltBotMessagesByMsg), boltKey(chatID, msgID))
+		if len(ids) == 0 {
+			return ErrNotFound
+		}
+		return boltGet(tx.Bucket(boltBotMessages), boltKey(ids[0]), ret)
+	})
+	return
+}
+
+//BotMessagesByDataKey implements BotMessageStorage
+func (s *BoltStorage) BotMessagesByDataKey(chatID int64, key string) (ret []*BotMessage, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBotMessages)
+		c := tx.Bucket(boltBotMessagesByMsg).Cursor()
+		prefix := boltKey(chatID)
+		ids := []int64{}
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			ids = append(ids, boltKeyID(k))
+		}
+		for _, id := range sortedIDs(ids) {
+			msg := &BotMessage{}
+			if err := boltGet(b, boltKey(id), msg); err != nil {
+				return err
+			}
+			if hasDataKey(msg.UserData, key) {
+				ret = append(ret, msg)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+//BotMessagesAfter implements BotMessageStorage
+func (s *BoltStorage) BotMessagesAfter(id int64, limit int) (ret []*BotMessage, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBotMessages).Cursor()
+		for k, v := c.Seek(boltKey(id + 1)); k != nil && len(ret) < limit; k, v = c.Next() {
+			msg := &BotMessage{}
+			if err := json.Unmarshal(v, msg); err != nil {
+				return err
+			}
+			ret = append(ret, msg)
+		}
+		return nil
+	})
+	return
+}
+
+//SaveBotMessage implements BotMessageStorage
+func (s *BoltStorage) SaveBotMessage(msg *BotMessage) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBotMessages)
+		index := tx.Bucket(boltBotMessagesByMsg)
+		if msg.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			msg.ID = int64(id)
+		} else {
+			old := &BotMessage{}
+			if boltGet(b, boltKey(msg.ID), old) == nil {
+				if err := index.Delete(boltKey(old.TelegramChatID, old.TelegramMsgID, old.ID)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := index.Put(boltKey(msg.TelegramChatID, msg.TelegramMsgID, msg.ID), []byte{}); err != nil {
+			return err
+		}
+		return boltPut(b, boltKey(msg.ID), msg)
+	})
+}
+
+//DeleteBotMessage implements BotMessageStorage
+func (s *BoltStorage) DeleteBotMessage(msg *BotMessage) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBotMessages)
+		old := &BotMessage{}
+		if boltGet(b, boltKey(msg.ID), old) != nil {
+			return nil
+		}
+		if err := tx.Bucket(boltBotMessagesByMsg).Delete(boltKey(old.TelegramChatID, old.TelegramMsgID, old.ID)); err != nil {
+			return err
+		}
+		return b.Delete(boltKey(msg.ID))
+	})
+}
+
+//FindChat implements ChatStorage
+func (s *BoltStorage) FindChat(chatID int64) (ret *Chat, err error) {
+	ret = &Chat{}
+	err = s.view(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltChats), boltKey(chatID), ret)
+	})
+	return
+}
+
+//Chats implements ChatStorage
+func (s *BoltStorage) Chats(active bool) (ret []*Chat, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltChats).ForEach(func(k, v []byte) error {
+			chat := &Chat{}
+			if err := json.Unmarshal(v, chat); err != nil {
+				return err
+			}
+			if chat.IsActive() == active {
+				ret = append(ret, chat)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+//ChatsAfter implements ChatStorage
+func (s *BoltStorage) ChatsAfter(id int64, limit int) (ret []*Chat, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		return boltAfter(tx, boltChats, boltChatsByID, id, limit, func(v []byte) error {
+			chat := &Chat{}
+			if err := json.Unmarshal(v, chat); err != nil {
+				return err
+			}
+			ret = append(ret, chat)
+			return nil
+		})
+	})
+	return
+}
+
+//SaveChat implements ChatStorage
+func (s *BoltStorage) SaveChat(chat *Chat) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltChats)
+		if chat.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			chat.ID = int64(id)
+		}
+		return boltPutIndexed(tx, boltChats, boltChatsByID, boltKey(chat.TelegramChatID), chat.ID, chat)
+	})
+}
+
+//DeleteChat implements ChatStorage
+func (s *BoltStorage) DeleteChat(chat *Chat) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return boltDeleteIndexed(tx, boltChats, boltChatsByID, boltKey(chat.TelegramChatID))
+	})
+}
+
+//FindUser implements UserStorage
+func (s *BoltStorage) FindUser(userID int64) (ret *User, err error) {
+	ret = &User{}
+	err = s.view(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltUsers), boltKey(userID), ret)
+	})
+	return
+}
+
+//UsersAfter implements UserStorage
+func (s *BoltStorage) UsersAfter(id int64, limit int) (ret []*User, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		return boltAfter(tx, boltUsers, boltUsersByID, id, limit, func(v []byte) error {
+			user := &User{}
+			if err := json.Unmarshal(v, user); err != nil {
+				return err
+			}
+			ret = append(ret, user)
+			return nil
+		})
+	})
+	return
+}
+
+//SaveUser implements UserStorage
+func (s *BoltStorage) SaveUser(user *User) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsers)
+		if user.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			user.ID = int64(id)
+		}
+		return boltPutIndexed(tx, boltUsers, boltUsersByID, boltKey(user.TelegramUserID), user.ID, user)
+	})
+}
+
+//SaveUserProfile implements UserStorage
+func (s *BoltStorage) SaveUserProfile(user *User) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsers)
+		stored := &User{}
+		if err := boltGet(b, boltKey(user.TelegramUserID), stored); err == ErrNotFound {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			*stored = *user
+			stored.ID = int64(id)
+		} else if err != nil {
+			return err
+		} else {
+			stored.copyProfile(user)
+		}
+		stored.UpdatedAt = time.Now()
+		user.ID, user.UserData, user.CreatedAt, user.UpdatedAt = stored.ID, stored.UserData, stored.CreatedAt, stored.UpdatedAt
+		return boltPutIndexed(tx, boltUsers, boltUsersByID, boltKey(user.TelegramUserID), stored.ID, stored)
+	})
+}
+
+//DeleteUser implements UserStorage
+func (s *BoltStorage) DeleteUser(user *User) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return boltDeleteIndexed(tx, boltUsers, boltUsersByID, boltKey(user.TelegramUserID))
+	})
+}
+
+//AppendDataChanges implements AuditStorage
+func (s *BoltStorage) AppendDataChanges(changes []*DataChange) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDataChanges)
+		for _, c := range changes {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			c.ID = int64(id)
+			if err := tx.Bucket(boltSessionChanges).Put(boltKey(c.SessionID, c.ID), []byte{}); err != nil {
+				return err
+			}
+			if err := boltPut(b, boltKey(c.ID), c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//DataChanges implements AuditStorage
+func (s *BoltStorage) DataChanges(sessionID int64) (ret []*DataChange, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		for _, id := range boltPrefixIDs(tx.Bucket(boltSessionChanges), boltKey(sessionID)) {
+			v := &DataChange{}
+			if err := boltGet(tx.Bucket(boltDataChanges), boltKey(id), v); err != nil {
+				return err
+			}
+			ret = append(ret, v)
+		}
+		return nil
+	})
+	return
+}
+
+//PruneDataChanges implements AuditStorage
+func (s *BoltStorage) PruneDataChanges(before time.Time) (n int, err error) {
+	err = s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDataChanges)
+		pruned := []*DataChange{}
+		err := b.ForEach(func(k, v []byte) error {
+			c := &DataChange{}
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			if c.ChangedAt.Before(before) {
+				pruned = append(pruned, c)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, c := range pruned {
+			if err := tx.Bucket(boltSessionChanges).Delete(boltKey(c.SessionID, c.ID)); err != nil {
+				return err
+			}
+			if err := b.Delete(boltKey(c.ID)); err != nil {
+				return err
+			}
+		}
+		n = len(pruned)
+		return nil
+	})
+	return
+}
+
+//DeleteDataChanges implements AuditStorage
+func (s *BoltStorage) DeleteDataChanges(sessionID int64) error {
+	return s.update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(boltSessionChanges)
+		for _, id := range boltPrefixIDs(index, boltKey(sessionID)) {
+			if err := index.Delete(boltKey(sessionID, id)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltDataChanges).Delete(boltKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//OutboxAfter implements OutboxStorage
+func (s *BoltStorage) OutboxAfter(id int64, limit int) (ret []*OutboxEntry, err error) {
+	err = s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltOutbox).Cursor()
+		for k, v := c.Seek(boltKey(id + 1)); k != nil && len(ret) < limit; k, v = c.Next() {
+			entry := &OutboxEntry{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			ret = append(ret, entry)
+		}
+		return nil
+	})
+	return
+}
+
+//SaveOutboxEntry implements OutboxStorage
+func (s *BoltStorage) SaveOutboxEntry(entry *OutboxEntry) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltOutbox)
+		if entry.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			entry.ID = int64(id)
+		}
+		return boltPut(b, boltKey(entry.ID), entry)
+	})
+}
+
+//DeleteOutboxEntry implements OutboxStorage
+func (s *BoltStorage) DeleteOutboxEntry(entry *OutboxEntry) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOutbox).Delete(boltKey(entry.ID))
+	})
+}
+
+//FindBroadcast implements BroadcastStorage
+func (s *BoltStorage) FindBroadcast(name string) (*BroadcastState, error) {
+	ret := &BroadcastState{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltBroadcasts), boltKey(name), ret)
+	})
+	return ret, err
+}
+
+//SaveBroadcast implements BroadcastStorage
+func (s *BoltStorage) SaveBroadcast(state *BroadcastState) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBroadcasts)
+		if state.ID == 0 {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			state.ID = int64(id)
+		}
+		return boltPut(b, boltKey(state.Name), state)
+	})
+}
@@ -0,0 +1,329 @@
+package botmeans
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+//GormStorage implements Storage on top of gorm. Works with PostgreSQL and SQLite dialects
+type GormStorage struct {
+	db   *gorm.DB
+	inTx bool
+}
+
+//NewGormStorage creates the storage for given gorm connection
+func NewGormStorage(db *gorm.DB) *GormStorage {
+	return &GormStorage{db: db}
+}
+
+//DB returns the underlying gorm connection
+func (s *GormStorage) DB() *gorm.DB {
+	return s.db
+}
+
+func (s *GormStorage) isPostgres() bool {
+	return s.db.Dialect().GetName() == "postgres"
+}
+
+//gormModels are the records stored in tables
+var gormModels = []interface{}{&Session{}, &BotMessage{}, &Chat{}, &User{}, &DataChange{}, &OutboxEntry{}, &BroadcastState{}}
+
+//Init implements Storage
+func (s *GormStorage) Init() error {
+	return s.db.AutoMigrate(gormModels...).Error
+}
+
+//Transaction implements TransactionalStorage. Nested transactions join the outer one
+func (s *GormStorage) Transaction(f func(tx Storage) error) error {
+	if s.inTx {
+		return f(s)
+	}
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := f(&GormStorage{db: tx, inTx: true}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func gormFindError(db *gorm.DB) error {
+	if db.RecordNotFound() {
+		return ErrNotFound
+	}
+	return db.Error
+}
+
+//FindSession implements SessionStorage
+func (s *GormStorage) FindSession(chatID int64, userID int64, userName string) (*Session, error) {
+	ret := &Session{}
+	err := gormFindError(s.db.Where("((telegram_user_id=? and telegram_user_id!=0) or (telegram_user_name=? and telegram_user_name!='')) and telegram_chat_id=?", userID, userName, chatID).
+		First(ret))
+	return ret, err
+}
+
+//SessionByID implements SessionStorage
+func (s *GormStorage) SessionByID(id int64) (*Session, error) {
+	ret := &Session{}
+	err := gormFindError(s.db.Where("id=?", id).First(ret))
+	return ret, err
+}
+
+//ChatSessions implements SessionStorage
+func (s *GormStorage) ChatSessions(chatID int64) (ret []*Session, err error) {
+	err = s.db.Where("telegram_chat_id=?", chatID).Find(&ret).Error
+	return
+}
+
+//UserSessions implements SessionStorage
+func (s *GormStorage) UserSessions(userID int64) (ret []*Session, err error) {
+	err = s.db.Where("telegram_user_id=?", userID).Find(&ret).Error
+	return
+}
+
+//SessionsAfter implements SessionStorage
+func (s *GormStorage) SessionsAfter(id int64, limit int) (ret []*Session, err error) {
+	err = s.db.Where("id>?", id).Order("id").Limit(limit).Find(&ret).Error
+	return
+}
+
+//SaveSession implements SessionStorage
+func (s *GormStorage) SaveSession(session *Session) error {
+	session.UpdatedAt = time.Now()
+	if session.ID != 0 {
+		columns := gormColumns(s.db, session)
+		columns["version"] = session.Version + 1
+		db := s.db.Model(&Session{}).Where("id=? and version=?", session.ID, session.Version).UpdateColumns(columns)
+		if db.Error != nil {
+			return db.Error
+		}
+		if db.RowsAffected != 0 {
+			session.Version++
+			return nil
+		}
+		if _, err := s.SessionByID(session.ID); err != ErrNotFound {
+			if err == nil {
+				err = ErrConflict
+			}
+			return err
+		}
+	}
+	session.Version++
+	if err := s.db.Create(session).Error; err != nil {
+		session.Version--
+		return err
+	}
+	return nil
+}
+
+//DeleteSession implements SessionStorage
+func (s *GormStorage) DeleteSession(session *Session) error {
+	return s.db.Delete(&Session{}, "id=?", session.ID).Error
+}
+
+//FindBotMessage implements BotMessageStorage
+func (s *GormStorage) FindBotMessage(chatID int64, msgID int64) (*BotMessage, error) {
+	ret := &BotMessage{}
+	err := gormFindError(s.db.Where("telegram_chat_id=? and telegram_msg_id=?", chatID, msgID).First(ret))
+	return ret, err
+}
+
+//BotMessagesByDataKey implements BotMessageStorage
+func (s *GormStorage) BotMessagesByDataKey(chatID int64, key string) (ret []*BotMessage, err error) {
+	query := s.db.Where("telegram_chat_id=?", chatID)
+	if s.isPostgres() {
+		err = query.Where("jsonb_exists(user_data, ?::text)", key).Find(&ret).Error
+		return
+	}
+	msgs := []*BotMessage{}
+	if err = query.Where("user_data like ?", fmt.Sprintf("%%%q%%", key)).Find(&msgs).Error; err != nil {
+		return
+	}
+	for _, m := range msgs {
+		if hasDataKey(m.UserData, key) {
+			ret = append(ret, m)
+		}
+	}
+	return
+}
+
+//BotMessagesAfter implements BotMessageStorage
+func (s *GormStorage) BotMessagesAfter(id int64, limit int) (ret []*BotMessage, err error) {
+	err = s.db.Where("id>?", id).Order("id").Limit(limit).Find(&ret).Error
+	return
+}
+
+//SaveBotMessage implements BotMessageStorage
+func (s *GormStorage) SaveBotMessage(msg *BotMessage) error {
+	return s.db.Save(msg).Error
+}
+
+//DeleteBotMessage implements BotMessageStorage
+func (s *GormStorage) DeleteBotMessage(msg *BotMessage) error {
+	return s.db.Delete(&BotMessage{}, "id=?", msg.ID).Error
+}
+
+//FindChat implements ChatStorage
+func (s *GormStorage) FindChat(chatID int64) (*Chat, error) {
+	ret := &Chat{}
+	err := gormFindError(s.db.Where("telegram_chat_id=?", chatID).First(ret))
+	return ret, err
+}
+
+//Chats implements ChatStorage
+func (s *GormStorage) Chats(active bool) (ret []*Chat, err error) {
+	err = s.db.Where("inactive=?", !active).Find(&ret).Error
+	return
+}
+
+//ChatsAfter implements ChatStorage
+func (s *GormStorage) ChatsAfter(id int64, limit int) (ret []*Chat, err error) {
+	err = s.db.Where("id>?", id).Order("id").Limit(limit).Find(&ret).Error
+	return
+}
+
+//SaveChat implements ChatStorage
+func (s *GormStorage) SaveChat(chat *Chat) error {
+	return s.db.Save(chat).Error
+}
+
+//DeleteChat implements ChatStorage
+func (s *GormStorage) DeleteChat(chat *Chat) error {
+	return s.db.Delete(&Chat{}, "telegram_chat_id=?", chat.TelegramChatID).Error
+}
+
+//FindUser implements UserStorage
+func (s *GormStorage) FindUser(userID int64) (*User, error) {
+	ret := &User{}
+	err := gormFindError(s.db.Where("telegram_user_id=?", userID).First(ret))
+	return ret, err
+}
+
+//UsersAfter implements UserStorage
+func (s *GormStorage) UsersAfter(id int64, limit int) (ret []*User, err error) {
+	err = s.db.Where("id>?", id).Order("id").Limit(limit).Find(&ret).Error
+	return
+}
+
+//SaveUser implements UserStorage
+func (s *GormStorage) SaveUser(user *User) error {
+	return s.db.Save(user).Error
+}
+
+//SaveUserProfile implements UserStorage
+func (s *GormStorage) SaveUserProfile(user *User) error {
+	user.UpdatedAt = time.Now()
+	columns := map[string]interface{}{
+		"telegram_user_name": user.TelegramUserName,
+		"user_name_history":  user.UserNameHistory,
+		"first_name":         user.FirstName,
+		"last_name":          user.LastName,
+		"language_code":      user.LanguageCode,
+		"updated_at":         user.UpdatedAt,
+	}
+	for retry := false; ; retry = true {
+		db := s.db.Model(&User{}).Where("telegram_user_id=?", user.TelegramUserID).UpdateColumns(columns)
+		if db.Error != nil {
+			return db.Error
+		}
+		if db.RowsAffected != 0 {
+			if user.ID == 0 {
+				stored, err := s.FindUser(user.TelegramUserID)
+				if err != nil {
+					return err
+				}
+				user.ID, user.UserData, user.CreatedAt = stored.ID, stored.UserData, stored.CreatedAt
+			}
+			return nil
+		}
+		//the user created concurrently violates the unique index, so the update is retried
+		if err := s.db.Create(user).Error; err == nil || retry {
+			return err
+		}
+		user.ID = 0
+	}
+}
+
+//gormColumns returns the values of the stored columns of the record except the primary key
+func gormColumns(db *gorm.DB, value interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for _, f := range db.NewScope(value).Fields() {
+		if f.IsNormal && !f.IsPrimaryKey && !f.IsIgnored {
+			ret[f.DBName] = f.Field.Interface()
+		}
+	}
+	return ret
+}
+
+//DeleteUser implements UserStorage
+func (s *GormStorage) DeleteUser(user *User) error {
+	return s.db.Delete(&User{}, "telegram_user_id=?", user.TelegramUserID).Error
+}
+
+//find loads arbitrary records by their ids
+func (s *GormStorage) find(val ...Identifiable) (err error) {
+	for _, v := range val {
+		if err = s.db.Where("id=?", v.Id()).First(v).Error; err != nil {
+			return
+		}
+	}
+	return
+}
+
+//AppendDataChanges implements AuditStorage
+func (s *GormStorage) AppendDataChanges(changes []*DataChange) error {
+	for _, c := range changes {
+		if err := s.db.Create(c).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//DataChanges implements AuditStorage
+func (s *GormStorage) DataChanges(sessionID int64) (ret []*DataChange, err error) {
+	err = s.db.Where("session_id=?", sessionID).Order("id").Find(&ret).Error
+	return
+}
+
+//PruneDataChanges implements AuditStorage
+func (s *GormStorage) PruneDataChanges(before time.Time) (int, error) {
+	db := s.db.Where("changed_at<?", before).Delete(&DataChange{})
+	return int(db.RowsAffected), db.Error
+}
+
+//DeleteDataChanges implements AuditStorage
+func (s *GormStorage) DeleteDataChanges(sessionID int64) error {
+	return s.db.Where("session_id=?", sessionID).Delete(&DataChange{}).Error
+}
+
+//OutboxAfter implements OutboxStorage
+func (s *GormStorage) OutboxAfter(id int64, limit int) (ret []*OutboxEntry, err error) {
+	err = s.db.Where("id>?", id).Order("id").Limit(limit).Find(&ret).Error
+	return
+}
+
+//SaveOutboxEntry implements OutboxStorage
+func (s *GormStorage) SaveOutboxEntry(entry *OutboxEntry) error {
+	return s.db.Save(entry).Error
+}
+
+//DeleteOutboxEntry implements OutboxStorage
+func (s *GormStorage) DeleteOutboxEntry(entry *OutboxEntry) error {
+	return s.db.Delete(&OutboxEntry{}, "id=?", entry.ID).Error
+}
+
+//FindBroadcast implements BroadcastStorage
+func (s *GormStorage) FindBroadcast(name string) (*BroadcastState, error) {
+	ret := &BroadcastState{}
+	err := gormFindError(s.db.Where("name=?", name).First(ret))
+	return ret, err
+}
+
+//SaveBroadcast implements BroadcastStorage
+func (s *GormStorage) SaveBroadcast(state *BroadcastState) error {
+	return s.db.Save(state).Error
+}
@@ -0,0 +1,500 @@
+package botmeans
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//MemoryStorage implements Storage in process memory. Useful for tests and small bots without persistence
+type MemoryStorage struct {
+	mutex       sync.RWMutex
+	lastID      int64
+	sessions    map[int64]Session
+	botMessages map[int64]BotMessage
+	chats       map[int64]Chat
+	users       map[int64]User
+	dataChanges map[int64]DataChange
+	outbox      map[int64]OutboxEntry
+	broadcasts  map[string]BroadcastState
+}
+
+//NewMemoryStorage creates empty in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		sessions:    make(map[int64]Session),
+		botMessages: make(map[int64]BotMessage),
+		chats:       make(map[int64]Chat),
+		users:       make(map[int64]User),
+		dataChanges: make(map[int64]DataChange),
+		outbox:      make(map[int64]OutboxEntry),
+		broadcasts:  make(map[string]BroadcastState),
+	}
+}
+
+//Init implements Storage
+func (s *MemoryStorage) Init() error {
+	return nil
+}
+
+//Transaction implements TransactionalStorage. f works on a copy of the data which replaces the data on success.
+//Other calls are blocked until the transaction ends
+func (s *MemoryStorage) Transaction(f func(tx Storage) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx := NewMemoryStorage()
+	tx.lastID = s.lastID
+	for k, v := range s.sessions {
+		tx.sessions[k] = v
+	}
+	for k, v := range s.botMessages {
+		tx.botMessages[k] = v
+	}
+	for k, v := range s.chats {
+		tx.chats[k] = v
+	}
+	for k, v := range s.users {
+		tx.users[k] = v
+	}
+	for k, v := range s.dataChanges {
+		tx.dataChanges[k] = v
+	}
+	for k, v := range s.outbox {
+		tx.outbox[k] = v
+	}
+	for k, v := range s.broadcasts {
+		tx.broadcasts[k] = v
+	}
+	if err := f(tx); err != nil {
+		return err
+	}
+	s.lastID, s.sessions, s.botMessages, s.chats, s.users = tx.lastID, tx.sessions, tx.botMessages, tx.chats, tx.users
+	s.dataChanges, s.outbox, s.broadcasts = tx.dataChanges, tx.outbox, tx.broadcasts
+	return nil
+}
+
+func (s *MemoryStorage) nextID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func sortedIDs(ids []int64) []int64 {
+	sort.Sort(int64Slice(ids))
+	return ids
+}
+
+func (s *MemoryStorage) sessionIDs() (ret []int64) {
+	for id := range s.sessions {
+		ret = append(ret, id)
+	}
+	return sortedIDs(ret)
+}
+
+//FindSession implements SessionStorage
+func (s *MemoryStorage) FindSession(chatID int64, userID int64, userName string) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, id := range s.sessionIDs() {
+		v := s.sessions[id]
+		if v.TelegramChatID != chatID {
+			continue
+		}
+		if (userID != 0 && v.TelegramUserID == userID) || (userName != "" && v.TelegramUserName == userName) {
+			return &v, nil
+		}
+	}
+	return &Session{}, ErrNotFound
+}
+
+//SessionByID implements SessionStorage
+func (s *MemoryStorage) SessionByID(id int64) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if v, ok := s.sessions[id]; ok {
+		return &v, nil
+	}
+	return &Session{}, ErrNotFound
+}
+
+//ChatSessions implements SessionStorage
+func (s *MemoryStorage) ChatSessions(chatID int64) (ret []*Session, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, id := range s.sessionIDs() {
+		if v := s.sessions[id]; v.TelegramChatID == chatID {
+			ret = append(ret, &v)
+		}
+	}
+	return
+}
+
+//UserSessions implements SessionStorage
+func (s *MemoryStorage) UserSessions(userID int64) (ret []*Session, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, id := range s.sessionIDs() {
+		if v := s.sessions[id]; v.TelegramUserID == userID {
+			ret = append(ret, &v)
+		}
+	}
+	return
+}
+
+//SessionsAfter implements SessionStorage
+func (s *MemoryStorage) SessionsAfter(id int64, limit int) (ret []*Session, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, i := range s.sessionIDs() {
+		if v := s.sessions[i]; i > id && len(ret) < limit {
+			ret = append(ret, &v)
+		}
+	}
+	return
+}
+
+//SaveSession implements SessionStorage
+func (s *MemoryStorage) SaveSession(session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if session.ID == 0 {
+		session.ID = s.nextID()
+	} else if stored, ok := s.sessions[session.ID]; ok && stored.Version != session.Version {
+		return ErrConflict
+	}
+	session.Version++
+	session.UpdatedAt = time.Now()
+	v := *session
+	v.storage = nil
+	v.isNew = false
+	v.chat = nil
+	v.user = nil
+	v.loaded = nil
+	s.sessions[v.ID] = v
+	return nil
+}
+
+//DeleteSession implements SessionStorage
+func (s *MemoryStorage) DeleteSession(session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, session.ID)
+	return nil
+}
+
+func (s *MemoryStorage) botMessageIDs() (ret []int64) {
+	for id := range s.botMessages {
+		ret = append(ret, id)
+	}
+	return sortedIDs(ret)
+}
+
+//FindBotMessage implements BotMessageStorage
+func (s *MemoryStorage) FindBotMessage(chatID int64, msgID int64) (*BotMessage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, id := range s.botMessageIDs() {
+		if v := s.botMessages[id]; v.TelegramChatID == chatID && v.TelegramMsgID == msgID {
+			return &v, nil
+		}
+	}
+	return &BotMessage{}, ErrNotFound
+}
+
+//BotMessagesByDataKey implements BotMessageStorage
+func (s *MemoryStorage) BotMessagesByDataKey(chatID int64, key string) (ret []*BotMessage, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, id := range s.botMessageIDs() {
+		if v := s.botMessages[id]; v.TelegramChatID == chatID && hasDataKey(v.UserData, key) {
+			ret = append(ret, &v)
+		}
+	}
+	return
+}
+
+//BotMessagesAfter implements BotMessageStorage
+func (s *MemoryStorage) BotMessagesAfter(id int64, limit int) (ret []*BotMessage, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, i := range s.botMessageIDs() {
+		if v := s.botMessages[i]; i > id && len(ret) < limit {
+			ret = append(ret, &v)
+		}
+	}
+	return
+}
+
+//SaveBotMessage implements BotMessageStorage
+func (s *MemoryStorage) SaveBotMessage(msg *BotMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if msg.ID == 0 {
+		msg.ID = s.nextID()
+	}
+	v := *msg
+	v.storage = nil
+	s.botMessages[v.ID] = v
+	return nil
+}
+
+//DeleteBotMessage implements BotMessageStorage
+func (s *MemoryStorage) DeleteBotMessage(msg *BotMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.botMessages, msg.ID)
+	return nil
+}
+
+//FindChat implements ChatStorage
+func (s *MemoryStorage) FindChat(chatID int64) (*Chat, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if v, ok := s.chats[chatID]; ok {
+		return &v, nil
+	}
+	return &Chat{}, ErrNotFound
+}
+
+//Chats implements ChatStorage
+func (s *MemoryStorage) Chats(active bool) (ret []*Chat, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ids := []int64{}
+	for id := range s.chats {
+		ids = append(ids, id)
+	}
+	for _, id := range sortedIDs(ids) {
+		if v := s.chats[id]; v.IsActive() == active {
+			ret = append(ret, &v)
+		}
+	}
+	return
+}
+
+//ChatsAfter implements ChatStorage
+func (s *MemoryStorage) ChatsAfter(id int64, limit int) (ret []*Chat, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	byID := make(map[int64]Chat)
+	ids := []int64{}
+	for _, v := range s.chats {
+		byID[v.ID] = v
+		ids = append(ids, v.ID)
+	}
+	for _, i := range sortedIDs(ids) {
+		if v := byID[i]; i > id && len(ret) < limit {
+			ret = append(ret, &v)
+		}
+	}
+	return
+}
+
+//SaveChat implements ChatStorage
+func (s *MemoryStorage) SaveChat(chat *Chat) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if chat.ID == 0 {
+		chat.ID = s.nextID()
+	}
+	v := *chat
+	v.storage = nil
+	v.isNew = false
+	s.chats[v.TelegramChatID] = v
+	return nil
+}
+
+//DeleteChat implements ChatStorage
+func (s *MemoryStorage) DeleteChat(chat *Chat) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.chats, chat.TelegramChatID)
+	return nil
+}
+
+//FindUser implements UserStorage
+func (s *MemoryStorage) FindUser(userID int64) (*User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if v, ok := s.users[userID]; ok {
+		return &v, nil
+	}
+	return &User{}, ErrNotFound
+}
+
+//UsersAfter implements UserStorage
+func (s *MemoryStorage) UsersAfter(id int64, limit int) (ret []*User, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	byID := make(map[int64]User)
+	ids := []int64{}
+	for _, v := range s.users {
+		byID[v.ID] = v
+		ids = append(ids, v.ID)
+	}
+	for _, i := range sortedIDs(ids) {
+		if v := byID[i]; i > id && len(ret) < limit {
+			ret = append(ret, &v)
+		}
+	}
+	return
+}
+
+//SaveUser implements UserStorage
+func (s *MemoryStorage) SaveUser(user *User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if user.ID == 0 {
+		user.ID = s.nextID()
+	}
+	v := *user
+	v.storage = nil
+	v.isNew = false
+	s.users[v.TelegramUserID] = v
+	return nil
+}
+
+//SaveUserProfile implements UserStorage
+func (s *MemoryStorage) SaveUserProfile(user *User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v, ok := s.users[user.TelegramUserID]
+	if ok {
+		v.copyProfile(user)
+	} else {
+		v = *user
+		v.ID = s.nextID()
+		v.storage = nil
+		v.isNew = false
+	}
+	v.UpdatedAt = time.Now()
+	user.ID, user.UserData, user.CreatedAt, user.UpdatedAt = v.ID, v.UserData, v.CreatedAt, v.UpdatedAt
+	s.users[v.TelegramUserID] = v
+	return nil
+}
+
+//DeleteUser implements UserStorage
+func (s *MemoryStorage) DeleteUser(user *User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.users, user.TelegramUserID)
+	return nil
+}
+
+//AppendDataChanges implements AuditStorage
+func (s *MemoryStorage) AppendDataChanges(changes []*DataChange) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range changes {
+		c.ID = s.nextID()
+		s.dataChanges[c.ID] = *c
+	}
+	return nil
+}
+
+//DataChanges implements AuditStorage
+func (s *MemoryStorage) DataChanges(sessionID int64) (ret []*DataChange, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ids := []int64{}
+	for id, c := range s.dataChanges {
+		if c.SessionID == sessionID {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range sortedIDs(ids) {
+		v := s.dataChanges[id]
+		ret = append(ret, &v)
+	}
+	return
+}
+
+//PruneDataChanges implements AuditStorage
+func (s *MemoryStorage) PruneDataChanges(before time.Time) (n int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, c := range s.dataChanges {
+		if c.ChangedAt.Before(before) {
+			delete(s.dataChanges, id)
+			n++
+		}
+	}
+	return
+}
+
+//DeleteDataChanges implements AuditStorage
+func (s *MemoryStorage) DeleteDataChanges(sessionID int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, c := range s.dataChanges {
+		if c.SessionID == sessionID {
+			delete(s.dataChanges, id)
+		}
+	}
+	return nil
+}
+
+//OutboxAfter implements OutboxStorage
+func (s *MemoryStorage) OutboxAfter(id int64, limit int) (ret []*OutboxEntry, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ids := []int64{}
+	for i := range s.outbox {
+		if i > id {
+			ids = append(ids, i)
+		}
+	}
+	for _, i := range sortedIDs(ids) {
+		if len(ret) == limit {
+			break
+		}
+		v := s.outbox[i]
+		ret = append(ret, &v)
+	}
+	return
+}
+
+//SaveOutboxEntry implements OutboxStorage
+func (s *MemoryStorage) SaveOutboxEntry(entry *OutboxEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if entry.ID == 0 {
+		entry.ID = s.nextID()
+	}
+	s.outbox[entry.ID] = *entry
+	return nil
+}
+
+//DeleteOutboxEntry implements OutboxStorage
+func (s *MemoryStorage) DeleteOutboxEntry(entry *OutboxEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.outbox, entry.ID)
+	return nil
+}
+
+//FindBroadcast implements BroadcastStorage
+func (s *MemoryStorage) FindBroadcast(name string) (*BroadcastState, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if v, ok := s.broadcasts[name]; ok {
+		return &v, nil
+	}
+	return &BroadcastState{}, ErrNotFound
+}
+
+//SaveBroadcast implements BroadcastStorage
+func (s *MemoryStorage) SaveBroadcast(state *BroadcastState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if state.ID == 0 {
+		state.ID = s.nextID()
+	}
+	s.broadcasts[state.Name] = *state
+	return nil
+}
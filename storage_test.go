@@ -0,0 +1,215 @@
+package botmeans
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	_ "github.com/lib/pq"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+//testStorages returns all storages available in the test environment.
+//PostgreSQL is used only if MEANS_DB_USERNAME is set
+func testStorages(t *testing.T) (ret map[string]Storage, cleanup func()) {
+	ret = map[string]Storage{"memory": NewMemoryStorage()}
+	cleanups := []func(){}
+	cleanup = func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "botmeans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanups = append(cleanups, func() { os.RemoveAll(dir) })
+	if bolt, err := NewBoltStorage(path.Join(dir, "test.bolt"), 0600); err == nil {
+		ret["bolt"] = bolt
+		cleanups = append([]func(){func() { bolt.Close() }}, cleanups...)
+	} else {
+		t.Error(err)
+	}
+	if db, err := gorm.Open("sqlite3", path.Join(dir, "test.db")); err == nil {
+		ret["sqlite"] = NewGormStorage(db)
+		cleanups = append([]func(){func() { db.Close() }}, cleanups...)
+	} else {
+		t.Error(err)
+	}
+
+	if os.Getenv("MEANS_DB_USERNAME") != "" {
+		db, err := gorm.Open("postgres", fmt.Sprintf("user=%v dbname=%v sslmode=disable password=%v",
+			string(os.Getenv("MEANS_DB_USERNAME")),
+			string(os.Getenv("MEANS_DBNAME")),
+			""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret["postgres"] = NewGormStorage(db)
+		cleanups = append(cleanups, func() {
+			db.DropTableIfExists(gormModels...)
+			db.Close()
+		})
+	}
+	for name, s := range ret {
+		if err := s.Init(); err != nil {
+			t.Fatal(name, err)
+		}
+	}
+	return
+}
+
+func TestStorage(t *testing.T) {
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	for name, storage := range storages {
+		s1 := &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramUserName: "one", TelegramChatID: 10}, UserData: "{}"}
+		s2 := &Session{SessionBase: SessionBase{TelegramUserName: "two", TelegramChatID: 10}, UserData: "{}"}
+		s3 := &Session{SessionBase: SessionBase{TelegramUserID: 1, TelegramUserName: "one", TelegramChatID: 20}, UserData: "{}"}
+		for _, s := range []*Session{s1, s2, s3} {
+			if err := storage.SaveSession(s); err != nil || s.ID == 0 {
+				t.Error(name, "Session is not saved", err)
+			}
+		}
+		if s, err := storage.FindSession(10, 0, "two"); err != nil || s.ID != s2.ID {
+			t.Error(name, "Should be found by username", err)
+		}
+		if s, err := storage.FindSession(20, 1, ""); err != nil || s.ID != s3.ID {
+			t.Error(name, "Should be found by user id", err)
+		}
+		if _, err := storage.FindSession(30, 1, "one"); err != ErrNotFound {
+			t.Error(name, "Should not be found", err)
+		}
+		s2.TelegramUserName = "three"
+		storage.SaveSession(s2)
+		if _, err := storage.FindSession(10, 0, "two"); err != ErrNotFound {
+			t.Error(name, "Old username should not be found", err)
+		}
+		if s, err := storage.FindSession(10, 0, "three"); err != nil || s.ID != s2.ID {
+			t.Error(name, "Should be found by new username", err)
+		}
+		stale, _ := storage.SessionByID(s1.ID)
+		s1.UserData = `{"A":1}`
+		if err := storage.SaveSession(s1); err != nil {
+			t.Error(name, "Session should be saved", err)
+		}
+		stale.UserData = `{"B":1}`
+		if err := storage.SaveSession(stale); err != ErrConflict {
+			t.Error(name, "Stale session should not be saved", err)
+		}
+		if s, _ := storage.SessionByID(s1.ID); s.UserData != `{"A":1}` || s.Version != s1.Version {
+			t.Error(name, "Stale session should not overwrite", s.UserData, s.Version, s1.Version)
+		}
+		s4 := &Session{SessionBase: SessionBase{TelegramUserName: "four", TelegramChatID: 10}, UserData: "{}"}
+		storage.SaveSession(s4)
+		if err := storage.DeleteSession(s4); err != nil {
+			t.Error(name, "Session should be deleted", err)
+		}
+		if _, err := storage.FindSession(10, 0, "four"); err != ErrNotFound {
+			t.Error(name, "Deleted session should not be found", err)
+		}
+		if l, _ := storage.ChatSessions(10); len(l) != 2 {
+			t.Error(name, "Should be 2 sessions in chat")
+		}
+		if l, _ := storage.UserSessions(1); len(l) != 2 {
+			t.Error(name, "Should be 2 sessions of user")
+		}
+
+		m1 := &BotMessage{TelegramChatID: 10, TelegramMsgID: 1, UserData: `{"Poll":{}}`}
+		m2 := &BotMessage{TelegramChatID: 10, TelegramMsgID: 2, UserData: `{"Polls":{}}`}
+		for _, m := range []*BotMessage{m1, m2} {
+			if err := storage.SaveBotMessage(m); err != nil {
+				t.Error(name, err)
+			}
+		}
+		if m, err := storage.FindBotMessage(10, 2); err != nil || m.ID != m2.ID {
+			t.Error(name, "Message should be found", err)
+		}
+		if l, _ := storage.BotMessagesByDataKey(10, "Poll"); len(l) != 1 || l[0].ID != m1.ID {
+			t.Error(name, "Should be exactly one message with Poll", l)
+		}
+
+		c1 := &Chat{TelegramChatID: 10, UserData: "{}"}
+		c2 := &Chat{TelegramChatID: 20, UserData: "{}", Inactive: true}
+		storage.SaveChat(c1)
+		storage.SaveChat(c2)
+		if l, _ := storage.Chats(true); len(l) != 1 || l[0].TelegramChatID != 10 {
+			t.Error(name, "Wrong active chats", l)
+		}
+		if c, err := storage.FindChat(20); err != nil || c.IsActive() {
+			t.Error(name, "Chat should be found and inactive", err)
+		}
+		if l, _ := storage.ChatsAfter(0, 1); len(l) != 1 || l[0].ID != c1.ID {
+			t.Error(name, "Chats should be paged in the order of ids", l)
+		}
+		if l, _ := storage.ChatsAfter(c1.ID, 10); len(l) != 1 || l[0].ID != c2.ID {
+			t.Error(name, "Wrong next page of chats", l)
+		}
+		storage.DeleteChat(c2)
+		if l, _ := storage.ChatsAfter(c1.ID, 10); len(l) != 0 {
+			t.Error(name, "Deleted chat should not be paged", l)
+		}
+
+		u := &User{TelegramUserID: 1, TelegramUserName: "one", UserData: "{}"}
+		storage.SaveUser(u)
+		if l, err := storage.FindUser(1); err != nil || l.Login() != "one" {
+			t.Error(name, "User should be found", err)
+		}
+		if _, err := storage.FindUser(2); err != ErrNotFound {
+			t.Error(name, "User should not be found", err)
+		}
+		u.UserData = `{"A":1}`
+		storage.SaveUser(u)
+		profile := &User{TelegramUserID: 1, TelegramUserName: "uno", FirstName: "One", UserData: "{}"}
+		if err := storage.SaveUserProfile(profile); err != nil || profile.ID != u.ID {
+			t.Error(name, "Profile should be saved to the stored user", err)
+		}
+		if l, _ := storage.FindUser(1); l.Login() != "uno" || l.FirstName != "One" || l.UserData != `{"A":1}` {
+			t.Error(name, "Profile save should keep UserData", l)
+		}
+		created := &User{TelegramUserID: 2, TelegramUserName: "two", UserData: "{}"}
+		if err := storage.SaveUserProfile(created); err != nil || created.ID == 0 {
+			t.Error(name, "New user should be created", err)
+		}
+		if l, err := storage.FindUser(2); err != nil || l.Login() != "two" {
+			t.Error(name, "Created user should be found", err)
+		}
+		if l, _ := storage.UsersAfter(0, 10); len(l) != 2 || l[0].ID != u.ID || l[1].ID != created.ID {
+			t.Error(name, "Users should be paged in the order of ids", l)
+		}
+		if l, _ := storage.UsersAfter(u.ID, 10); len(l) != 1 || l[0].ID != created.ID {
+			t.Error(name, "Wrong next page of users", l)
+		}
+	}
+}
+
+func TestBoltReindex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botmeans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := NewBoltStorage(path.Join(dir, "test.bolt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	storage.Init()
+	for _, id := range []int64{30, 10, 20} {
+		storage.SaveChat(&Chat{TelegramChatID: id, UserData: "{}"})
+	}
+	storage.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(boltChatsByID)
+	})
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := storage.ChatsAfter(0, 10); len(l) != 3 || l[0].TelegramChatID != 30 || l[2].TelegramChatID != 20 {
+		t.Error("Index should be rebuilt for existing chats", l)
+	}
+}
@@ -29,12 +29,14 @@ func getTemplater() *template.Template {
 	)
 }
 
-//MessageTemplate defines the structure of the message template
+//MessageTemplate defines the structure of the message template.
+//MessageOptions fields, e.g. "Silent": true, set the default options of the message
 type MessageTemplate struct {
 	ParseMode     string
 	Keyboard      map[string][][]MessageButton
 	Template      map[string]string
 	ReplyKeyboard map[string][][]MessageButton
+	MessageOptions
 }
 
 //MessageButton represents a button in Telegram UI
@@ -44,12 +46,19 @@ type MessageButton struct {
 	Args    string
 }
 
+//KeyboardProvider is implemented by the message data adding inline buttons built at runtime.
+//The rows are appended to the inline keyboard of the template
+type KeyboardProvider interface {
+	Keyboard() [][]MessageButton
+}
+
 type tgMsgParams struct {
 	ParseMode       string
 	text            string
 	inlineKbdMarkup *tgbotapi.InlineKeyboardMarkup
 	replyKbdMarkup  *tgbotapi.ReplyKeyboardMarkup
 	replyKbdHide    *tgbotapi.ReplyKeyboardHide
+	options         MessageOptions
 }
 
 func renderFromTemplate(
@@ -66,13 +75,16 @@ func renderFromTemplate(
 		return ret, err
 	}
 	ret.ParseMode = msgTemplate.ParseMode
-	if _, ok := msgTemplate.Template[locale]; !ok {
-		locale = ""
-	}
+	ret.options = msgTemplate.MessageOptions
+	locale = resolveTemplateLocale(msgTemplate.Template, locale)
 
 	ret.text, err = renderText(msgTemplate.Template[locale], Data, templ)
 
-	ret.inlineKbdMarkup = createInlineKeyboard(msgTemplate.Keyboard[locale])
+	keyboard := msgTemplate.Keyboard[locale]
+	if p, ok := Data.(KeyboardProvider); ok {
+		keyboard = append(keyboard, p.Keyboard()...)
+	}
+	ret.inlineKbdMarkup = createInlineKeyboard(keyboard)
 	ret.replyKbdMarkup = createReplyKeyboard(msgTemplate.ReplyKeyboard[locale])
 	if len(msgTemplate.ReplyKeyboard[locale]) == 0 {
 		h := tgbotapi.NewHideKeyboard(true)
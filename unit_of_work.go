@@ -0,0 +1,238 @@
+package botmeans
+
+import (
+	"encoding/json"
+)
+
+//batchingStorage marks the storage working in unit-of-work mode
+type batchingStorage struct {
+	Storage
+	outbox bool
+}
+
+//BatchWrites enables unit-of-work mode for the storage.
+//Session and bot message writes made by an Action are buffered and flushed in a single transaction
+//(if the storage implements TransactionalStorage) after the ActionHandler returns.
+//The writes are dropped if the handler calls Error
+func BatchWrites(storage Storage) Storage {
+	if _, ok := batchingOf(storage); ok {
+		return storage
+	}
+	return &batchingStorage{Storage: storage}
+}
+
+func (s *batchingStorage) unwrap() Storage {
+	return s.Storage
+}
+
+//batchingOf finds the storage in unit-of-work mode behind the wrappers, e.g. CacheSessions(BatchWrites(s))
+func batchingOf(storage Storage) (*batchingStorage, bool) {
+	for {
+		if b, ok := storage.(*batchingStorage); ok {
+			return b, true
+		}
+		w, ok := storage.(storageWrapper)
+		if !ok {
+			return nil, false
+		}
+		storage = w.unwrap()
+	}
+}
+
+//Transaction implements TransactionalStorage
+func (s *batchingStorage) Transaction(f func(tx Storage) error) error {
+	return inTransaction(s.Storage, f)
+}
+
+//unitOfWork buffers the writes of the session and bot messages during one Action.
+//Other storage calls are passed through. In outbox mode the outgoing messages are buffered too
+type unitOfWork struct {
+	Storage
+	original      Storage
+	session       *Session
+	baseData      string
+	sessionDirty  bool
+	botMessages   []*BotMessage
+	outboxEnabled bool
+	outbox        []outboxPending
+}
+
+//beginWork starts the unit of work for the session if its storage is in unit-of-work mode.
+//Writes are flushed through all wrappers of the storage
+func beginWork(s ActionSessionInterface) *unitOfWork {
+	session, ok := s.(*Session)
+	if !ok || session.storage == nil {
+		return nil
+	}
+	batching, ok := batchingOf(session.storage)
+	if !ok {
+		return nil
+	}
+	w := &unitOfWork{
+		Storage:       session.storage,
+		original:      session.storage,
+		session:       session,
+		baseData:      session.UserData,
+		outboxEnabled: batching.outbox,
+	}
+	session.storage = w
+	return w
+}
+
+//attach makes the message save through the unit of work
+func (w *unitOfWork) attach(msg BotMessageInterface) BotMessageInterface {
+	if m, ok := msg.(*BotMessage); ok {
+		m.storage = w
+	}
+	return msg
+}
+
+//SessionByID implements SessionStorage. The session of the unit of work is returned without querying the storage
+func (w *unitOfWork) SessionByID(id int64) (*Session, error) {
+	if id == w.session.ID {
+		v := *w.session
+		return &v, nil
+	}
+	return w.Storage.SessionByID(id)
+}
+
+//SaveSession implements SessionStorage. The session of the unit of work is saved on flush
+func (w *unitOfWork) SaveSession(session *Session) error {
+	if session == w.session {
+		w.sessionDirty = true
+		return nil
+	}
+	return w.Storage.SaveSession(session)
+}
+
+//FindBotMessage implements BotMessageStorage. Buffered messages are returned without querying the storage
+func (w *unitOfWork) FindBotMessage(chatID int64, msgID int64) (*BotMessage, error) {
+	for _, m := range w.botMessages {
+		if m.TelegramChatID == chatID && m.TelegramMsgID == msgID {
+			v := *m
+			return &v, nil
+		}
+	}
+	return w.Storage.FindBotMessage(chatID, msgID)
+}
+
+//SaveBotMessage implements BotMessageStorage. The message is saved on flush
+func (w *unitOfWork) SaveBotMessage(msg *BotMessage) error {
+	for _, m := range w.botMessages {
+		if m == msg {
+			return nil
+		}
+	}
+	w.botMessages = append(w.botMessages, msg)
+	return nil
+}
+
+//detach makes the session and messages use the original storage again
+func (w *unitOfWork) detach() {
+	w.session.storage = w.original
+	for _, m := range w.botMessages {
+		if m.storage == w {
+			m.storage = w.original
+		}
+	}
+}
+
+//flush saves buffered writes in one transaction, if the storage supports transactions
+func (w *unitOfWork) flush() error {
+	w.detach()
+	if !w.sessionDirty && len(w.botMessages) == 0 && len(w.outbox) == 0 {
+		return nil
+	}
+	transactional, ok := w.Storage.(TransactionalStorage)
+	if !ok {
+		return w.save(w.Storage)
+	}
+
+	sessionID, sessionVersion, sessionData := w.session.ID, w.session.Version, w.session.UserData
+	msgIDs := make([]int64, len(w.botMessages))
+	for i, m := range w.botMessages {
+		msgIDs[i] = m.ID
+	}
+	err := transactional.Transaction(w.save)
+	if err != nil {
+		w.session.ID, w.session.Version, w.session.UserData = sessionID, sessionVersion, sessionData
+		for i, m := range w.botMessages {
+			m.ID = msgIDs[i]
+		}
+		for _, p := range w.outbox {
+			p.entry.ID = 0
+		}
+		return err
+	}
+	w.session.isNew = false
+	return nil
+}
+
+func (w *unitOfWork) save(storage Storage) error {
+	if w.sessionDirty && !w.session.erased {
+		if err := w.saveSession(storage); err != nil {
+			return err
+		}
+	}
+	for _, m := range w.botMessages {
+		if err := storage.SaveBotMessage(m); err != nil {
+			return err
+		}
+	}
+	return w.saveOutbox(storage)
+}
+
+//saveSession saves the session merging its changes into concurrent updates
+func (w *unitOfWork) saveSession(storage Storage) error {
+	baseData := w.baseData
+	for i := 0; i < sessionSaveRetries; i++ {
+		err := storage.SaveSession(w.session)
+		if err != ErrConflict {
+			return err
+		}
+		stored, err := storage.SessionByID(w.session.ID)
+		if err != nil {
+			return err
+		}
+		data := mergeData(baseData, w.session.UserData, stored.UserData)
+		w.session.refresh(stored)
+		w.session.UserData = data
+		baseData = stored.UserData
+	}
+	return ErrConflict
+}
+
+//rollback drops buffered writes and restores the session data
+func (w *unitOfWork) rollback() {
+	w.detach()
+	w.session.UserData = w.baseData
+	w.sessionDirty = false
+	w.botMessages = nil
+	w.outbox = nil
+}
+
+//mergeData applies the keys changed from base to current onto stored
+func mergeData(base string, current string, stored string) string {
+	baseContainer := dataContainer(base)
+	currentContainer := dataContainer(current)
+	container := dataContainer(stored)
+	for key, v := range currentContainer {
+		if b, ok := baseContainer[key]; !ok || rawString(b) != rawString(v) {
+			container[key] = v
+		}
+	}
+	for key := range baseContainer {
+		if _, ok := currentContainer[key]; !ok {
+			delete(container, key)
+		}
+	}
+	d, _ := json.Marshal(container)
+	return string(d)
+}
+
+func rawString(raw *json.RawMessage) string {
+	if raw == nil {
+		return ""
+	}
+	return string(*raw)
+}
@@ -0,0 +1,116 @@
+package botmeans
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnitOfWork(t *testing.T) {
+	storages, cleanup := testStorages(t)
+	defer cleanup()
+
+	type Counter struct {
+		N int
+	}
+	type Other struct {
+		V string
+	}
+
+	for name, storage := range storages {
+		batching := BatchWrites(storage)
+		stored := &Session{SessionBase: SessionBase{TelegramUserID: 7, TelegramChatID: 7}, UserData: "{}", storage: storage}
+		stored.Save()
+
+		fail := false
+		handler := func(context ActionContextInterface) {
+			for i := 1; i <= 3; i++ {
+				context.Session().SetData(Counter{i})
+			}
+			context.Output().SimpleText("hello")
+			current := Counter{}
+			s, _ := storage.SessionByID(stored.ID)
+			if deserialize(s.UserData, &current); current.N == 3 {
+				t.Error(name, "Writes should be buffered until the handler returns")
+			}
+			concurrent, _ := storage.SessionByID(stored.ID)
+			concurrent.UserData = serialize(concurrent.UserData, Other{"concurrent"})
+			concurrent.FirstName = "Concurrent"
+			storage.SaveSession(concurrent)
+			if fail {
+				context.Error("fail")
+			}
+		}
+
+		newAction := func() *Action {
+			session, _ := SessionLoader(SessionBase{7, "", 7, false, false}, batching, 0, nil)
+			return &Action{
+				session:          session,
+				handlersProvider: func(string) (ActionHandler, bool) { return handler, true },
+				getters: actionExecuterFactoryConfig{
+					cmdGetter:       func() string { return "cmd" },
+					sourceMsgGetter: func() BotMessageInterface { return BotMessageDBLoader(7, 0, "", batching) },
+				},
+				senderFactory: func(s senderSession) SenderInterface {
+					return &Sender{session: s, msgFactory: func() BotMessageInterface { return NewBotMessage(s.ChatId(), batching) }}
+				},
+			}
+		}
+
+		newAction().Execute()
+		s, _ := storage.SessionByID(stored.ID)
+		counter, other := Counter{}, Other{}
+		s.GetData(&counter)
+		s.GetData(&other)
+		if counter.N != 3 || other.V != "concurrent" || s.FirstName != "Concurrent" {
+			t.Error(name, "Changes should be flushed and merged with concurrent ones", s.UserData, s.FirstName)
+		}
+		if msgs, _ := storage.BotMessagesAfter(0, 10); len(msgs) != 1 {
+			t.Error(name, "Bot message should be saved", len(msgs))
+		}
+
+		fail = true
+		s.storage = storage
+		s.SetData(Counter{0})
+		newAction().Execute()
+		s, _ = storage.SessionByID(stored.ID)
+		s.GetData(&counter)
+		if counter.N != 0 {
+			t.Error(name, "Changes should be rolled back on Error", s.UserData)
+		}
+		if msgs, _ := storage.BotMessagesAfter(0, 10); len(msgs) != 1 {
+			t.Error(name, "Bot message should not be saved on Error", len(msgs))
+		}
+	}
+}
+
+func TestUnitOfWorkBehindWrappers(t *testing.T) {
+	type Counter struct {
+		N int
+	}
+	storage := NewMemoryStorage()
+	for name, wrapped := range map[string]Storage{
+		"cache": CacheSessions(BatchWrites(storage), NewLRUSessionCache(10, time.Hour)),
+		"audit": AuditSessionData(BatchWrites(storage)),
+	} {
+		session := &Session{SessionBase: SessionBase{TelegramUserID: 8, TelegramChatID: 8}, UserData: "{}", storage: wrapped}
+		w := beginWork(session)
+		if w == nil {
+			t.Fatal(name, "Unit of work should be found behind the wrappers")
+		}
+		session.SetData(Counter{1})
+		if stored, err := storage.FindSession(8, 8, ""); err == nil && stored.ID == session.ID {
+			t.Error(name, "Session should not be saved before flush")
+		}
+		if err := w.flush(); err != nil {
+			t.Fatal(name, err)
+		}
+		if session.storage != wrapped {
+			t.Error(name, "Session should use the wrapped storage after flush")
+		}
+		stored, err := storage.SessionByID(session.ID)
+		counter := Counter{}
+		if deserialize(stored.UserData, &counter); err != nil || counter.N != 1 {
+			t.Error(name, "Session should be saved on flush", err)
+		}
+	}
+}
@@ -36,6 +36,7 @@ type parserConfig struct {
 	botMessageFactory     BotMessageFactory
 	cmdParser             CmdParserFunc
 	argsParser            ArgsParserFunc
+	userFactory           UserFactory
 }
 
 func createTGUpdatesParser(
@@ -54,16 +55,19 @@ func createTGUpdatesParser(
 				var msg *tgbotapi.Message
 				var msgId int64
 				var callbackID string
+				var from *tgbotapi.User
 				switch {
 				case tgUpdate.Message != nil:
 					chatId = tgUpdate.Message.Chat.ID
 					userId = int64(tgUpdate.Message.From.ID)
 					username = tgUpdate.Message.From.UserName
+					from = tgUpdate.Message.From
 					msg = tgUpdate.Message
 				case tgUpdate.CallbackQuery != nil:
 					chatId = tgUpdate.CallbackQuery.Message.Chat.ID
 					userId = int64(tgUpdate.CallbackQuery.From.ID)
 					username = tgUpdate.CallbackQuery.From.UserName
+					from = tgUpdate.CallbackQuery.From
 					msg = tgUpdate.CallbackQuery.Message
 					msgId = int64(msg.MessageID)
 					callbackID = tgUpdate.CallbackQuery.ID
@@ -71,19 +75,29 @@ func createTGUpdatesParser(
 					chatId = tgUpdate.EditedMessage.Chat.ID
 					userId = int64(tgUpdate.EditedMessage.From.ID)
 					username = tgUpdate.EditedMessage.From.UserName
+					from = tgUpdate.EditedMessage.From
 					msg = tgUpdate.EditedMessage
 				case tgUpdate.InlineQuery != nil:
 				case tgUpdate.ChosenInlineResult != nil:
 
 				}
+				var sourceID int64
+				if msg != nil {
+					sourceID = int64(msg.MessageID)
+				}
+				var user UserInterface
+				if pC.userFactory != nil {
+					user = pC.userFactory(from)
+				}
 
 				pC.actionExecuterFactory(
 					SessionBase{TelegramUserID: userId, TelegramUserName: username, TelegramChatID: chatId},
 					pC.sessionFactory,
 					actionExecuterFactoryConfig{
 						func() string { return pC.cmdParser(tgUpdate) },
-						func() Args { return pC.argsParser(tgUpdate) },
+						func() Args { return sourceArgs{pC.argsParser(tgUpdate), sourceID} },
 						func() BotMessageInterface { return pC.botMessageFactory(chatId, msgId, callbackID) },
+						func() UserInterface { return user },
 					},
 					cmdQueueChan)
 
@@ -45,7 +45,7 @@ func TestUpdatesParser(t *testing.T) {
 		_, ok := sessionIdFlags[stringID]
 		sessionIdFlags[stringID] = struct{}{}
 		mutex.Unlock()
-		return &Session{SessionBase: base, db: nil, isNew: !ok}, nil
+		return &Session{SessionBase: base, storage: nil, isNew: !ok}, nil
 	}
 
 	aliaser := func(string) (string, Args, bool) { return "", args{}, false }
@@ -74,6 +74,7 @@ func TestUpdatesParser(t *testing.T) {
 			botMsgFactory,
 			cmdParser,
 			argsParser,
+			nil,
 		},
 	)
 	type TestEntry struct {
@@ -0,0 +1,169 @@
+package botmeans
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"strings"
+	"time"
+)
+
+//User represents the telegram user across all chats
+type User struct {
+	ID               int64  `sql:"index;unique"`
+	TelegramUserID   int64  `sql:"index;unique"`
+	TelegramUserName string `sql:"index"`
+	UserNameHistory  string
+	FirstName        string
+	LastName         string
+	LanguageCode     string
+	UserData         string `sql:"type:jsonb"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	storage          UserStorage
+	isNew            bool
+}
+
+//UserInterface defines the global user profile shared across chats
+type UserInterface interface {
+	UserIdentifier
+	DataGetSetter
+	PersistentSaver
+	UserName() string
+	Login() string
+	PreviousLogins() []string
+	Language() string
+}
+
+//UserId returns telegram user id
+func (user *User) UserId() int64 {
+	return user.TelegramUserID
+}
+
+//UserName returns the name of the user
+func (user *User) UserName() string {
+	s := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if s == "" {
+		s = user.TelegramUserName
+	}
+	return s
+}
+
+//Login returns the current telegram username of the user
+func (user *User) Login() string {
+	return user.TelegramUserName
+}
+
+//PreviousLogins returns the usernames the user had before, the latest last
+func (user *User) PreviousLogins() (ret []string) {
+	json.Unmarshal([]byte(user.UserNameHistory), &ret)
+	return
+}
+
+//Language returns the IETF language tag of the user's telegram client
+func (user *User) Language() string {
+	return user.LanguageCode
+}
+
+//SetData sets internal UserData field to JSON representation of given value
+func (user *User) SetData(value interface{}) {
+	if user.storage != nil && !user.isNew {
+		if u, err := user.storage.FindUser(user.TelegramUserID); err == nil {
+			user.UserData = u.UserData
+		}
+	}
+	user.UserData = serialize(user.UserData, value)
+	user.Save()
+}
+
+//GetData extracts internal UserData field to given value
+func (user *User) GetData(value interface{}) {
+	if upgraded, changed := deserialize(user.UserData, value); changed {
+		user.UserData = upgraded
+		user.Save()
+	}
+}
+
+//Save saves the user to the storage
+func (user *User) Save() error {
+	if user.storage != nil {
+		if err := user.storage.SaveUser(user); err != nil {
+			return err
+		}
+		user.isNew = false
+		return nil
+	}
+	return fmt.Errorf("storage not set")
+}
+
+//updateProfile copies the profile fields from the telegram user and returns true if anything has changed
+func (user *User) updateProfile(from *tgbotapi.User) bool {
+	changed := false
+	if from.UserName != user.TelegramUserName {
+		user.UserNameHistory = appendUserNameHistory(user.UserNameHistory, user.TelegramUserName)
+		user.TelegramUserName = from.UserName
+		changed = true
+	}
+	if from.FirstName != user.FirstName || from.LastName != user.LastName {
+		user.FirstName = from.FirstName
+		user.LastName = from.LastName
+		changed = true
+	}
+	if from.LanguageCode != "" && from.LanguageCode != user.LanguageCode {
+		user.LanguageCode = from.LanguageCode
+		changed = true
+	}
+	return changed
+}
+
+//copyProfile copies the fields taken from telegram updates
+func (user *User) copyProfile(from *User) {
+	user.TelegramUserName = from.TelegramUserName
+	user.UserNameHistory = from.UserNameHistory
+	user.FirstName = from.FirstName
+	user.LastName = from.LastName
+	user.LanguageCode = from.LanguageCode
+}
+
+//appendUserNameHistory adds the username to JSON array of previous usernames
+func appendUserNameHistory(history string, userName string) string {
+	if userName == "" {
+		return history
+	}
+	logins := []string{}
+	json.Unmarshal([]byte(history), &logins)
+	d, _ := json.Marshal(append(logins, userName))
+	return string(d)
+}
+
+//UserLoader loads the user from the storage and refreshes the profile from given telegram user.
+//Only the profile is saved and only if something has changed, so UserData written by handlers
+//at the same time is kept
+func UserLoader(from *tgbotapi.User, storage UserStorage) UserInterface {
+	if from == nil {
+		return nil
+	}
+	user := userStorageLoader(int64(from.ID), storage)
+	if user.updateProfile(from) || user.isNew {
+		if err := storage.SaveUserProfile(user); err == nil {
+			user.isNew = false
+		}
+	}
+	return user
+}
+
+func userStorageLoader(TelegramUserID int64, storage UserStorage) *User {
+	user, err := storage.FindUser(TelegramUserID)
+	if err != nil {
+		user = &User{}
+		user.isNew = true
+		user.TelegramUserID = TelegramUserID
+		user.UserData = "{}"
+		user.CreatedAt = time.Now()
+	}
+	user.storage = storage
+	return user
+}
+
+//UserFactory loads the user profile for the sender of the update
+type UserFactory func(from *tgbotapi.User) UserInterface
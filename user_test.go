@@ -0,0 +1,39 @@
+package botmeans
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"testing"
+)
+
+func TestUser(t *testing.T) {
+	user := &User{TelegramUserID: 42, UserData: "{}", isNew: true}
+
+	if !user.updateProfile(&tgbotapi.User{ID: 42, UserName: "fuuu", FirstName: "John", LanguageCode: "en-US"}) {
+		t.Error("Should be changed")
+	}
+	if user.updateProfile(&tgbotapi.User{ID: 42, UserName: "fuuu", FirstName: "John"}) {
+		t.Error("Should not be changed")
+	}
+	if user.UserName() != "John" || user.Login() != "fuuu" || user.Language() != "en-US" {
+		t.Errorf("Wrong profile %+v", user)
+	}
+	if len(user.PreviousLogins()) != 0 {
+		t.Error("Should be empty")
+	}
+
+	user.updateProfile(&tgbotapi.User{ID: 42, UserName: "fuuu2", FirstName: "John"})
+	user.updateProfile(&tgbotapi.User{ID: 42, UserName: "fuuu3", FirstName: "John"})
+	if history := user.PreviousLogins(); len(history) != 2 || history[0] != "fuuu" || history[1] != "fuuu2" {
+		t.Errorf("Wrong history %v", history)
+	}
+
+	type TimeZone struct {
+		Offset int
+	}
+	user.SetData(TimeZone{3})
+	tz := TimeZone{}
+	user.GetData(&tz)
+	if tz.Offset != 3 {
+		t.Error("Should be 3")
+	}
+}